@@ -0,0 +1,47 @@
+package vimg
+
+import (
+	"runtime"
+	"sync"
+)
+
+// BatchItem is an image and the options to process it with, for ProcessBatch.
+type BatchItem struct {
+	Buffer  []byte
+	Options Options
+}
+
+// BatchResult is the outcome of processing a BatchItem, either the output image or the error that stopped it.
+type BatchResult struct {
+	Buffer []byte
+	Err    error
+}
+
+// ProcessBatch processes and saves each item on a Worker of runtime.NumCPU() threads. The results are in the same
+// order as the items, and an item that fails only sets its own Err, so one bad image doesn't abort the batch.
+func ProcessBatch(items []BatchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+	if len(items) == 0 {
+		return results
+	}
+
+	size := runtime.NumCPU()
+	if size > len(items) {
+		size = len(items)
+	}
+	w := NewWorker(size)
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(len(items))
+	for i := range items {
+		go func(i int) {
+			defer wg.Done()
+			buf, err := w.Submit(items[i].Buffer, items[i].Options)
+			results[i] = BatchResult{Buffer: buf, Err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,50 @@
+package vimg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProcessBatch(t *testing.T) {
+	valid := readFile("test.jpg")
+	items := []BatchItem{
+		{Buffer: valid, Options: Options{Width: 100, Height: 100}},
+		{Buffer: []byte("not an image at all, just some text")},
+		{Buffer: valid[:64]},
+		{Buffer: nil},
+		{Buffer: valid, Options: Options{Width: 50, Type: PNG}},
+	}
+
+	results := ProcessBatch(items)
+	if len(results) != len(items) {
+		t.Fatalf("Expected %d results, got %d", len(items), len(results))
+	}
+
+	for _, i := range []int{0, 4} {
+		if results[i].Err != nil {
+			t.Errorf("Expected item %d to succeed, got %s", i, results[i].Err)
+			continue
+		}
+		img, err := NewVipsImage(bytes.NewBuffer(results[i].Buffer), Options{})
+		if err != nil {
+			t.Errorf("Cannot read the output of item %d: %s", i, err)
+			continue
+		}
+		if size, _ := img.Dimensions(); size.Width != items[i].Options.Width {
+			t.Errorf("Expected item %d to be %d wide, got %d", i, items[i].Options.Width, size.Width)
+		}
+		img.DecrementReferenceCount()
+	}
+	if DetermineImageType(results[4].Buffer) != PNG {
+		t.Errorf("Expected item 4 to be a png")
+	}
+
+	for _, i := range []int{1, 2, 3} {
+		if results[i].Err == nil {
+			t.Errorf("Expected item %d to report an error", i)
+		}
+		if results[i].Buffer != nil {
+			t.Errorf("Expected no output for item %d", i)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package vimg
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"github.com/KarlAustin/refcount"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -25,6 +28,18 @@ func NewImage(buf *bytes.Buffer, o Options) (*Image, error) {
 	return ret, nil
 }
 
+// NewImageFromReader creates a new Image struct reading the image from r, see NewVipsImageFromReader.
+func NewImageFromReader(r io.Reader, o Options) (*Image, error) {
+	vimgImageBuffer.With(prometheus.Labels{"action":"request", "type":"image"}).Inc()
+	var err error
+	ret := AquireImage()
+	ret.VipsImage, err = NewVipsImageFromReader(r, o)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func ResetImage(i interface{}) error {
 	img, ok := i.(*Image)
 	if !ok {
@@ -84,6 +99,89 @@ func (i *Image) ResizeAndCrop(width, height int) error {
 	return i.Process()
 }
 
+// ResizeFit resizes the image into a box of width and height with the given mode, reporting whether any pixels were
+// cropped to do so. Only ResizeModeCover crops, and only when the box has a different aspect ratio to the image.
+func (i *Image) ResizeFit(width, height int, mode ResizeMode) (bool, error) {
+	size, err := i.VipsImage.Dimensions()
+	if err != nil {
+		return false, err
+	}
+	// The box applies after EXIF auto rotation
+	orientation, err := i.VipsImage.vipsExifOrientation()
+	if err != nil {
+		return false, err
+	}
+	if orientation >= 5 && !i.VipsImage.Options.NoAutoRotate {
+		size.Width, size.Height = size.Height, size.Width
+	}
+
+	// Put the sizing options back afterwards, so a following DSL call doesn't resize again
+	o := &i.VipsImage.Options
+	previous := *o
+	defer func() {
+		o.Width, o.Height = previous.Width, previous.Height
+		o.Crop, o.Force, o.MaintainAspect = previous.Crop, previous.Force, previous.MaintainAspect
+	}()
+
+	i.VipsImage.Options.Width = width
+	i.VipsImage.Options.Height = height
+	switch mode {
+	case ResizeModeCover:
+		i.VipsImage.Options.Crop = true
+	case ResizeModeFill:
+		i.VipsImage.Options.Force = true
+	default:
+		i.VipsImage.Options.MaintainAspect = true
+	}
+	if err = i.Process(); err != nil {
+		return false, err
+	}
+	if mode != ResizeModeCover {
+		return false, nil
+	}
+
+	// Cover scales the image until both sides fill the box, whatever sticks out of the box was cropped
+	scale := math.Max(float64(width)/float64(size.Width), float64(height)/float64(size.Height))
+	return math.Round(float64(size.Width)*scale) > float64(width) || math.Round(float64(size.Height)*scale) > float64(height), nil
+}
+
+// ResizeToPixelBudget downscales the image, preserving its aspect ratio, so the total number of pixels is no more
+// than maxPixels. Images already within the budget are left alone.
+func (i *Image) ResizeToPixelBudget(maxPixels int) error {
+	if maxPixels <= 0 {
+		return errors.New("The pixel budget must be positive")
+	}
+
+	size, err := i.VipsImage.Dimensions()
+	if err != nil {
+		return err
+	}
+	pixels := size.Width * size.Height
+	if pixels <= maxPixels {
+		return nil
+	}
+
+	// Round down so the budget is never exceeded
+	scale := math.Sqrt(float64(maxPixels) / float64(pixels))
+	width := int(math.Max(1, math.Floor(float64(size.Width)*scale)))
+	height := int(math.Max(1, math.Floor(float64(size.Height)*scale)))
+
+	// The size applies after EXIF auto rotation
+	orientation, err := i.VipsImage.vipsExifOrientation()
+	if err != nil {
+		return err
+	}
+	if orientation >= 5 && !i.VipsImage.Options.NoAutoRotate {
+		width, height = height, width
+	}
+
+	i.VipsImage.Options.Width = width
+	i.VipsImage.Options.Height = height
+	i.VipsImage.Options.Force = true
+
+	return i.Process()
+}
+
 // SmartCrop produces a thumbnail aiming at focus on the interesting part.
 func (i *Image) SmartCrop(width, height int) error {
 	i.VipsImage.Options.Width = width
@@ -94,6 +192,37 @@ func (i *Image) SmartCrop(width, height int) error {
 	return i.Process()
 }
 
+// SmartCropRect crops around the most interesting part and returns the image with the area taken, see
+// VipsImage.SmartCropRect.
+func (i *Image) SmartCropRect(width, height int) (*Image, ImageRect, error) {
+	rect, err := i.VipsImage.SmartCropRect(width, height)
+	if err != nil {
+		return nil, ImageRect{}, err
+	}
+	return i, rect, nil
+}
+
+// CropToFaces crops around the faces the detector finds and returns the image with the area taken, see
+// VipsImage.CropToFaces.
+func (i *Image) CropToFaces(width, height int, detector FaceDetector) (*Image, ImageRect, error) {
+	rect, err := i.VipsImage.CropToFaces(width, height, detector)
+	if err != nil {
+		return nil, ImageRect{}, err
+	}
+	return i, rect, nil
+}
+
+// ExtractBand keeps n bands from start, replacing the image with them, see VipsImage.ExtractBand.
+func (i *Image) ExtractBand(start, n int) error {
+	bands, err := i.VipsImage.ExtractBand(start, n)
+	if err != nil {
+		return err
+	}
+	i.VipsImage.DecrementReferenceCount()
+	i.VipsImage = bands
+	return nil
+}
+
 // Extract area from the by X/Y axis in the current image.
 func (i *Image) Extract(top, left, width, height int) error {
 	i.VipsImage.Options.Extract.Width = float32(width)
@@ -108,6 +237,25 @@ func (i *Image) Extract(top, left, width, height int) error {
 	return i.Process()
 }
 
+// CropRelative crops an area given in percentages of the image size, from 0 to 100, see Extract.Relative.
+func (i *Image) CropRelative(leftPct, topPct, widthPct, heightPct float64) error {
+	if leftPct < 0 || topPct < 0 || leftPct >= 100 || topPct >= 100 {
+		return fmt.Errorf("The crop offset must be from 0 to 100%%, got %g,%g", leftPct, topPct)
+	}
+	if widthPct <= 0 || heightPct <= 0 || widthPct > 100 || heightPct > 100 {
+		return fmt.Errorf("The crop size must be over 0 and up to 100%%, got %gx%g", widthPct, heightPct)
+	}
+	i.VipsImage.Options.Extract = Extract{
+		Left:     float32(leftPct),
+		Top:      float32(topPct),
+		Width:    float32(widthPct),
+		Height:   float32(heightPct),
+		Relative: true,
+	}
+
+	return i.Process()
+}
+
 // Enlarge enlarges the image by width and height. Aspect ratio is maintained.
 func (i *Image) Enlarge(width, height int) error {
 	i.VipsImage.Options.Width = width
@@ -183,12 +331,45 @@ func (i *Image) Zoom(factor int) error {
 	return i.Process()
 }
 
+// Median removes salt and pepper noise with a size x size median filter, size must be odd.
+func (i *Image) Median(size int) error {
+	if err := validateMedian(size); err != nil {
+		return err
+	}
+	i.VipsImage.Options.Median = size
+	return i.Process()
+}
+
+// BlurRadius blurs the image by a radius in pixels rather than a sigma, see GaussianBlurRadius for the conversion.
+func (i *Image) BlurRadius(radiusPx float64) error {
+	if radiusPx <= 0 {
+		return errors.New("Blur radius must be above 0")
+	}
+	i.VipsImage.Options.GaussianBlur = GaussianBlurRadius(radiusPx)
+	return i.Process()
+}
+
 // Rotate rotates the image by given angle degrees (0, 90, 180 or 270).
 func (i *Image) Rotate(a Angle) error {
 	i.VipsImage.Options.Rotate = a
 	return i.Process()
 }
 
+// FlattenOnto flattens any alpha onto the given colour, black included, see VipsImage.FlattenOnto.
+func (i *Image) FlattenOnto(c Color) error {
+	return i.VipsImage.FlattenOnto(c)
+}
+
+// FlattenTo flattens any alpha onto the given colour and saves the image as t, see VipsImage.FlattenTo.
+func (i *Image) FlattenTo(background Color, t ImageType) ([]byte, error) {
+	return i.VipsImage.FlattenTo(background, t)
+}
+
+// RotateFloat rotates the image by any angle in degrees, see VipsImage.RotateFloat.
+func (i *Image) RotateFloat(degrees float64) error {
+	return i.VipsImage.RotateFloat(degrees)
+}
+
 // Flip flips the image about the vertical Y axis.
 func (i *Image) Flip() error {
 	i.VipsImage.Options.Flip = true
@@ -208,7 +389,8 @@ func (i *Image) Fly() error {
 	return errors.New("Don't care if I die")
 }
 
-// Convert converts image to another format.
+// Convert converts image to another format. Without any size options it's a pure transcode, the output keeps the
+// input's dimensions after auto-rotation.
 func (i *Image) Convert(t ImageType) error {
 	i.VipsImage.Options.Type = t
 	return i.Process()
@@ -227,6 +409,38 @@ func (i *Image) Trim() error {
 	return i.Process()
 }
 
+// TrimBox returns the area Trim would keep without trimming, see VipsImage.TrimBox.
+func (i *Image) TrimBox() (ImageRect, error) {
+	return i.VipsImage.TrimBox()
+}
+
+// TrimWithInfo trims the background and reports how much came off each edge, see VipsImage.TrimWithInfo.
+func (i *Image) TrimWithInfo(background Color, threshold float64) (TrimInfo, error) {
+	return i.VipsImage.TrimWithInfo(background, threshold)
+}
+
+// Grayscale converts the image to a single band B&W image.
+// Set Options.KeepAlpha to retain the alpha channel.
+func (i *Image) Grayscale() error {
+	i.VipsImage.Options.Grayscale = true
+	return i.Process()
+}
+
+// AutoOrient applies the EXIF orientation correction without the rest of the processing pipeline.
+func (i *Image) AutoOrient() error {
+	return i.VipsImage.AutoOrient()
+}
+
+// AutoRotate applies the EXIF orientation, strips the orientation tag and saves, without the rest of the processing
+// pipeline. It's meant for normalizing uploads before storage.
+func (i *Image) AutoRotate() (*[]byte, error) {
+	err := i.VipsImage.AutoRotate()
+	if err != nil {
+		return nil, err
+	}
+	return i.GetBuffer(), nil
+}
+
 func (i *Image) GetICCProfile() ([]byte, error) {
 	ret, err := i.VipsImage.GetICCProfile()
 	if err != nil {
@@ -235,6 +449,57 @@ func (i *Image) GetICCProfile() ([]byte, error) {
 	return ret, nil
 }
 
+// SetICCProfile embeds the given ICC profile, replacing any existing one.
+func (i *Image) SetICCProfile(profile []byte) error {
+	return i.VipsImage.SetICCProfile(profile)
+}
+
+// WouldEnlarge reports whether processing with the given options would enlarge the image.
+func (i *Image) WouldEnlarge(o Options) (bool, error) {
+	return i.VipsImage.WouldEnlarge(o)
+}
+
+// RenderVectorToWidth renders an SVG or PDF at exactly width pixels wide, see VipsImage.RenderVectorToWidth.
+func (i *Image) RenderVectorToWidth(width int) error {
+	return i.VipsImage.RenderVectorToWidth(width)
+}
+
+// Composite draws the overlay image onto the image at x, y, see VipsImage.Composite.
+func (i *Image) Composite(overlayBuf []byte, mode BlendMode, x, y int) error {
+	overlay, err := NewVipsImage(bytes.NewBuffer(overlayBuf), Options{})
+	if err != nil {
+		return err
+	}
+	defer overlay.DecrementReferenceCount()
+
+	return i.VipsImage.Composite(overlay, mode, x, y)
+}
+
+// ContactSheet lays out every page or frame in a grid, see VipsImage.ContactSheet.
+func (i *Image) ContactSheet(cols int, thumbWidth int, padding int, background Color) (*VipsImage, error) {
+	return i.VipsImage.ContactSheet(cols, thumbWidth, padding, background)
+}
+
+// CompositeMulti draws several layers onto the image in one pass, see VipsImage.CompositeMulti.
+func (i *Image) CompositeMulti(layers []CompositeLayer) error {
+	return i.VipsImage.CompositeMulti(layers)
+}
+
+// IsBlank reports whether the image is a near-solid colour, see VipsImage.IsBlank.
+func (i *Image) IsBlank(tolerance float64) (bool, error) {
+	return i.VipsImage.IsBlank(tolerance)
+}
+
+// Apply runs an arbitrary libvips operation by name, see VipsImage.Apply.
+func (i *Image) Apply(operation string, args map[string]interface{}) error {
+	return i.VipsImage.Apply(operation, args)
+}
+
+// DeltaE returns the mean CIEDE2000 colour difference against another image of the same size.
+func (i *Image) DeltaE(other *Image) (float64, error) {
+	return i.VipsImage.DeltaE(other.VipsImage)
+}
+
 // Process processes the image based on the given transformation options,
 // talking with libvips bindings accordingly and returning the resultant
 // image buffer.
@@ -254,6 +519,41 @@ func (i *Image) Save() (*[]byte, error) {
 	return i.GetBuffer(), nil
 }
 
+// ProcessAndDescribe processes and saves the image, returning its metadata too, see VipsImage.ProcessAndDescribe.
+func (i *Image) ProcessAndDescribe(o Options) ([]byte, ImageMetadata, error) {
+	return i.VipsImage.ProcessAndDescribe(o)
+}
+
+// SaveWithSSIM saves at the lowest quality meeting an SSIM target, see VipsImage.SaveWithSSIM.
+func (i *Image) SaveWithSSIM(target float64, o Options) ([]byte, int, error) {
+	return i.VipsImage.SaveWithSSIM(target, o)
+}
+
+// SaveToTempFile processes and saves the image straight to a temporary file, see VipsImage.SaveToTempFile.
+func (i *Image) SaveToTempFile(o Options) (string, func(), error) {
+	return i.VipsImage.SaveToTempFile(o)
+}
+
+// EstimateOutputSize roughly estimates the bytes saving with o would take, see VipsImage.EstimateOutputSize.
+func (i *Image) EstimateOutputSize(o Options) (int, error) {
+	return i.VipsImage.EstimateOutputSize(o)
+}
+
+// ConvertICCVariants encodes the image once per named ICC profile, see VipsImage.ConvertICCVariants.
+func (i *Image) ConvertICCVariants(profiles map[string][]byte) (map[string][]byte, error) {
+	return i.VipsImage.ConvertICCVariants(profiles)
+}
+
+// SaveAs processes and saves the image with the saver and options a libvips style suffix picks, see VipsImage.SaveAs.
+func (i *Image) SaveAs(suffix string, o Options) ([]byte, error) {
+	return i.VipsImage.SaveAs(suffix, o)
+}
+
+// SaveTo encodes the image straight to w, see VipsImage.SaveTo.
+func (i *Image) SaveTo(w io.Writer) error {
+	return i.VipsImage.SaveTo(w)
+}
+
 func (i *Image) GetBuffer() *[]byte {
 	return &i.VipsImage.Buffer
 }
@@ -281,6 +581,26 @@ func (i *Image) Type() string {
 	return DetermineImageTypeName(*i.GetBuffer())
 }
 
+// Header returns all the libvips header fields as strings, see VipsImage.Header.
+func (i *Image) Header() (map[string]string, error) {
+	return i.VipsImage.Header()
+}
+
+// Dimensions returns the image width and height without the cost of reading the full metadata.
+func (i *Image) Dimensions() (ImageSize, error) {
+	return i.VipsImage.Dimensions()
+}
+
+// Bands returns the number of bands, e.g. 3 for RGB.
+func (i *Image) Bands() int {
+	return i.VipsImage.Bands()
+}
+
+// Shape returns "portrait", "landscape" or "square" once auto-rotated, see VipsImage.Shape.
+func (i *Image) Shape() (string, error) {
+	return i.VipsImage.Shape()
+}
+
 // Size returns the image size as form of width and height pixels.
 func (i *Image) Size() (ImageSize, error) {
 	m, err := i.Metadata()
@@ -301,4 +621,89 @@ func (i *Image) Length() int {
 func (i *Image) Gamma(exponent float64) error {
 	i.VipsImage.Options.Gamma = exponent
 	return i.Process()
-}
\ No newline at end of file
+}
+
+// Pipeline collects transformations for an Image and applies them all with a single Process, rather than the
+// separate pass each DSL method makes.
+type Pipeline struct {
+	image   *Image
+	options Options
+}
+
+// Pipe starts a Pipeline from the image's current options. Nothing is applied until Run is called.
+func (i *Image) Pipe() *Pipeline {
+	return &Pipeline{image: i, options: i.VipsImage.Options}
+}
+
+// Resize resizes the image to fixed width and height.
+func (p *Pipeline) Resize(width, height int) *Pipeline {
+	p.options.Width = width
+	p.options.Height = height
+	p.options.Embed = true
+	return p
+}
+
+// ForceResize resizes with custom size (aspect ratio won't be maintained).
+func (p *Pipeline) ForceResize(width, height int) *Pipeline {
+	p.options.Width = width
+	p.options.Height = height
+	p.options.Force = true
+	return p
+}
+
+// Crop crops the image to the exact size specified.
+func (p *Pipeline) Crop(width, height int, gravity Gravity) *Pipeline {
+	p.options.Width = width
+	p.options.Height = height
+	p.options.Crop = true
+	p.options.Gravity = gravity
+	return p
+}
+
+// Sharpen sharpens the image with the given parameters.
+func (p *Pipeline) Sharpen(s Sharpen) *Pipeline {
+	p.options.Sharpen = s
+	return p
+}
+
+// Rotate rotates the image by given angle degrees (0, 90, 180 or 270).
+func (p *Pipeline) Rotate(a Angle) *Pipeline {
+	p.options.Rotate = a
+	return p
+}
+
+// Flip flips the image about the vertical Y axis.
+func (p *Pipeline) Flip() *Pipeline {
+	p.options.Flip = true
+	return p
+}
+
+// Flop flops the image about the horizontal X axis.
+func (p *Pipeline) Flop() *Pipeline {
+	p.options.Flop = true
+	return p
+}
+
+// Grayscale converts the image to a single band B&W image.
+func (p *Pipeline) Grayscale() *Pipeline {
+	p.options.Grayscale = true
+	return p
+}
+
+// Gamma applies a gamma filter.
+func (p *Pipeline) Gamma(exponent float64) *Pipeline {
+	p.options.Gamma = exponent
+	return p
+}
+
+// Convert converts image to another format.
+func (p *Pipeline) Convert(t ImageType) *Pipeline {
+	p.options.Type = t
+	return p
+}
+
+// Run applies the collected transformations in one Process.
+func (p *Pipeline) Run() error {
+	p.image.VipsImage.Options = p.options
+	return p.image.Process()
+}
@@ -1,7 +1,14 @@
 package vimg
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/rand"
 	"path"
 	"testing"
 )
@@ -475,6 +482,310 @@ func TestImageSmartCrop(t *testing.T) {
 	Write("testdata/test_smart_crop.jpg", buf)
 }
 
+func TestImageSmartCropRect(t *testing.T) {
+	if VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.8", VipsVersion)
+	}
+
+	i, err := NewImage(bytes.NewBuffer(readFile("northern_cardinal_bird.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	before, _ := i.Dimensions()
+
+	cropped, rect, err := i.SmartCropRect(300, 200)
+	if err != nil {
+		t.Fatalf("Cannot smart crop the image: %s", err)
+	}
+	if rect.Width != 300 || rect.Height != 200 {
+		t.Errorf("Expected a 300x200 rect, got %+v", rect)
+	}
+	if rect.Left < 0 || rect.Top < 0 || rect.Left+rect.Width > before.Width || rect.Top+rect.Height > before.Height {
+		t.Errorf("Expected %+v to be within %dx%d", rect, before.Width, before.Height)
+	}
+	if size, _ := cropped.Dimensions(); size.Width != rect.Width || size.Height != rect.Height {
+		t.Errorf("Expected the image to be cropped to the rect, got %dx%d", size.Width, size.Height)
+	}
+}
+
+func TestImageBlurRadius(t *testing.T) {
+	// A checkerboard of 8 pixel squares
+	board := image.NewGray(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			if (x/8+y/8)%2 == 0 {
+				board.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, board); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	// The high frequency energy, the mean difference between neighbouring pixels
+	energy := func(radius float64) float64 {
+		i, err := NewImage(bytes.NewBuffer(buf.Bytes()), Options{Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer i.DecrementReferenceCount()
+		if radius > 0 {
+			if err = i.BlurRadius(radius); err != nil {
+				t.Fatalf("Cannot blur the image: %s", err)
+			}
+		}
+		out, err := i.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(*out))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		var sum float64
+		bounds := decoded.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X + 1; x < bounds.Max.X; x++ {
+				a := color.GrayModel.Convert(decoded.At(x-1, y)).(color.Gray)
+				b := color.GrayModel.Convert(decoded.At(x, y)).(color.Gray)
+				sum += math.Abs(float64(a.Y) - float64(b.Y))
+			}
+		}
+		return sum / float64(bounds.Dx()*bounds.Dy())
+	}
+
+	sharp, small, large := energy(0), energy(2), energy(6)
+	if !(sharp > small && small > large) {
+		t.Errorf("Expected a larger radius to be blurrier, got energies %g, %g at 2px and %g at 6px", sharp, small, large)
+	}
+
+	if blur := GaussianBlurRadius(10); math.Abs(blur.Sigma-5.574) > 0.01 || blur.MinAmpl != BlurMinAmpl {
+		t.Errorf("Expected a 10px radius to be sigma 5.574, got %+v", blur)
+	}
+	i, err := NewImage(bytes.NewBuffer(buf.Bytes()), Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	if err = i.BlurRadius(0); err == nil {
+		t.Error("Expected an error for a radius of 0")
+	}
+}
+
+func TestImageMedian(t *testing.T) {
+	// Flat grey with salt and pepper on about one pixel in twenty
+	random := rand.New(rand.NewSource(1))
+	noisy := image.NewGray(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			v := uint8(128)
+			if random.Intn(20) == 0 {
+				v = uint8(255 * random.Intn(2))
+			}
+			noisy.SetGray(x, y, color.Gray{v})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, noisy); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	variance := func(b []byte) float64 {
+		decoded, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		var sum, sum2, n float64
+		bounds := decoded.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				v := float64(color.GrayModel.Convert(decoded.At(x, y)).(color.Gray).Y)
+				sum += v
+				sum2 += v * v
+				n++
+			}
+		}
+		mean := sum / n
+		return sum2/n - mean*mean
+	}
+
+	i, err := NewImage(bytes.NewBuffer(buf.Bytes()), Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	if err = i.Median(4); err == nil {
+		t.Error("Expected an error for an even size")
+	}
+	if err = i.Median(3); err != nil {
+		t.Fatalf("Cannot filter the image: %s", err)
+	}
+	out, err := i.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	before, after := variance(buf.Bytes()), variance(*out)
+	if after >= before/10 {
+		t.Errorf("Expected the median filter to remove most of the noise, the variance went from %g to %g", before, after)
+	}
+}
+
+func TestImageExtractBand(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			red.Set(x, y, color.RGBA{R: 200, G: 80, B: 60, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, red); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	img, err := NewImage(buf, Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	if err = img.ExtractBand(1, 1); err != nil {
+		t.Fatalf("Cannot extract the green band: %s", err)
+	}
+	if bands := img.VipsImage.Bands(); bands != 1 {
+		t.Errorf("Expected the image to be replaced by a single band, got %d", bands)
+	}
+	out, err := img.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(*out))
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+	if v := color.GrayModel.Convert(decoded.At(4, 4)).(color.Gray).Y; v != 80 {
+		t.Errorf("Expected the green value 80, got %d", v)
+	}
+
+	// A failed extraction leaves the image alone
+	if err = img.ExtractBand(1, 1); err == nil {
+		t.Error("Expected an error extracting past the last band")
+	}
+	if bands := img.VipsImage.Bands(); bands != 1 {
+		t.Errorf("Expected the image to be kept, got %d bands", bands)
+	}
+}
+
+func TestImageResizeFit(t *testing.T) {
+	cases := []struct {
+		sourceWidth   int
+		width, height int
+		mode          ResizeMode
+		cropped       bool
+	}{
+		{400, 100, 100, ResizeModeCover, true},
+		{400, 200, 150, ResizeModeCover, false},
+		{400, 100, 100, ResizeModeFit, false},
+		{400, 100, 100, ResizeModeFill, false},
+		// A single column is still a crop
+		{401, 400, 300, ResizeModeCover, true},
+	}
+	for _, c := range cases {
+		// A 4:3 image, or just wider
+		source := &bytes.Buffer{}
+		if err := png.Encode(source, image.NewRGBA(image.Rect(0, 0, c.sourceWidth, 300))); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		img, err := NewImage(source, Options{Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		cropped, err := img.ResizeFit(c.width, c.height, c.mode)
+		if err != nil {
+			t.Fatalf("Cannot resize the image to %dx%d: %s", c.width, c.height, err)
+		}
+		if cropped != c.cropped {
+			t.Errorf("Expected cropped to be %t resizing %dx300 to %dx%d with mode %d", c.cropped, c.sourceWidth, c.width, c.height, c.mode)
+		}
+		if o := img.VipsImage.Options; o.Width != 0 || o.Height != 0 || o.Crop || o.Force {
+			t.Errorf("Expected the sizing options to be reset, got %dx%d crop %t force %t", o.Width, o.Height, o.Crop, o.Force)
+		}
+		out, err := img.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		width, height, _, err := DecodeConfig(*out)
+		if err != nil {
+			t.Fatalf("Cannot read the resized image: %s", err)
+		}
+		if c.mode != ResizeModeFit && (width != c.width || height != c.height) {
+			t.Errorf("Expected %dx%d, got %dx%d", c.width, c.height, width, height)
+		}
+		if c.mode == ResizeModeFit && (width != 100 || height != 75) {
+			t.Errorf("Expected the image to fit at 100x75, got %dx%d", width, height)
+		}
+	}
+}
+
+func TestImageCropRelative(t *testing.T) {
+	crop := func(apply func(i *Image) error) []byte {
+		i, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer i.DecrementReferenceCount()
+		if err = apply(i); err != nil {
+			t.Fatalf("Cannot crop the image: %s", err)
+		}
+		out, err := i.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return *out
+	}
+	width, height, _, err := DecodeConfig(readFile("test.jpg"))
+	if err != nil {
+		t.Fatalf("Cannot read the image size: %s", err)
+	}
+
+	// The centre half, with the edges rounded the same way
+	left, top := int(math.Round(float64(width)/4)), int(math.Round(float64(height)/4))
+	right, bottom := int(math.Round(float64(width)*3/4)), int(math.Round(float64(height)*3/4))
+	relative := crop(func(i *Image) error { return i.CropRelative(25, 25, 50, 50) })
+	absolute := crop(func(i *Image) error { return i.Extract(top, left, right-left, bottom-top) })
+
+	outWidth, outHeight, _, err := DecodeConfig(relative)
+	if err != nil {
+		t.Fatalf("Cannot read the cropped image: %s", err)
+	}
+	if outWidth != right-left || outHeight != bottom-top {
+		t.Errorf("Expected %dx%d, got %dx%d", right-left, bottom-top, outWidth, outHeight)
+	}
+	if !bytes.Equal(relative, absolute) {
+		t.Error("Expected the relative crop to match the absolute one")
+	}
+
+	// Areas running off the image are clamped to it
+	clamped := crop(func(i *Image) error { return i.CropRelative(75, 75, 50, 50) })
+	if outWidth, outHeight, _, err = DecodeConfig(clamped); err != nil {
+		t.Fatalf("Cannot read the cropped image: %s", err)
+	}
+	if outWidth != width-right || outHeight != height-bottom {
+		t.Errorf("Expected the crop clamped to %dx%d, got %dx%d", width-right, height-bottom, outWidth, outHeight)
+	}
+
+	i, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	if err = i.CropRelative(10, 10, 0, 50); err == nil {
+		t.Error("Expected an empty crop to fail")
+	}
+}
+
 func TestImageTrim(t *testing.T) {
 
 	if !(VipsMajorVersion >= 8 && VipsMinorVersion >= 6) {
@@ -531,6 +842,664 @@ func TestImageLength(t *testing.T) {
 	}
 }
 
+func TestImageGrayscale(t *testing.T) {
+	files := []string{"test.jpg", "test.png", "test.webp", "transparent.png"}
+
+	for _, file := range files {
+		i, err := NewImage(bytes.NewBuffer(readFile(file)), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s -> %s", file, err)
+		}
+
+		err = i.Grayscale()
+		if err != nil {
+			t.Errorf("Cannot process the image: %#v", err)
+		}
+
+		metadata, err := i.VipsImage.Metadata()
+		if err != nil {
+			t.Fatalf("Cannot read the metadata: %s -> %s", file, err)
+		}
+		if metadata.Channels != 1 {
+			t.Errorf("Unexpected number of channels for %s: %d", file, metadata.Channels)
+		}
+	}
+}
+
+func TestNewImageFromReader(t *testing.T) {
+	buf := readFile("test.jpg")
+
+	i, err := NewImageFromReader(bytes.NewReader(buf), Options{MaxBytes: int64(len(buf))})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	if i.VipsImage.Type != JPEG {
+		t.Errorf("Unexpected image type: %s", ImageTypeName(i.VipsImage.Type))
+	}
+
+	_, err = NewImageFromReader(bytes.NewReader(buf), Options{MaxBytes: int64(len(buf) - 1)})
+	if err != ErrMaxBytesExceeded {
+		t.Errorf("Expected ErrMaxBytesExceeded, got %v", err)
+	}
+}
+
+func TestImageAutoOrient(t *testing.T) {
+	o := Options{Quality: 80, Type: JPEG}
+	i, err := NewImage(bytes.NewBuffer(readFile("exif/Landscape_6.jpg")), o)
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	before, err := i.VipsImage.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if before.Orientation != 6 {
+		t.Fatalf("Expected orientation 6, got %d", before.Orientation)
+	}
+
+	err = i.AutoOrient()
+	if err != nil {
+		t.Fatalf("Cannot orient the image: %s", err)
+	}
+
+	after, err := i.VipsImage.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if after.Size.Width != before.Size.Height || after.Size.Height != before.Size.Width {
+		t.Errorf("Expected %dx%d, got %dx%d", before.Size.Height, before.Size.Width, after.Size.Width, after.Size.Height)
+	}
+	if after.Orientation != 1 {
+		t.Errorf("Expected orientation 1, got %d", after.Orientation)
+	}
+	if after.Type != before.Type || after.Channels != before.Channels || after.Space != before.Space {
+		t.Errorf("Expected only the orientation to change, got %+v from %+v", after, before)
+	}
+	if opts := i.VipsImage.Options; opts.Quality != o.Quality || opts.Type != o.Type || opts.Rotate != o.Rotate {
+		t.Errorf("Expected the options to be untouched, got %+v", opts)
+	}
+}
+
+func TestImageWorkingSpaceScRGB(t *testing.T) {
+	// A smooth grey ramp using every 8-bit value
+	ramp := image.NewRGBA(image.Rect(0, 0, 256, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 256; x++ {
+			ramp.Set(x, y, color.RGBA{R: uint8(x), G: uint8(x), B: uint8(x), A: 255})
+		}
+	}
+	source := &bytes.Buffer{}
+	if err := png.Encode(source, ramp); err != nil {
+		t.Fatalf("Cannot encode the ramp: %s", err)
+	}
+
+	// A gamma chain that cancels out, in 8-bit the dark tones are crushed by the first step
+	distinct := func(o Options) int {
+		i, err := NewImage(bytes.NewBuffer(source.Bytes()), o)
+		if err != nil {
+			t.Fatalf("Cannot read the ramp: %s", err)
+		}
+		defer i.DecrementReferenceCount()
+		for _, exponent := range []float64{0.25, 4.0, 0.5, 2.0} {
+			err = i.Gamma(exponent)
+			if err != nil {
+				t.Fatalf("Cannot apply gamma %f: %s", exponent, err)
+			}
+		}
+		buf, err := i.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the ramp: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(*buf))
+		if err != nil {
+			t.Fatalf("Cannot decode the ramp: %s", err)
+		}
+
+		values := map[uint32]bool{}
+		for x := 0; x < 256; x++ {
+			r, _, _, _ := out.At(x, 0).RGBA()
+			values[r>>8] = true
+		}
+		return len(values)
+	}
+
+	eightBit := distinct(Options{})
+	scRGB := distinct(Options{WorkingSpace: InterpretationScRGB})
+	if scRGB <= eightBit {
+		t.Errorf("Expected the scRGB working space to keep more distinct values than 8-bit, got %d and %d", scRGB, eightBit)
+	}
+}
+
+func TestImageResizeToPixelBudget(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 4000, 3000))); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	i, err := NewImage(buf, Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	if err = i.ResizeToPixelBudget(1000000); err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	size, err := i.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+	if size.Width*size.Height > 1000000 {
+		t.Errorf("Expected at most 1000000 pixels, got %dx%d", size.Width, size.Height)
+	}
+	if aspect := float64(size.Width) / float64(size.Height); aspect < 1.33 || aspect > 1.34 {
+		t.Errorf("Expected a 4:3 aspect ratio, got %dx%d", size.Width, size.Height)
+	}
+
+	// Already within budget
+	if err = i.ResizeToPixelBudget(2000000); err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if after, _ := i.Dimensions(); after != size {
+		t.Errorf("Expected %+v to be left alone, got %+v", size, after)
+	}
+}
+
+func TestImageAutoRotate(t *testing.T) {
+	for _, file := range []string{"exif/Landscape_6.jpg", "exif/Landscape_8.jpg"} {
+		i, err := NewImage(bytes.NewBuffer(readFile(file)), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		stored, err := i.Dimensions()
+		if err != nil {
+			t.Fatalf("Cannot read the dimensions: %s", err)
+		}
+
+		buf, err := i.AutoRotate()
+		if err != nil {
+			t.Fatalf("Cannot rotate %s: %s", file, err)
+		}
+		out, err := NewVipsImage(bytes.NewBuffer(*buf), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the rotated image: %s", err)
+		}
+		m, err := out.Metadata()
+		if err != nil {
+			t.Fatalf("Cannot read the metadata: %s", err)
+		}
+		if m.Size.Width != stored.Height || m.Size.Height != stored.Width {
+			t.Errorf("Expected %s to be %dx%d, got %dx%d", file, stored.Height, stored.Width, m.Size.Width, m.Size.Height)
+		}
+		if m.Orientation > 1 {
+			t.Errorf("Expected %s to have its orientation reset, got %d", file, m.Orientation)
+		}
+		out.DecrementReferenceCount()
+		i.DecrementReferenceCount()
+	}
+}
+
+func TestImageConvertKeepsDimensions(t *testing.T) {
+	if !IsTypeSupportedSave(WEBP) {
+		t.Skip("WEBP saving is not supported")
+	}
+	i, err := NewImage(bytes.NewBuffer(readFile("exif/Landscape_6.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	// Orientation 6 is rotated by 90 degrees, so the visual size is the stored size swapped
+	stored, err := i.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+
+	if err = i.Convert(WEBP); err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	buf, err := i.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if DetermineImageType(*buf) != WEBP {
+		t.Fatalf("Expected a webp, got %s", DetermineImageTypeName(*buf))
+	}
+
+	out, err := NewVipsImage(bytes.NewBuffer(*buf), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the converted image: %s", err)
+	}
+	defer out.DecrementReferenceCount()
+	size, err := out.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+	if size.Width != stored.Height || size.Height != stored.Width {
+		t.Errorf("Expected %dx%d, got %dx%d", stored.Height, stored.Width, size.Width, size.Height)
+	}
+}
+
+func TestImageComposite(t *testing.T) {
+	// A transparent badge with an opaque red square in the middle
+	badge := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 5; y < 15; y++ {
+		for x := 5; x < 15; x++ {
+			badge.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	overlay := &bytes.Buffer{}
+	if err := png.Encode(overlay, badge); err != nil {
+		t.Fatalf("Cannot encode the overlay: %s", err)
+	}
+
+	i, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	before, _ := i.Dimensions()
+
+	if err = i.Composite(overlay.Bytes(), BlendOver, 10, 10); err != nil {
+		t.Fatalf("Cannot composite the image: %s", err)
+	}
+	m, err := i.VipsImage.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if m.Size != before || m.Alpha {
+		t.Errorf("Expected %+v without alpha, got %+v with alpha %t", before, m.Size, m.Alpha)
+	}
+
+	buf, err := i.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(*buf))
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+	if r, g, b, _ := out.At(20, 20).RGBA(); r>>8 != 255 || g>>8 != 0 || b>>8 != 0 {
+		t.Errorf("Expected the badge to be red at 20,20, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestImageAlphaMask(t *testing.T) {
+	// A white disc on black, smaller than the image so it's stretched to fit
+	disc := image.NewGray(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			if math.Hypot(float64(x)-49.5, float64(y)-49.5) < 45 {
+				disc.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	mask := &bytes.Buffer{}
+	if err := png.Encode(mask, disc); err != nil {
+		t.Fatalf("Cannot encode the mask: %s", err)
+	}
+
+	// The 8-bit mask has to be scaled up to the alpha range of a 16-bit image
+	deep := image.NewRGBA64(image.Rect(0, 0, 200, 150))
+	draw.Draw(deep, deep.Bounds(), &image.Uniform{color.RGBA64{0x8000, 0x4000, 0x2000, 0xffff}}, image.Point{}, draw.Src)
+	deepPNG := &bytes.Buffer{}
+	if err := png.Encode(deepPNG, deep); err != nil {
+		t.Fatalf("Cannot encode the 16-bit image: %s", err)
+	}
+
+	for name, source := range map[string][]byte{"test.jpg": readFile("test.jpg"), "16-bit PNG": deepPNG.Bytes()} {
+		i, err := NewImage(bytes.NewBuffer(source), Options{Type: PNG, AlphaMask: mask.Bytes()})
+		if err != nil {
+			t.Fatalf("Cannot read %s: %s", name, err)
+		}
+		defer i.DecrementReferenceCount()
+		if err = i.Process(); err != nil {
+			t.Fatalf("Cannot process %s: %s", name, err)
+		}
+		buf, err := i.Save()
+		if err != nil {
+			t.Fatalf("Cannot save %s: %s", name, err)
+		}
+		out, err := png.Decode(bytes.NewReader(*buf))
+		if err != nil {
+			t.Fatalf("Cannot decode %s: %s", name, err)
+		}
+
+		b := out.Bounds()
+		for _, corner := range []image.Point{{0, 0}, {b.Dx() - 1, 0}, {0, b.Dy() - 1}, {b.Dx() - 1, b.Dy() - 1}} {
+			if _, _, _, a := out.At(corner.X, corner.Y).RGBA(); a != 0 {
+				t.Errorf("Expected the corner of %s at %v to be transparent, got alpha %d", name, corner, a>>8)
+			}
+		}
+		if _, _, _, a := out.At(b.Dx()/2, b.Dy()/2).RGBA(); a>>8 != 255 {
+			t.Errorf("Expected the centre of %s to be opaque, got alpha %d", name, a>>8)
+		}
+	}
+}
+
+func TestImageProcessAndDescribe(t *testing.T) {
+	i, err := NewImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	buf, m, err := i.ProcessAndDescribe(Options{Width: 200, Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	out, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the processed image: %s", err)
+	}
+	defer out.DecrementReferenceCount()
+	actual, err := out.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if m.Size != actual.Size {
+		t.Errorf("Expected %+v, got %+v", actual.Size, m.Size)
+	}
+	if m.Type != "jpeg" || m.Alpha != actual.Alpha || m.Channels != actual.Channels {
+		t.Errorf("Expected a %s with %d channels, got a %s with %d", actual.Type, actual.Channels, m.Type, m.Channels)
+	}
+
+	// The colour conversions before the save show up in the metadata
+	bw, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer bw.DecrementReferenceCount()
+	buf, m, err = bw.ProcessAndDescribe(Options{Width: 200, Type: JPEG, Interpretation: InterpretationBW})
+	if err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	grey, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the processed image: %s", err)
+	}
+	defer grey.DecrementReferenceCount()
+	if actual, err = grey.Metadata(); err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if m.Space != actual.Space || m.Channels != actual.Channels {
+		t.Errorf("Expected %s with %d channels, got %s with %d", actual.Space, actual.Channels, m.Space, m.Channels)
+	}
+}
+
+func TestImageSaveTo(t *testing.T) {
+	// A PNG of this size spans several chunks
+	opts := Options{Type: PNG, Width: 800}
+	saved, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), opts)
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+	if err = saved.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	buf, err := saved.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	streamed, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), opts)
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer streamed.DecrementReferenceCount()
+	if err = streamed.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	out := &bytes.Buffer{}
+	if err = streamed.SaveTo(out); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	if out.Len() <= saveChunkSize {
+		t.Errorf("Expected more than one chunk, got %d bytes", out.Len())
+	}
+	if !bytes.Equal(out.Bytes(), *buf) {
+		t.Errorf("Expected the streamed image to match Save, got %d bytes against %d", out.Len(), len(*buf))
+	}
+}
+
+func TestImageFlattenOnto(t *testing.T) {
+	transparent := &bytes.Buffer{}
+	if err := png.Encode(transparent, image.NewNRGBA(image.Rect(0, 0, 20, 20))); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	flatten := map[string]func(i *Image) error{
+		"FlattenOnto": func(i *Image) error { return i.FlattenOnto(ColorBlack) },
+		"Options.BackgroundSet": func(i *Image) error {
+			i.VipsImage.Options.BackgroundSet = true
+			return i.Process()
+		},
+	}
+	for name, fn := range flatten {
+		i, err := NewImage(bytes.NewBuffer(transparent.Bytes()), Options{Type: PNG, Background: ColorBlack})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = fn(i); err != nil {
+			t.Fatalf("%s: cannot flatten the image: %s", name, err)
+		}
+		buf, err := i.Save()
+		if err != nil {
+			t.Fatalf("%s: cannot save the image: %s", name, err)
+		}
+		out, err := png.Decode(bytes.NewReader(*buf))
+		i.DecrementReferenceCount()
+		if err != nil {
+			t.Fatalf("%s: cannot decode the image: %s", name, err)
+		}
+		if r, g, b, a := out.At(10, 10).RGBA(); r != 0 || g != 0 || b != 0 || a>>8 != 255 {
+			t.Errorf("%s: expected opaque black, got %d,%d,%d,%d", name, r>>8, g>>8, b>>8, a>>8)
+		}
+	}
+}
+
+func TestImageRotateFloat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	i, err := NewImage(buf, Options{Type: PNG, Background: Color{255, 255, 255, 255}})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	// A square on its corner is as wide and high as its diagonal
+	if err = i.RotateFloat(45); err != nil {
+		t.Fatalf("Cannot rotate the image: %s", err)
+	}
+	size, err := i.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+	diagonal := 100 * math.Sqrt2
+	if math.Abs(float64(size.Width)-diagonal) > 2 || math.Abs(float64(size.Height)-diagonal) > 2 {
+		t.Errorf("Expected about %.0fx%.0f, got %dx%d", diagonal, diagonal, size.Width, size.Height)
+	}
+}
+
+func TestImageCompositeMulti(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, img); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		return buf.Bytes()
+	}
+	// Three half transparent 60x60 squares, overlapping from 40,40 to 60,60
+	colours := []color.NRGBA{{R: 255, A: 128}, {G: 255, A: 128}, {B: 255, A: 128}}
+	layers := []CompositeLayer{}
+	for n, c := range colours {
+		square := image.NewNRGBA(image.Rect(0, 0, 60, 60))
+		draw.Draw(square, square.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+		layers = append(layers, CompositeLayer{Buf: encode(square), Mode: BlendOver, X: n * 20, Y: n * 20})
+	}
+	white := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(white, white.Bounds(), image.White, image.Point{}, draw.Src)
+
+	i, err := NewImage(bytes.NewBuffer(encode(white)), Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+	if err = i.CompositeMulti(layers); err != nil {
+		t.Fatalf("Cannot composite the layers: %s", err)
+	}
+	buf, err := i.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(*buf))
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+
+	// Each layer goes over the result of the ones before
+	expected := []float64{255, 255, 255}
+	for _, c := range colours {
+		alpha := float64(c.A) / 255
+		for n, v := range []uint8{c.R, c.G, c.B} {
+			expected[n] = float64(v)*alpha + expected[n]*(1-alpha)
+		}
+	}
+	r, g, b, a := out.At(50, 50).RGBA()
+	for n, v := range []uint32{r >> 8, g >> 8, b >> 8} {
+		if math.Abs(float64(v)-expected[n]) > 3 {
+			t.Errorf("Expected %.0f,%.0f,%.0f at the overlap, got %d,%d,%d", expected[0], expected[1], expected[2], r>>8, g>>8, b>>8)
+			break
+		}
+	}
+	if a>>8 != 255 {
+		t.Errorf("Expected an opaque result, got alpha %d", a>>8)
+	}
+
+	if err = i.CompositeMulti(nil); err == nil {
+		t.Error("Expected an error without layers")
+	}
+}
+
+func TestImageRenderVectorToWidth(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50">
+		<rect width="100" height="50" fill="#fff"/>
+		<rect x="10" y="10" width="30" height="30" fill="#000"/>
+		<circle cx="70" cy="25" r="15" fill="#000"/>
+	</svg>`)
+
+	// sharpness sums the squared steps between horizontal neighbours along the middle row, soft edges score less
+	sharpness := func(render func(i *Image) error) float64 {
+		i, err := NewImage(bytes.NewBuffer(svg), Options{Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer i.DecrementReferenceCount()
+		if err = render(i); err != nil {
+			t.Fatalf("Cannot render the image: %s", err)
+		}
+		buf, err := i.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(*buf))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		if width := out.Bounds().Dx(); width != 800 {
+			t.Errorf("Expected 800 pixels wide, got %d", width)
+		}
+
+		total := 0.0
+		y := out.Bounds().Dy() / 2
+		for x := 1; x < out.Bounds().Dx(); x++ {
+			a := color.GrayModel.Convert(out.At(x-1, y)).(color.Gray).Y
+			b := color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y
+			total += math.Pow(float64(a)-float64(b), 2)
+		}
+		return total
+	}
+
+	rendered := sharpness(func(i *Image) error {
+		return i.RenderVectorToWidth(800)
+	})
+	resized := sharpness(func(i *Image) error {
+		return i.Enlarge(800, 400)
+	})
+	if rendered <= resized*2 {
+		t.Errorf("Expected rendering at 800 pixels to be much crisper than resizing, got %.0f against %.0f", rendered, resized)
+	}
+}
+
+func TestImagePipeline(t *testing.T) {
+	i, err := NewImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer i.DecrementReferenceCount()
+
+	p := i.Pipe().Resize(300, 200).Sharpen(Sharpen{Sigma: 1, X1: 2, Y2: 10, Y3: 20, M1: 0, M2: 3}).Rotate(D90)
+	// Nothing happens until Run
+	if i.VipsImage.Options.Width != 0 || i.VipsImage.Options.Rotate != 0 {
+		t.Errorf("Expected the options to be untouched before Run, got %+v", i.VipsImage.Options)
+	}
+	if err = p.Run(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+
+	size, err := i.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+	if size.Width != 300 || size.Height != 200 {
+		t.Errorf("Expected 300x200, got %dx%d", size.Width, size.Height)
+	}
+}
+
+func benchmarkTransform(b *testing.B, transform func(i *Image) error) {
+	buf := readFile("test.jpg")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i, err := NewImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			b.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = transform(i); err != nil {
+			b.Fatalf("Cannot process the image: %s", err)
+		}
+		if _, err = i.Save(); err != nil {
+			b.Fatalf("Cannot save the image: %s", err)
+		}
+		i.DecrementReferenceCount()
+	}
+}
+
+var benchmarkSharpen = Sharpen{Sigma: 1, X1: 2, Y2: 10, Y3: 20, M1: 0, M2: 3}
+
+func BenchmarkChainedDSL(b *testing.B) {
+	benchmarkTransform(b, func(i *Image) error {
+		if err := i.Resize(300, 200); err != nil {
+			return err
+		}
+		i.VipsImage.Options.Sharpen = benchmarkSharpen
+		if err := i.Process(); err != nil {
+			return err
+		}
+		return i.Rotate(D90)
+	})
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	benchmarkTransform(b, func(i *Image) error {
+		return i.Pipe().Resize(300, 200).Sharpen(benchmarkSharpen).Rotate(D90).Run()
+	})
+}
+
 func initImage(file string) *Image {
 	buf, _ := imageBuf(file)
 	return NewImage(buf)
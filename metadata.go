@@ -6,23 +6,55 @@ package vimg
 */
 import "C"
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
 // ImageSize represents the image width and height values
 type ImageSize struct {
-	Width  int
-	Height int
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ImageRect represents an area of the image, e.g. the box kept by a trim
+type ImageRect struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// TrimInfo reports how many pixels a trim took off each edge, and the size before and after
+type TrimInfo struct {
+	Top          int `json:"top"`
+	Bottom       int `json:"bottom"`
+	Left         int `json:"left"`
+	Right        int `json:"right"`
+	OriginalSize ImageSize `json:"original_size"`
+	TrimmedSize  ImageSize `json:"trimmed_size"`
 }
 
 // ImageMetadata represents the basic metadata fields
 type ImageMetadata struct {
-	Orientation int
-	Channels    int
-	Alpha       bool
-	Profile     bool
-	Type        string
-	Space       string
-	Colourspace string
-	Size        ImageSize
-	EXIF		EXIF
+	Orientation int `json:"orientation"`
+	Channels    int `json:"channels"`
+	Alpha       bool `json:"alpha"`
+	Profile     bool `json:"profile"`
+	Type        string `json:"type"`
+	Space       string `json:"space"`
+	Colourspace string `json:"colourspace"`
+	Size        ImageSize `json:"size"`
+	XRes        float64 `json:"xres"`
+	YRes        float64 `json:"yres"`
+	// Pages is the number of pages or frames in the file, whether or not they were all loaded, and PageHeight the
+	// height of each. Images with no pages metadata count as a single page the height of the image.
+	Pages       int `json:"pages"`
+	PageHeight  int `json:"page_height"`
+	EXIF		EXIF `json:"exif"`
 }
 
 const (
@@ -80,57 +112,199 @@ const (
 )
 
 type EXIF struct {
-	Make string
-	Model string
-	Orientation int
-	XResolution string
-	YResolution string
-	ResolutionUnit int
-	Software string
-	Datetime string
-	YCbCrPositioning int
-	Compression int
-	ExposureTime string
-	FNumber string
-	ExposureProgram int
-	ISOSpeedRatings int
-	ExifVersion string
-	DateTimeOriginal string
-	DateTimeDigitized string
-	ComponentsConfiguration string
-	ShutterSpeedValue string
-	ApertureValue string
-	BrightnessValue string
-	ExposureBiasValue string
-	MeteringMode int
-	Flash int
-	FocalLength string
-	SubjectArea string
-	MakerNote string
-	SubSecTimeOriginal string
-	SubSecTimeDigitized string
-	ColorSpace int
-	PixelXDimension int
-	PixelYDimension int
-	SensingMethod int
-	SceneType string
-	ExposureMode int
-	WhiteBalance int
-	FocalLengthIn35mmFilm int
-	SceneCaptureType int
-	GPSLatitudeRef string
-	GPSLatitude string
-	GPSLongitudeRef string
-	GPSLongitude string
-	GPSAltitudeRef string
-	GPSAltitude string
-	GPSSpeedRef string
-	GPSSpeed string
-	GPSImgDirectionRef string
-	GPSImgDirection string
-	GPSDestBearingRef string
-	GPSDestBearing string
-	GPSDateStamp string
+	Make string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	Orientation int `json:"orientation,omitempty"`
+	XResolution string `json:"x_resolution,omitempty"`
+	YResolution string `json:"y_resolution,omitempty"`
+	ResolutionUnit int `json:"resolution_unit,omitempty"`
+	Software string `json:"software,omitempty"`
+	Datetime string `json:"datetime,omitempty"`
+	YCbCrPositioning int `json:"ycbcr_positioning,omitempty"`
+	Compression int `json:"compression,omitempty"`
+	ExposureTime string `json:"exposure_time,omitempty"`
+	FNumber string `json:"f_number,omitempty"`
+	ExposureProgram int `json:"exposure_program,omitempty"`
+	ISOSpeedRatings int `json:"iso_speed_ratings,omitempty"`
+	ExifVersion string `json:"exif_version,omitempty"`
+	DateTimeOriginal string `json:"date_time_original,omitempty"`
+	DateTimeDigitized string `json:"date_time_digitized,omitempty"`
+	ComponentsConfiguration string `json:"components_configuration,omitempty"`
+	ShutterSpeedValue string `json:"shutter_speed_value,omitempty"`
+	ApertureValue string `json:"aperture_value,omitempty"`
+	BrightnessValue string `json:"brightness_value,omitempty"`
+	ExposureBiasValue string `json:"exposure_bias_value,omitempty"`
+	MeteringMode int `json:"metering_mode,omitempty"`
+	Flash int `json:"flash,omitempty"`
+	FocalLength string `json:"focal_length,omitempty"`
+	SubjectArea string `json:"subject_area,omitempty"`
+	MakerNote string `json:"maker_note,omitempty"`
+	SubSecTimeOriginal string `json:"sub_sec_time_original,omitempty"`
+	SubSecTimeDigitized string `json:"sub_sec_time_digitized,omitempty"`
+	ColorSpace int `json:"color_space,omitempty"`
+	PixelXDimension int `json:"pixel_x_dimension,omitempty"`
+	PixelYDimension int `json:"pixel_y_dimension,omitempty"`
+	SensingMethod int `json:"sensing_method,omitempty"`
+	SceneType string `json:"scene_type,omitempty"`
+	ExposureMode int `json:"exposure_mode,omitempty"`
+	WhiteBalance int `json:"white_balance,omitempty"`
+	FocalLengthIn35mmFilm int `json:"focal_length_in_35mm_film,omitempty"`
+	SceneCaptureType int `json:"scene_capture_type,omitempty"`
+	GPSLatitudeRef string `json:"gps_latitude_ref,omitempty"`
+	GPSLatitude string `json:"gps_latitude,omitempty"`
+	GPSLongitudeRef string `json:"gps_longitude_ref,omitempty"`
+	GPSLongitude string `json:"gps_longitude,omitempty"`
+	GPSAltitudeRef string `json:"gps_altitude_ref,omitempty"`
+	GPSAltitude string `json:"gps_altitude,omitempty"`
+	GPSSpeedRef string `json:"gps_speed_ref,omitempty"`
+	GPSSpeed string `json:"gps_speed,omitempty"`
+	GPSImgDirectionRef string `json:"gps_img_direction_ref,omitempty"`
+	GPSImgDirection string `json:"gps_img_direction,omitempty"`
+	GPSDestBearingRef string `json:"gps_dest_bearing_ref,omitempty"`
+	GPSDestBearing string `json:"gps_dest_bearing,omitempty"`
+	GPSDateStamp string `json:"gps_date_stamp,omitempty"`
+}
+
+// GPSCoord converts the GPS latitude and longitude rationals, e.g. "51/1 30/1 0/1000", and their N/S/E/W refs into
+// signed decimal degrees. ok is false when the GPS data is missing or can't be parsed.
+func (e EXIF) GPSCoord() (latitude, longitude float64, ok bool) {
+	latitude, ok = gpsDegrees(e.GPSLatitude, e.GPSLatitudeRef, "N", "S")
+	if !ok {
+		return 0, 0, false
+	}
+	longitude, ok = gpsDegrees(e.GPSLongitude, e.GPSLongitudeRef, "E", "W")
+	if !ok {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+// gpsDegrees parses up to three degree, minute and second rationals, negated for the negative ref
+func gpsDegrees(value, ref, positive, negative string) (float64, bool) {
+	parts := strings.Fields(value)
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, false
+	}
+	ref = strings.ToUpper(strings.TrimSpace(ref))
+	if ref != positive && ref != negative {
+		return 0, false
+	}
+
+	degrees := 0.0
+	for i, part := range parts {
+		fraction := strings.SplitN(part, "/", 2)
+		if len(fraction) != 2 {
+			return 0, false
+		}
+		numerator, err := strconv.ParseFloat(fraction[0], 64)
+		if err != nil {
+			return 0, false
+		}
+		denominator, err := strconv.ParseFloat(fraction[1], 64)
+		if err != nil || denominator == 0 {
+			return 0, false
+		}
+		degrees += numerator / denominator / math.Pow(60, float64(i))
+	}
+
+	if ref == negative {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+// GetEXIFTag returns the value of any EXIF tag by its libvips name, e.g. "exif-ifd2-LensModel", and whether it's set.
+// As with the EXIF struct, the libvips description after the value is dropped.
+func (img *VipsImage) GetEXIFTag(name string) (string, bool) {
+	value, ok := img.vipsImageGetString(name)
+	if !ok {
+		return "", false
+	}
+	return vipsExifShort(value), true
+}
+
+// SetEXIFTag sets any EXIF tag by its libvips name, e.g. "exif-ifd0-Artist". It's written out when the image is saved
+// without StripMetadata.
+func (img *VipsImage) SetEXIFTag(name, value string) error {
+	if !strings.HasPrefix(name, "exif-ifd") {
+		return fmt.Errorf("%q is not an EXIF tag name", name)
+	}
+	return img.vipsImageSetString(name, value)
+}
+
+// Header returns every libvips header field, e.g. "width", "interpretation" or "vips-loader", with its value
+// formatted as a string. It's meant for debugging, Metadata() has the parsed values.
+func (img *VipsImage) Header() (map[string]string, error) {
+	return img.vipsHeader()
+}
+
+// DecodeConfig returns the width, height and type of an image from its header alone, like image.DecodeConfig, without
+// creating a VipsImage or decoding any pixels. It's cheap enough to reject oversized images before loading them.
+// The dimensions are as stored, before any EXIF auto rotation.
+func DecodeConfig(buf []byte) (width, height int, typ ImageType, err error) {
+	typ = vipsImageType(buf)
+	if typ == UNKNOWN {
+		return 0, 0, UNKNOWN, errors.New("Unsupported image format")
+	}
+	width, height, err = vipsDecodeConfig(buf)
+	if err != nil {
+		return 0, 0, UNKNOWN, err
+	}
+	return width, height, typ, nil
+}
+
+// Dimensions returns the image width and height only, it's much cheaper than Metadata() as no EXIF is read.
+func (img *VipsImage) Dimensions() (ImageSize, error) {
+	if img.Image == nil {
+		return ImageSize{}, ErrVipsImageNotValidPointer
+	}
+	return ImageSize{
+		Width:  int(img.Image.Xsize),
+		Height: int(img.Image.Ysize),
+	}, nil
+}
+
+// Bands returns the number of bands, e.g. 3 for RGB or 4 with an alpha channel, 0 if no image is loaded.
+func (img *VipsImage) Bands() int {
+	if img.Image == nil {
+		return 0
+	}
+	return int(img.Image.Bands)
+}
+
+// Shapes returned by Shape.
+const (
+	ShapePortrait  = "portrait"
+	ShapeLandscape = "landscape"
+	ShapeSquare    = "square"
+)
+
+// Shape returns whether the image is a portrait, landscape or square once auto-rotated, so a portrait photo stored on
+// its side with an EXIF orientation still reports portrait. Options.ForceOrientation and NoAutoRotate are honoured.
+func (img *VipsImage) Shape() (string, error) {
+	size, err := img.Dimensions()
+	if err != nil {
+		return "", err
+	}
+
+	orientation := img.Options.ForceOrientation
+	if orientation == 0 {
+		if orientation, err = img.vipsExifOrientation(); err != nil {
+			return "", err
+		}
+	}
+	// Orientations 5 to 8 swap the width and height
+	if orientation >= 5 && !img.Options.NoAutoRotate {
+		size.Width, size.Height = size.Height, size.Width
+	}
+
+	switch {
+	case size.Width > size.Height:
+		return ShapeLandscape, nil
+	case size.Width < size.Height:
+		return ShapePortrait, nil
+	}
+	return ShapeSquare, nil
 }
 
 // Metadata returns the image metadata (size, type, alpha channel, profile, EXIF orientation...).
@@ -154,6 +328,15 @@ func (img *VipsImage) Metadata() (ImageMetadata, error) {
 	s, err := img.vipsSpace()
 	if err != nil { return ImageMetadata{}, err }
 
+	pages, ok := img.vipsImageGetInt("n-pages")
+	if !ok || pages < 1 {
+		pages = 1
+	}
+	pageHeight, ok := img.vipsImageGetInt("page-height")
+	if !ok || pageHeight < 1 {
+		pageHeight = size.Height
+	}
+
 	b := img.Buffer
 	metadata := ImageMetadata{
 		Size:        size,
@@ -163,6 +346,11 @@ func (img *VipsImage) Metadata() (ImageMetadata, error) {
 		Profile:     p,
 		Space:       s,
 		Type:        ImageTypeName(vipsImageType(b)),
+		// libvips keeps pixels per millimetre
+		XRes:        float64(img.Image.Xres) * 25.4,
+		YRes:        float64(img.Image.Yres) * 25.4,
+		Pages:       pages,
+		PageHeight:  pageHeight,
 		EXIF: EXIF{
 			Make: img.vipsExifStringTag(Make),
 			Model: img.vipsExifStringTag(Model),
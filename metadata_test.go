@@ -1,7 +1,11 @@
 package vimg
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"testing"
@@ -117,6 +121,389 @@ func TestColourspaceIsSupported(t *testing.T) {
 	}
 }
 
+func TestDimensions(t *testing.T) {
+	files := []struct {
+		name   string
+		width  int
+		height int
+	}{
+		{"test.jpg", 1680, 1050},
+		{"test.png", 400, 300},
+		{"test.webp", 550, 368},
+	}
+	for _, file := range files {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile(file.name)), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s -> %s", file.name, err)
+		}
+
+		size, err := img.Dimensions()
+		if err != nil {
+			t.Fatalf("Cannot read the dimensions: %s -> %s", file.name, err)
+		}
+		if size.Width != file.width || size.Height != file.height {
+			t.Errorf("Unexpected image size: %dx%d", size.Width, size.Height)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	files := []struct {
+		name   string
+		width  int
+		height int
+		typ    ImageType
+	}{
+		{"test.jpg", 1680, 1050, JPEG},
+		{"test.png", 400, 300, PNG},
+		{"test.webp", 550, 368, WEBP},
+	}
+	for _, file := range files {
+		width, height, typ, err := DecodeConfig(readFile(file.name))
+		if err != nil {
+			t.Fatalf("Cannot read the header: %s -> %s", file.name, err)
+		}
+		if width != file.width || height != file.height || typ != file.typ {
+			t.Errorf("Unexpected %s header: %dx%d %s", file.name, width, height, ImageTypeName(typ))
+		}
+	}
+
+	if _, _, _, err := DecodeConfig([]byte("not an image at all")); err == nil {
+		t.Error("Expected an error for a buffer that isn't an image")
+	}
+	if _, _, _, err := DecodeConfig(nil); err == nil {
+		t.Error("Expected an error for an empty buffer")
+	}
+}
+
+func TestShape(t *testing.T) {
+	files := []struct {
+		name    string
+		options Options
+		shape   string
+	}{
+		{"test.jpg", Options{}, ShapeLandscape},
+		// Stored as 1600x1200 with orientation 6, it's shown turned onto its side
+		{"exif/Portrait_6.jpg", Options{}, ShapePortrait},
+		{"exif/Portrait_6.jpg", Options{NoAutoRotate: true}, ShapeLandscape},
+		{"exif/Landscape_6.jpg", Options{}, ShapeLandscape},
+	}
+	for _, file := range files {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile(file.name)), file.options)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s -> %s", file.name, err)
+		}
+
+		shape, err := img.Shape()
+		if err != nil {
+			t.Fatalf("Cannot read the shape: %s -> %s", file.name, err)
+		}
+		if shape != file.shape {
+			t.Errorf("Expected %s to be %s, got %s", file.name, file.shape, shape)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+func TestHeader(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	header, err := img.Header()
+	if err != nil {
+		t.Fatalf("Cannot read the header: %s", err)
+	}
+	for _, name := range []string{"width", "height", "vips-loader"} {
+		if _, ok := header[name]; !ok {
+			t.Errorf("Expected a %s field, got %v", name, header)
+		}
+	}
+	if header["width"] != "1680" || header["height"] != "1050" {
+		t.Errorf("Expected 1680x1050, got %sx%s", header["width"], header["height"])
+	}
+}
+
+func TestMetadataJSON(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	metadata, err := img.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	buf, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatalf("Cannot marshal the metadata: %s", err)
+	}
+
+	var decoded map[string]interface{}
+	if err = json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatalf("Cannot unmarshal the metadata: %s", err)
+	}
+	for _, key := range []string{"orientation", "channels", "alpha", "profile", "type", "space", "colourspace", "size", "exif"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("Expected key %q in %s", key, buf)
+		}
+	}
+	if size, ok := decoded["size"].(map[string]interface{}); !ok || size["width"] != float64(400) || size["height"] != float64(300) {
+		t.Errorf("Unexpected size in %s", buf)
+	}
+	// The PNG has no EXIF, so every empty tag should be dropped
+	if exif, ok := decoded["exif"].(map[string]interface{}); !ok || len(exif) != 0 {
+		t.Errorf("Expected an empty exif object, got %s", buf)
+	}
+}
+
+func TestEXIFTag(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	// The typed struct and the generic getter agree
+	metadata, err := img.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if maker, _ := img.GetEXIFTag(Make); maker != metadata.EXIF.Make {
+		t.Errorf("Expected make %q, got %q", metadata.EXIF.Make, maker)
+	}
+	if _, ok := img.GetEXIFTag("exif-ifd0-NoSuchTag"); ok {
+		t.Error("Expected a missing tag not to be found")
+	}
+
+	if err = img.SetEXIFTag("exif-ifd0-Artist", "vimg test"); err != nil {
+		t.Fatalf("Cannot set the tag: %s", err)
+	}
+	if artist, ok := img.GetEXIFTag("exif-ifd0-Artist"); !ok || artist != "vimg test" {
+		t.Errorf("Expected artist %q, got %q", "vimg test", artist)
+	}
+	if err = img.SetEXIFTag("icc-profile-data", "nope"); err == nil {
+		t.Error("Expected an error setting a non EXIF field")
+	}
+
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	saved, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+	if artist, ok := saved.GetEXIFTag("exif-ifd0-Artist"); !ok || artist != "vimg test" {
+		t.Errorf("Expected artist %q after saving, got %q", "vimg test", artist)
+	}
+}
+
+func TestRemoveEXIFTags(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Type: JPEG, Quality: 90})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	tags := map[string]string{
+		Make:            "vimg",
+		Model:           "test",
+		GPSLatitudeRef:  "N",
+		GPSLatitude:     "51/1 30/1 116/10",
+		GPSLongitudeRef: "W",
+		GPSLongitude:    "0/1 7/1 106/10",
+	}
+	for name, value := range tags {
+		if err = img.SetEXIFTag(name, value); err != nil {
+			t.Fatalf("Cannot set %s: %s", name, err)
+		}
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the tagged image: %s", err)
+	}
+
+	// Full and short names, and a tag the image doesn't have
+	o := Options{Type: JPEG, Quality: 90, RemoveEXIFTags: []string{GPSLatitude, GPSLatitudeRef, "GPSLongitude", "GPSLongitudeRef", GPSAltitude}}
+	tagged, err := NewVipsImage(bytes.NewBuffer(img.Buffer), o)
+	if err != nil {
+		t.Fatalf("Cannot read the tagged image: %s", err)
+	}
+	defer tagged.DecrementReferenceCount()
+	if err = tagged.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	saved, err := NewVipsImage(bytes.NewBuffer(tagged.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+
+	for _, name := range []string{GPSLatitude, GPSLatitudeRef, GPSLongitude, GPSLongitudeRef} {
+		if value, ok := saved.GetEXIFTag(name); ok {
+			t.Errorf("Expected %s to be removed, got %q", name, value)
+		}
+	}
+	for _, name := range []string{Make, Model} {
+		if value, _ := saved.GetEXIFTag(name); value != tags[name] {
+			t.Errorf("Expected %s to be %q, got %q", name, tags[name], value)
+		}
+	}
+}
+
+func TestMetadataPages(t *testing.T) {
+	if !IsTypeSupported(PDF) {
+		t.Skip("PDF loading is not supported")
+	}
+	for _, allPages := range []bool{false, true} {
+		img, err := NewVipsImage(bytes.NewBuffer(testPDF(3)), Options{AllPages: allPages})
+		if err != nil {
+			t.Fatalf("Cannot read the PDF: %s", err)
+		}
+		metadata, err := img.Metadata()
+		img.DecrementReferenceCount()
+		if err != nil {
+			t.Fatalf("Cannot read the metadata: %s", err)
+		}
+		// The whole count, however many pages were loaded, each 72x144 points rendered at 72 DPI
+		if metadata.Pages != 3 || metadata.PageHeight != 144 {
+			t.Errorf("Expected 3 pages 144 pixels high with AllPages %t, got %d of %d", allPages, metadata.Pages, metadata.PageHeight)
+		}
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	metadata, err := img.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if metadata.Pages != 1 || metadata.PageHeight != 300 {
+		t.Errorf("Expected a single page 300 pixels high, got %d of %d", metadata.Pages, metadata.PageHeight)
+	}
+}
+
+// testPDF returns a PDF of blank 72x144 point pages.
+func testPDF(pages int) []byte {
+	kids := ""
+	for n := 0; n < pages; n++ {
+		kids += fmt.Sprintf("%d 0 R ", n+3)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, pages),
+	}
+	for n := 0; n < pages; n++ {
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 72 144] >>")
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for n, object := range objects {
+		offsets[n] = buf.Len()
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", n+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestGPSCoord(t *testing.T) {
+	// The London Eye, 51°30'11.6"N 0°7'10.6"W
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	for name, value := range map[string]string{
+		GPSLatitudeRef:  "N",
+		GPSLatitude:     "51/1 30/1 116/10",
+		GPSLongitudeRef: "W",
+		GPSLongitude:    "0/1 7/1 106/10",
+	} {
+		if err = img.SetEXIFTag(name, value); err != nil {
+			t.Fatalf("Cannot set %s: %s", name, err)
+		}
+	}
+	metadata, err := img.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	latitude, longitude, ok := metadata.EXIF.GPSCoord()
+	if !ok || math.Abs(latitude-51.503222) > 0.000001 || math.Abs(longitude+0.119611) > 0.000001 {
+		t.Errorf("Expected 51.503222, -0.119611, got %f, %f, %t", latitude, longitude, ok)
+	}
+
+	invalid := []EXIF{
+		{},
+		{GPSLatitude: "51/1 30/1 0/1", GPSLatitudeRef: "N"},
+		{GPSLatitude: "51/1 30/1 0/1", GPSLatitudeRef: "N", GPSLongitude: "0/1 7/0", GPSLongitudeRef: "W"},
+		{GPSLatitude: "51/1 30/1 0/1", GPSLatitudeRef: "X", GPSLongitude: "0/1 7/1", GPSLongitudeRef: "W"},
+	}
+	for _, exif := range invalid {
+		if _, _, ok := exif.GPSCoord(); ok {
+			t.Errorf("Expected incomplete GPS data to fail, got ok for %+v", exif)
+		}
+	}
+}
+
+func BenchmarkDimensions(b *testing.B) {
+	img, _ := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	defer img.DecrementReferenceCount()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		img.Dimensions()
+	}
+}
+
+func BenchmarkMetadata(b *testing.B) {
+	img, _ := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	defer img.DecrementReferenceCount()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		img.Metadata()
+	}
+}
+
+func BenchmarkDecodeConfig(b *testing.B) {
+	buf := readFile("test.jpg")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, _, err := DecodeConfig(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewImageMetadata(b *testing.B) {
+	buf := readFile("test.jpg")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		img, err := NewImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = img.Metadata(); err != nil {
+			b.Fatal(err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
 func readFile(file string) []byte {
 	data, _ := os.Open(path.Join("testdata", file))
 	buf, _ := ioutil.ReadAll(data)
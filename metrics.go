@@ -1,6 +1,7 @@
 package vimg
 
 import (
+	"time"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -17,4 +18,24 @@ var (
 		Name: "vimg_operations",
 		Help: "VIPS Operations",
 	},[]string{"type"})
-)
\ No newline at end of file
+)
+
+var (
+	vimgOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "vimg_operation_duration_seconds",
+		Help: "VIPS Operation durations, libvips is lazy so only saves and intermediate buffers include the pixel work",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	},[]string{"type"})
+)
+
+var (
+	vimgOperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "vimg_operation_errors_total",
+		Help: "VIPS Operation errors",
+	},[]string{"type"})
+)
+
+// observeOperation records how long the operation has taken since start, deferred at the top of the operation.
+func observeOperation(operation string, start time.Time) {
+	vimgOperationDuration.With(prometheus.Labels{"type":operation}).Observe(time.Since(start).Seconds())
+}
@@ -6,10 +6,16 @@ package vimg
 */
 import "C"
 
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
 const (
 	// Quality defines the default JPEG quality to be used.
 	Quality = 80
-	// MaxSize defines the maximum pixels width or height supported.
+	// MaxSize defines the default maximum pixels width or height supported, see VipsSetMaxImageSize.
 	MaxSize = 16383
 )
 
@@ -29,6 +35,8 @@ const (
 	GravityWest
 	// GravitySmart enables libvips Smart Crop algorithm for image gravity orientation.
 	GravitySmart
+	// GravityFocal centres the crop on Options.FocalX and FocalY, kept inside the image.
+	GravityFocal
 )
 var gravityToID = map[string]Gravity {
 	"north": GravityNorth,
@@ -36,6 +44,7 @@ var gravityToID = map[string]Gravity {
 	"east": GravityEast,
 	"west": GravityWest,
 	"smart": GravitySmart,
+	"focal": GravityFocal,
 }
 
 type Position int
@@ -54,6 +63,52 @@ var positions = map[string]Position {
 	"bottom": PositionBottom,
 }
 
+// SmartCropStrategy represents how GravitySmart picks the most interesting part of the image.
+type SmartCropStrategy int
+
+const (
+	// SmartCropAttention looks for skin tones, saturated colours and edges, libvips' default.
+	SmartCropAttention SmartCropStrategy = iota
+	// SmartCropEntropy keeps the part with the most entropy, better for texture heavy images.
+	SmartCropEntropy
+)
+
+var smartCropStrategies = map[string]SmartCropStrategy{
+	"attention": SmartCropAttention,
+	"entropy": SmartCropEntropy,
+}
+
+// MetadataPreset represents a fixed set of metadata to keep when saving.
+type MetadataPreset int
+
+const (
+	// MetadataAsIs keeps whatever metadata the other options leave.
+	MetadataAsIs MetadataPreset = iota
+	// MetadataMinimal keeps only the orientation and ICC profile, so every output has the same minimal metadata.
+	MetadataMinimal
+)
+
+var metadataPresets = map[string]MetadataPreset{
+	"minimal": MetadataMinimal,
+}
+
+// ResizeMode represents how an image is resized into a box, see Image.ResizeFit.
+type ResizeMode int
+
+const (
+	// ResizeModeFit scales the image to fit inside the box, keeping its aspect ratio.
+	ResizeModeFit ResizeMode = iota
+	// ResizeModeCover scales the image to cover the box, cropping whatever overflows it.
+	ResizeModeCover
+	// ResizeModeFill stretches the image to the box, ignoring its aspect ratio.
+	ResizeModeFill
+)
+
+var resizeModes = map[string]ResizeMode{
+	"fit": ResizeModeFit,
+	"cover": ResizeModeCover,
+	"fill": ResizeModeFill,
+}
 
 // Interpolator represents the image interpolation value.
 type Interpolator int
@@ -67,6 +122,14 @@ const (
 	Nohalo
 	// Nearest neighbour interpolation value.
 	Nearest
+	// Lanczos2 interpolation value, resize only, affine transforms fall back to bicubic.
+	Lanczos2
+	// Lanczos3 interpolation value, resize only, affine transforms fall back to bicubic.
+	Lanczos3
+	// LBB (locally bounded bicubic) interpolation value.
+	LBB
+	// VSQBS (vertex split quadratic b-splines) interpolation value.
+	VSQBS
 )
 
 var interpolations = map[Interpolator]string{
@@ -74,6 +137,10 @@ var interpolations = map[Interpolator]string{
 	Bilinear: "bilinear",
 	Nohalo:   "nohalo",
 	Nearest:  "nearest",
+	Lanczos2: "lanczos2",
+	Lanczos3: "lanczos3",
+	LBB:      "lbb",
+	VSQBS:    "vsqbs",
 }
 
 func (i Interpolator) String() string {
@@ -84,6 +151,15 @@ func (i Interpolator) CString() *C.char {
 	return imageInterpolatorToCString[i]
 }
 
+// interpolator returns the interpolator to resample with. Bicubic is the zero value, so it takes
+// DefaultInterpolator() unless InterpolatorSet.
+func (o Options) interpolator() Interpolator {
+	if o.Interpolator == Bicubic && !o.InterpolatorSet {
+		return DefaultInterpolator()
+	}
+	return o.Interpolator
+}
+
 // Angle represents the image rotation angle value.
 type Angle float64
 
@@ -178,6 +254,12 @@ type Color struct {
 // ColorBlack is a shortcut to black RGB color representation.
 var ColorBlack = Color{0, 0, 0, 0}
 
+// hasBackground reports whether a Background was given. ColorBlack is the zero value, so it only counts with
+// BackgroundSet.
+func (o Options) hasBackground() bool {
+	return o.BackgroundSet || o.Background != ColorBlack
+}
+
 // Watermark represents the text-based watermark supported options.
 type Watermark struct {
 	Width       int
@@ -193,6 +275,7 @@ type Watermark struct {
 	HAlign			Position
 	VAlign			Position
 	TextAlign		int
+	Rotate			float64 // Degrees clockwise to turn the text, e.g. 45 for a diagonal stamp
 }
 
 // WatermarkImage represents the image-based watermark supported options.
@@ -207,6 +290,22 @@ type WatermarkImage struct {
 	Opacity 		float32
 	Path 			string
 	BlendMode		BlendMode
+	Rotate			float64 // Degrees clockwise to turn the watermark after it's sized
+	Tile			bool // Repeat the watermark edge to edge over the whole image, lined up with where the single one would go
+}
+
+// Badge represents text on a rounded rectangle, rendered once and composited onto the image at Gravity.
+type Badge struct {
+	Text			string
+	Font			string // WatermarkFont when empty
+	DPI				int // 150 when 0
+	Color			Color // Text colour
+	Background		Color // Shape colour
+	Opacity			float32 // Shape opacity, 0 to 1, 1 when 0, the text is always opaque
+	Radius			int // Corner radius of the shape
+	Padding			int // Space between the text and the edges of the shape
+	Gravity			Gravity
+	Margin			int // Space between the shape and the edges of the image
 }
 
 // GaussianBlur represents the gaussian image transformation values.
@@ -215,7 +314,21 @@ type GaussianBlur struct {
 	MinAmpl float64
 }
 
+// BlurMinAmpl is the libvips default MinAmpl, where the gaussian mask is cut off.
+const BlurMinAmpl = 0.2
+
+// GaussianBlurRadius returns the GaussianBlur whose mask reaches radius pixels either side of each pixel. libvips cuts
+// the mask off where the gaussian falls to MinAmpl, exp(-r²/2σ²) = MinAmpl, so σ = r / sqrt(-2 ln MinAmpl), about
+// r / 1.79 with BlurMinAmpl.
+func GaussianBlurRadius(radius float64) GaussianBlur {
+	return GaussianBlur{
+		Sigma:   radius / math.Sqrt(-2 * math.Log(BlurMinAmpl)),
+		MinAmpl: BlurMinAmpl,
+	}
+}
+
 // Sharpen represents the image sharp transformation options.
+// Zero values take the libvips defaults once any of them is set, unless Exact is set.
 type Sharpen struct {
 	Sigma  float64
 	X1     float64
@@ -223,6 +336,69 @@ type Sharpen struct {
 	Y3     float64
 	M1     float64
 	M2     float64
+	Exact  bool // Use zero values as given rather than as the libvips defaults
+}
+
+// Sharpen defaults, as libvips has them.
+const (
+	SharpenSigma = 0.5
+	SharpenX1    = 2.0
+	SharpenY2    = 10.0
+	SharpenY3    = 20.0
+	SharpenM1    = 0.0
+	SharpenM2    = 3.0
+)
+
+// isSet reports whether any sharpening was asked for.
+func (s Sharpen) isSet() bool {
+	return s != Sharpen{}
+}
+
+// Validate checks the values are ones libvips accepts, once the defaults are filled in. An unset Sharpen is fine.
+func (s Sharpen) Validate() error {
+	if !s.isSet() {
+		return nil
+	}
+
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{{"sigma", s.Sigma}, {"x1", s.X1}, {"y2", s.Y2}, {"y3", s.Y3}, {"m1", s.M1}, {"m2", s.M2}} {
+		if v.value < 0 {
+			return fmt.Errorf("Sharpen %s can't be negative, got %g", v.name, v.value)
+		}
+	}
+	if s.Sigma > 10000 {
+		return errors.New("Sharpen sigma can't be more than 10000")
+	}
+	if s.Exact && s.Sigma == 0 {
+		return errors.New("Sharpen sigma must be above 0")
+	}
+	return nil
+}
+
+// resolve returns a copy of s with the libvips defaults in place of its zero values, unless Exact is set.
+func (s Sharpen) resolve() Sharpen {
+	if s.Exact {
+		return s
+	}
+	if s.Sigma == 0 {
+		s.Sigma = SharpenSigma
+	}
+	if s.X1 == 0 {
+		s.X1 = SharpenX1
+	}
+	if s.Y2 == 0 {
+		s.Y2 = SharpenY2
+	}
+	if s.Y3 == 0 {
+		s.Y3 = SharpenY3
+	}
+	if s.M2 == 0 {
+		s.M2 = SharpenM2
+	}
+	// M1 defaults to 0, so there's nothing to fill in
+	return s
 }
 
 type Extract struct {
@@ -248,26 +424,90 @@ type Options struct {
 	Flop           	bool
 	Force          	bool
 	NoAutoRotate   	bool
+	ForceOrientation	int // EXIF style orientation, 1 to 8, used in place of the image's own when non-zero
 	NoProfile      	bool
 	Interlace      	bool
 	StripMetadata  	bool
 	Trim           	bool
+	TrimBackground	*Color // Colour to trim against, Background if set or else the top-left pixel when nil
 	Lossless       	bool
+	WebPNearLossless	bool // Lossless WEBP with lossy preprocessing, Quality sets how much, needs libvips 8.8
+	WebPEffort		*int // WEBP reduction effort, 0 to 6, higher is smaller and slower, libvips' default of 4 when nil
+	WebPSmartSubsample	bool // Sharper WEBP colour edges from smarter chroma subsampling, needs libvips 8.8
 	MaintainAspect	bool
+	Grayscale		bool
+	KeepAlpha		bool
+	AutoInvertNegative	bool // Best-effort detection and correction of scanned film negatives
 	SkipICCIf		string
 	Extend         	Extend
 	Extract 		Extract
 	Rotate         	Angle
+	RotateCrop		bool // Crop an arbitrary angle rotation back to the original size, instead of expanding the canvas
 	Background     	Color
+	BackgroundSet	bool // Background was given, so a ColorBlack one is used rather than taken as unset, see hasBackground
 	Gravity        	Gravity
+	FocalX			float64 // Relative horizontal focal point for GravityFocal crops, 0 is the left edge and 1 the right
+	FocalY			float64 // Relative vertical focal point for GravityFocal crops, 0 is the top edge and 1 the bottom
+	SmartCropStrategy	SmartCropStrategy // What GravitySmart keeps, SmartCropAttention by default
+	PremultiplyAlpha	*bool // Premultiply alpha while resizing so transparent edges don't get a dark halo, true when nil
+	MetadataPreset	MetadataPreset // MetadataMinimal saves only the orientation and ICC profile, StripMetadata is then ignored
+	KeepMetadata	[]Blob // Blobs StripMetadata leaves, e.g. the ICC profile or EXIF
+	RemoveEXIFTags	[]string // EXIF tags left out when saving, by libvips name such as GPSLatitude's or just the tag name
 	Watermark      	Watermark
 	WatermarkImage 	WatermarkImage
+	Badge			Badge // Text on a rounded rectangle, drawn after any watermarks
+	AlphaMask		[]byte // Greyscale image used as the alpha channel when saving to a type with alpha, stretched to fit
 	Type           	ImageType
-	Interpolator   	Interpolator
+	PreferredTypes	[]ImageType // Output types in order of preference, the first that can be saved and keeps any alpha is used
+	Interpolator   	Interpolator // Bicubic, the zero value, takes DefaultInterpolator(), see SetDefaultInterpolator
+	InterpolatorSet	bool // Interpolator was given, so a Bicubic one is used rather than taken as unset
 	Interpretation 	Interpretation
+	ClampGamut		bool // Bring out of gamut colours from an scRGB WorkingSpace back into sRGB, keeping their hue
+	AutoSharpenOnDownscale	bool // Apply a mild sharpen, scaled to the reduction, after downscaling by 2x or more
+	LinearProcessing	bool // Resize RGB images in linear light (scRGB) to avoid darkening high contrast edges
+	WorkingSpace	Interpretation // Colour space for the intermediate operations, e.g. InterpretationScRGB to keep float precision
+	Median			int // Median filter window size for removing salt and pepper noise, odd, 0 for none
 	GaussianBlur   	GaussianBlur
 	Sharpen        	Sharpen
 	Threshold      	float64
 	Gamma			float64
+	InputICC		string // Path to an ICC profile assigned to the image before any colour transforms, CMYK images only use it without an embedded one
 	OutputICC      	string
+	XRes			float64 // Output horizontal resolution in DPI, the source's is kept when 0
+	YRes			float64 // Output vertical resolution in DPI, XRes when 0
+	Palette			bool // Save an 8-bit palette PNG, needs libvips built with libimagequant
+	Colors			int // Number of palette colours, 2 to 256, 256 when 0
+	Dither			float64 // Palette dithering from 0, none, to 1
+	TIFFCompression	string // TIFF compression, "none", "lzw", "deflate" or "jpeg", empty is uncompressed
+	TIFFTile		bool // Save a tiled TIFF rather than a stripped one
+	TIFFTileWidth	int // TIFF tile width, a multiple of 16, 128 when 0
+	TIFFTileHeight	int // TIFF tile height, a multiple of 16, 128 when 0
+	TIFFPyramid		bool // Save a tiled TIFF with each level of a pyramid as a page
+	JpegSubsampling	string // JPEG chroma subsampling, "444" or "420", empty leaves it to libvips. libvips can't write "422", Process rejects it
+	AllPages		bool // Load every page or frame of a GIF, WebP, TIFF or PDF stacked vertically, not just the first
+	FirstFrameOnly	bool // Load just the first page or frame, which is the default, made explicit, an error with AllPages
+	Page			int // PDF page to load, from 0, or the first of them with AllPages
+	PDFDPI			float64 // Density PDFs are rendered at, 72 when 0
+	SVGScale		float64 // Times the intrinsic size SVGs are rendered at, on top of SVGDPI, 1 when 0
+	SVGDPI			float64 // Density SVGs are rendered at, 72 when 0
+	MaxProcessingMemory	int64 // Estimated bytes Process may use, from the decoded size, larger images are refused, 0 for no limit
+	MaxImageSize	int // Largest width or height extract and smartcrop will produce, VipsMaxImageSize() when 0
+	MaxBytes		int64 // Maximum number of bytes to read when loading from an io.Reader, 0 for no limit
+	RejectAnimated	bool // Process fails with ErrAnimatedNotAllowed for a GIF, WebP or other image with more than one frame
+	MaxAspectRatio	float64 // Process fails with ErrMaxAspectRatioExceeded when the longer side is more times the shorter, 0 for no limit
+	// ProgressCallback receives the percentage complete as the image is evaluated
+	ProgressCallback	func(percent int)	`json:"-"`
+}
+
+// premultiplyAlpha reports whether resizes premultiply the alpha channel, the default.
+func (o *Options) premultiplyAlpha() bool {
+	return o.PremultiplyAlpha == nil || *o.PremultiplyAlpha
+}
+
+// svgScale is SVGScale, or 1 when it's not set.
+func (o *Options) svgScale() float64 {
+	if o.SVGScale == 0 {
+		return 1
+	}
+	return o.SVGScale
 }
@@ -0,0 +1,67 @@
+package vimg
+
+/*
+#cgo pkg-config: vips
+#include "vips/vips.h"
+*/
+import "C"
+
+import (
+	"sync"
+)
+
+// progressHandler wraps a progress callback, only passing on increasing percentages
+type progressHandler struct {
+	callback func(percent int)
+	last     int
+}
+
+// progressWatch is a callback connected to the progress signals of an image
+type progressWatch struct {
+	handle   int
+	image    *C.VipsImage
+	eval     C.gulong
+	posteval C.gulong
+}
+
+var (
+	progressMutex    sync.Mutex
+	progressHandlers = map[int]*progressHandler{}
+	progressNext     int
+)
+
+func registerProgress(callback func(percent int)) int {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	progressNext++
+	progressHandlers[progressNext] = &progressHandler{callback: callback, last: -1}
+	return progressNext
+}
+
+// unregisterProgress disconnects the signals of w from its image and drops the callback
+func unregisterProgress(w progressWatch) {
+	if w.image != nil {
+		C.g_signal_handler_disconnect(C.gpointer(w.image), w.eval)
+		C.g_signal_handler_disconnect(C.gpointer(w.image), w.posteval)
+		C.g_object_unref(C.gpointer(w.image))
+	}
+	progressMutex.Lock()
+	delete(progressHandlers, w.handle)
+	progressMutex.Unlock()
+}
+
+// vimgProgressCallback is called by libvips (from its own worker threads) as the image is evaluated
+//
+//export vimgProgressCallback
+func vimgProgressCallback(handle C.int, percent C.int) {
+	progressMutex.Lock()
+	h, ok := progressHandlers[int(handle)]
+	if !ok || int(percent) <= h.last {
+		progressMutex.Unlock()
+		return
+	}
+	h.last = int(percent)
+	progressMutex.Unlock()
+
+	h.callback(int(percent))
+}
@@ -0,0 +1,77 @@
+package vimg
+
+/*
+#cgo pkg-config: vips
+#include "vips/vips.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+// Session thumbnails one image after another, reusing its decode buffer and pooled VipsImage rather than
+// allocating them per call as NewImage does. Calls are serialised, so give each worker its own Session.
+type Session struct {
+	Options Options // Applied to every thumbnail, with the size and crop of each call
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	img *VipsImage
+}
+
+// NewSession creates a Session thumbnailing with o. Close it to return its image to the pool.
+func NewSession(o Options) *Session {
+	return &Session{Options: o, img: AquireVipsImage()}
+}
+
+// Thumbnail crops buf to a w x h thumbnail and returns the encoded image. The returned buffer belongs to the caller,
+// the session's own are reused by the next call.
+func (s *Session) Thumbnail(buf []byte, w, h int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.img == nil {
+		return nil, errors.New("Session is closed")
+	}
+
+	s.buf.Reset()
+	s.buf.Write(buf)
+
+	img := s.img
+	img.Options = s.Options
+	img.Options.Width = w
+	img.Options.Height = h
+	img.Options.Crop = true
+
+	defer s.release()
+	if err := img.Load(&s.buf); err != nil {
+		return nil, err
+	}
+	if err := img.Process(); err != nil {
+		return nil, err
+	}
+	if err := img.Save(); err != nil {
+		return nil, err
+	}
+	return img.Buffer, nil
+}
+
+// release drops the decoded image, if saving hasn't already, and keeps the VipsImage for the next call.
+func (s *Session) release() {
+	if s.img.Image != nil {
+		C.g_object_unref(C.gpointer(s.img.Image))
+	}
+	s.img.Reset()
+}
+
+// Close returns the session's image to the pool, Thumbnail fails after it.
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.img != nil {
+		s.img.DecrementReferenceCount()
+		s.img = nil
+	}
+}
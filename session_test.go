@@ -0,0 +1,75 @@
+package vimg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSessionThumbnail(t *testing.T) {
+	s := NewSession(Options{Type: JPEG})
+
+	for _, file := range []string{"test.jpg", "test.png", "northern_cardinal_bird.jpg"} {
+		buf, err := s.Thumbnail(readFile(file), 120, 80)
+		if err != nil {
+			t.Fatalf("Cannot thumbnail %s: %s", file, err)
+		}
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the thumbnail of %s: %s", file, err)
+		}
+		if size, _ := img.Dimensions(); size.Width != 120 || size.Height != 80 {
+			t.Errorf("Expected a 120x80 thumbnail of %s, got %dx%d", file, size.Width, size.Height)
+		}
+		if DetermineImageType(buf) != JPEG {
+			t.Errorf("Expected a JPEG thumbnail of %s", file)
+		}
+		img.DecrementReferenceCount()
+	}
+
+	// A bad image doesn't stop the next one
+	if _, err := s.Thumbnail([]byte("not an image at all"), 120, 80); err == nil {
+		t.Error("Expected an error for a buffer that isn't an image")
+	}
+	if _, err := s.Thumbnail(readFile("test.jpg"), 120, 80); err != nil {
+		t.Errorf("Cannot thumbnail after a failure: %s", err)
+	}
+
+	s.Close()
+	if _, err := s.Thumbnail(readFile("test.jpg"), 120, 80); err == nil {
+		t.Error("Expected an error from a closed session")
+	}
+}
+
+func BenchmarkSessionThumbnail(b *testing.B) {
+	buf := readFile("test.jpg")
+	s := NewSession(Options{Type: JPEG})
+	defer s.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := s.Thumbnail(buf, 120, 80); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewImageThumbnail(b *testing.B) {
+	buf := readFile("test.jpg")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		img, err := NewImage(bytes.NewBuffer(buf), Options{Type: JPEG, Width: 120, Height: 80, Crop: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = img.Process(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = img.Save(); err != nil {
+			b.Fatal(err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
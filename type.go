@@ -3,7 +3,9 @@ package vimg
 import "C"
 import (
 	"encoding/json"
+	"fmt"
 	"regexp"
+	"strings"
 	"sync"
 	"unicode/utf8"
 )
@@ -126,6 +128,10 @@ var imageInterpolatorToID = map[string]Interpolator {
 	"bilinear": Bilinear,
 	"nohalo": Nohalo,
 	"nearest": Nearest,
+	"lanczos2": Lanczos2,
+	"lanczos3": Lanczos3,
+	"lbb": LBB,
+	"vsqbs": VSQBS,
 }
 
 var imageInterpolatorToCString = map[Interpolator]*C.char {
@@ -133,6 +139,10 @@ var imageInterpolatorToCString = map[Interpolator]*C.char {
 	Bilinear: C.CString("bilinear"),
 	Nohalo: C.CString("nohalo"),
 	Nearest: C.CString("nearest"),
+	Lanczos2: C.CString("lanczos2"),
+	Lanczos3: C.CString("lanczos3"),
+	LBB: C.CString("lbb"),
+	VSQBS: C.CString("vsqbs"),
 }
 
 var imageInterpretationToID = map[string]Interpretation {
@@ -209,6 +219,51 @@ func (g *Gravity) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (s *SmartCropStrategy) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	*s = smartCropStrategies[name]
+	return nil
+}
+
+func (p *MetadataPreset) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	*p = metadataPresets[name]
+	return nil
+}
+
+func (m *ResizeMode) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	*m = resizeModes[name]
+	return nil
+}
+
+func (b *Blob) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	// Keeping the wrong blob could leak metadata meant to be stripped, so don't guess
+	blob, ok := blobsFromString[name]
+	if !ok {
+		return fmt.Errorf("Unknown metadata blob %q", name)
+	}
+	*b = blob
+	return nil
+}
+
 // imageMutex is used to provide thread-safe synchronization
 // for SupportedImageTypes map.
 var imageMutex = &sync.RWMutex{}
@@ -313,6 +368,15 @@ func IsTypeSupportedSave(t ImageType) bool {
 	return ok && IsImageTypeSupportedByVips(t).Save
 }
 
+// CanSave returns an error naming the format when the current libvips build can't save it, so a request can fail
+// before any of the expensive decoding and resizing.
+func CanSave(t ImageType) error {
+	if !IsTypeSupportedSave(t) {
+		return fmt.Errorf("VIPS cannot save to %s", ImageTypeName(t))
+	}
+	return nil
+}
+
 // IsTypeNameSupportedSave checks if a given image type name is supported for
 // saving
 func IsTypeNameSupportedSave(t string) bool {
@@ -324,6 +388,35 @@ func IsTypeNameSupportedSave(t string) bool {
 	return false
 }
 
+// suffixAliases maps the other common file extensions onto the type names.
+var suffixAliases = map[string]string{
+	"jpg": "jpeg",
+	"jpe": "jpeg",
+	"tif": "tiff",
+}
+
+// imageTypeFromSuffix returns the type a libvips style suffix such as "out.jpg[Q=80]" saves as, UNKNOWN if it isn't
+// one vimg knows.
+func imageTypeFromSuffix(suffix string) ImageType {
+	if i := strings.IndexByte(suffix, '['); i >= 0 {
+		suffix = suffix[:i]
+	}
+	ext := strings.ToLower(suffix[strings.LastIndexByte(suffix, '.')+1:])
+	if alias, ok := suffixAliases[ext]; ok {
+		ext = alias
+	}
+	return imageTypeToID[ext]
+}
+
+// typeSupportsAlpha reports whether the given image type can be saved with an alpha channel.
+func typeSupportsAlpha(t ImageType) bool {
+	switch t {
+	case PNG, WEBP, TIFF, GIF:
+		return true
+	}
+	return false
+}
+
 // ImageTypeName is used to get the human friendly name of an image format.
 func ImageTypeName(t ImageType) string {
 	imageType := ImageTypes[t]
@@ -1,9 +1,11 @@
 package vimg
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -109,6 +111,32 @@ func TestIsTypeSupportedSave(t *testing.T) {
 	}
 }
 
+func TestCanSave(t *testing.T) {
+	if err := CanSave(JPEG); err != nil {
+		t.Errorf("Expected JPEG to be saveable, got %s", err)
+	}
+	if err := CanSave(GIF); err == nil || !strings.Contains(err.Error(), "gif") {
+		t.Fatalf("Expected an error naming gif, got %v", err)
+	}
+
+	// Process fails before resizing anything
+	if !IsTypeSupported(GIF) {
+		t.Skip("GIF is not supported")
+	}
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{Type: GIF, Width: 100})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	before, _ := img.Dimensions()
+	if err = img.Process(); err == nil || err.Error() != CanSave(GIF).Error() {
+		t.Errorf("Expected %s, got %v", CanSave(GIF), err)
+	}
+	if after, _ := img.Dimensions(); after != before {
+		t.Errorf("Expected the image to be left at %+v, got %+v", before, after)
+	}
+}
+
 func TestIsTypeNameSupportedSave(t *testing.T) {
 	types := []struct {
 		name     string
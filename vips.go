@@ -13,12 +13,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -100,7 +105,11 @@ func (b Blob) CString() *C.char {
 
 var (
 	m           sync.Mutex
+	// libvips keeps one error buffer for the whole process, errorLock makes reading and clearing it one step
+	errorLock   sync.Mutex
 	initialized bool
+	maxImageSize int32 = MaxSize
+	defaultInterpolator int32 = int32(Bicubic)
 )
 
 // VipsMemoryInfo represents the memory stats provided by libvips.
@@ -119,9 +128,63 @@ type vipsSaveOptions struct {
 	NoProfile      bool
 	StripMetadata  bool
 	Lossless       bool
+	InputICC       string // Absolute path to the ICC profile assigned to the input
 	OutputICC      string // Absolute path to the output ICC profile
 	Interpretation Interpretation
 	Progressive    bool
+	Subsampling    string
+	TIFFCompression string
+	TIFFTile        bool
+	TIFFTileWidth   int
+	TIFFTileHeight  int
+	TIFFPyramid     bool
+	Palette         bool
+	Colors          int
+	Dither          float64
+	XRes            float64
+	YRes            float64
+	WebPNearLossless   bool
+	WebPEffort         *int
+	WebPSmartSubsample bool
+	Suffix             string // libvips style suffix picking the saver, e.g. ".jpg[Q=80]", the options above are then ignored
+	MetadataPreset     MetadataPreset
+	KeepMetadata       []Blob
+	RemoveEXIFTags     []string
+	BeforeEncode       func() error // Called once vipsPreSave has prepared the image, with the image about to be encoded
+}
+
+// minimalMetadataPrefixes are the metadata fields MetadataMinimal removes, everything but the orientation and ICC
+// profile. libvips writes a fresh EXIF block holding the orientation when saving a JPEG.
+var minimalMetadataPrefixes = []string{"exif-", "xmp-", "iptc-", "photoshop-", "image-description", "png-comment-", "gif-comment"}
+
+// metadataBlobPrefixes are the metadata fields each Blob covers for KeepMetadata, libvips rebuilds the EXIF block from
+// the exif- fields when saving.
+var metadataBlobPrefixes = map[Blob]string{
+	VIPS_META_EXIF_NAME:        "exif-",
+	VIPS_META_XMP_NAME:         "xmp-",
+	VIPS_META_IPTC_NAME:        "iptc-",
+	VIPS_META_PHOTOSHOP_NAME:   "photoshop-",
+	VIPS_META_ICC_NAME:         "icc-profile-data",
+	VIPS_META_IMAGEDESCRIPTION: "image-description",
+	VIPS_META_ORIENTATION:      "orientation",
+}
+
+// strippedMetadataPrefixes returns the metadata fields to remove to strip all but the kept blobs.
+func strippedMetadataPrefixes(keep []Blob) []string {
+	prefixes := []string{"png-comment-", "gif-comment"}
+	for blob, prefix := range metadataBlobPrefixes {
+		kept := false
+		for _, k := range keep {
+			if k == blob {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
 }
 
 type vipsWatermarkOptions struct {
@@ -134,6 +197,7 @@ type vipsWatermarkOptions struct {
 	VOffset 		C.double
 	HAlign			C.int
 	VAlign			C.int
+	Rotate			C.double
 }
 
 type vipsWatermarkImageOptions struct {
@@ -141,6 +205,7 @@ type vipsWatermarkImageOptions struct {
 	Top     C.int
 	Opacity C.float
 	Blend	C.int
+	Tile	C.int
 }
 
 type vipsWatermarkTextOptions struct {
@@ -198,6 +263,10 @@ func Shutdown() {
 	C.free(unsafe.Pointer(imageInterpolatorToCString[Bilinear]))
 	C.free(unsafe.Pointer(imageInterpolatorToCString[Nohalo]))
 	C.free(unsafe.Pointer(imageInterpolatorToCString[Nearest]))
+	C.free(unsafe.Pointer(imageInterpolatorToCString[Lanczos2]))
+	C.free(unsafe.Pointer(imageInterpolatorToCString[Lanczos3]))
+	C.free(unsafe.Pointer(imageInterpolatorToCString[LBB]))
+	C.free(unsafe.Pointer(imageInterpolatorToCString[VSQBS]))
 
 	C.free(unsafe.Pointer(blobToCString[VIPS_META_EXIF_NAME]))
 	C.free(unsafe.Pointer(blobToCString[VIPS_META_XMP_NAME]))
@@ -233,6 +302,46 @@ func VipsCacheDropAll() {
 	C.vips_cache_drop_all()
 }
 
+// VipsConcurrencySet sets the number of threads libvips uses for each image, 0 or less picks a default from the
+// number of CPUs. Initialize() sets it to 1 unless VIPS_CONCURRENCY is set, as more than one thread per image may
+// generate thread-unsafe issues, see https://github.com/jcupitt/libvips/issues/261#issuecomment-92850414
+func VipsConcurrencySet(n int) {
+	C.vips_concurrency_set(C.int(n))
+}
+
+// VipsConcurrencyGet returns the number of threads libvips uses for each image.
+func VipsConcurrencyGet() int {
+	return int(C.vips_concurrency_get())
+}
+
+// VipsSetMaxImageSize sets the largest width or height extract and smartcrop will produce, 0 or less restores
+// MaxSize. Options.MaxImageSize overrides it for a single image.
+func VipsSetMaxImageSize(n int) {
+	if n <= 0 {
+		n = MaxSize
+	}
+	atomic.StoreInt32(&maxImageSize, int32(n))
+}
+
+// VipsMaxImageSize returns the largest width or height extract and smartcrop will produce.
+func VipsMaxImageSize() int {
+	return int(atomic.LoadInt32(&maxImageSize))
+}
+
+// SetDefaultInterpolator sets the interpolator used when Options.Interpolator is left at its zero value, Bicubic,
+// without Options.InterpolatorSet. Bicubic is the default, an unknown interpolator restores it.
+func SetDefaultInterpolator(i Interpolator) {
+	if _, ok := interpolations[i]; !ok {
+		i = Bicubic
+	}
+	atomic.StoreInt32(&defaultInterpolator, int32(i))
+}
+
+// DefaultInterpolator returns the interpolator used when Options.Interpolator isn't set.
+func DefaultInterpolator() Interpolator {
+	return Interpolator(atomic.LoadInt32(&defaultInterpolator))
+}
+
 // VipsDebugInfo outputs to stdout libvips collected data. Useful for debugging.
 func VipsDebugInfo() {
 	C.im__print_all()
@@ -303,6 +412,26 @@ func (img *VipsImage) vipsExifOrientation() (int, error) {
 	return int(C.vips_exif_orientation(img.Image)), nil
 }
 
+func (img *VipsImage) vipsResetOrientation() error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"resetorientation"}).Inc()
+	defer observeOperation("resetorientation", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_reset_orientation_bridge(img.Image, &image)
+	if err != 0 {
+		return catchVipsError("resetorientation")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
 func (img *VipsImage) vipsHasAlpha() (bool, error) {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return false, ErrVipsImageNotValidPointer
@@ -335,13 +464,114 @@ func (img *VipsImage) vipsRotate(angle Angle) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"rotate"}).Inc()
+	defer observeOperation("rotate", time.Now())
 
 	var image *C.VipsImage
+	inWidth, inHeight := img.Image.Xsize, img.Image.Ysize
 //	err := C.vips_rotate_vimg(img.Image, &image, C.double(angle))
 	err := C.vips_rotate_fill(img.Image, &image, C.double(angle), C.double(img.Options.Background.R), C.double(img.Options.Background.G), C.double(img.Options.Background.B), C.double(img.Options.Background.A))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("rotate")
+	}
+
+	// Arbitrary angles expand the canvas, crop it back to the original size around the centre
+	if img.Options.RotateCrop && math.Mod(float64(angle), 90) != 0 {
+		var cropped *C.VipsImage
+		left := (image.Xsize - inWidth) / 2
+		top := (image.Ysize - inHeight) / 2
+		err = C.vips_extract_area_bridge(image, &cropped, left, top, inWidth, inHeight)
+		C.g_object_unref(C.gpointer(image))
+		if err != 0 {
+			return catchVipsError("rotate")
+		}
+		image = cropped
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsRotateFloat(deg float64) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"rotate"}).Inc()
+	defer observeOperation("rotate", time.Now())
+
+	var image *C.VipsImage
+	background := img.Options.Background
+
+	err := C.vips_rotate_float_bridge(img.Image, &image, C.double(deg), C.double(background.R), C.double(background.G), C.double(background.B), C.double(background.A))
+	if err != 0 {
+		return catchVipsError("rotate")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// vipsOrient rotates the image clockwise by a right angle then mirrors it, vertically with flip and horizontally
+// with flop, as a single operation. Every combination is one of eight orientations, a rotation, a mirror or a
+// transposition.
+func (img *VipsImage) vipsOrient(angle Angle, flip, flop bool) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+
+	m := orientationMatrix(angle, flip, flop)
+	switch m {
+	case [4]int{1, 0, 0, 1}:
+		return nil
+	case [4]int{0, -1, 1, 0}:
+		return img.vipsRotate(D90)
+	case [4]int{-1, 0, 0, -1}:
+		return img.vipsRotate(D180)
+	case [4]int{0, 1, -1, 0}:
+		return img.vipsRotate(D270)
+	case [4]int{-1, 0, 0, 1}:
+		return img.vipsFlip(Horizontal)
+	case [4]int{1, 0, 0, -1}:
+		return img.vipsFlip(Vertical)
+	}
+	return img.vipsTranspose(m)
+}
+
+// orientationMatrix returns the matrix, with x right and y down, of a clockwise rotation by a right angle followed by
+// the mirrors.
+func orientationMatrix(angle Angle, flip, flop bool) [4]int {
+	m := [4]int{1, 0, 0, 1}
+	for n := int(math.Mod(float64(angle), 360)) / 90; n > 0; n-- {
+		// A quarter turn takes (x, y) to (-y, x)
+		m = [4]int{-m[2], -m[3], m[0], m[1]}
+	}
+	if flip {
+		m[2], m[3] = -m[2], -m[3]
+	}
+	if flop {
+		m[0], m[1] = -m[0], -m[1]
+	}
+	return m
+}
+
+// vipsTranspose applies one of the two orientation matrices that swap the axes, which libvips has no rotation or
+// mirror for.
+func (img *VipsImage) vipsTranspose(m [4]int) error {
+	vimgOperations.With(prometheus.Labels{"type":"transpose"}).Inc()
+	defer observeOperation("transpose", time.Now())
+
+	var image *C.VipsImage
+	width, height := int(img.Image.Xsize), int(img.Image.Ysize)
+	// Map the centre of the image onto the centre of the output, pixels are sampled at whole coordinates
+	odx := (height - 1) - (m[0] * (width - 1) + m[1] * (height - 1))
+	ody := (width - 1) - (m[2] * (width - 1) + m[3] * (height - 1))
+	err := C.vips_transpose_bridge(img.Image, &image, C.int(m[0]), C.int(m[1]), C.int(m[2]), C.int(m[3]), C.int(odx / 2), C.int(ody / 2), C.int(height), C.int(width))
+	if err != 0 {
+		return catchVipsError("transpose")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -355,6 +585,7 @@ func (img *VipsImage) vipsFlip(direction Direction) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"flip"}).Inc()
+	defer observeOperation("flip", time.Now())
 
 	//m.Lock()
 	//defer m.Unlock()
@@ -364,7 +595,7 @@ func (img *VipsImage) vipsFlip(direction Direction) error {
 	err := C.vips_flip_bridge(img.Image, &image, C.int(direction))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("flip")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -378,6 +609,7 @@ func (img *VipsImage) vipsZoom(zoom int) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"zoom"}).Inc()
+	defer observeOperation("zoom", time.Now())
 
 	//m.Lock()
 	//defer m.Unlock()
@@ -387,7 +619,7 @@ func (img *VipsImage) vipsZoom(zoom int) error {
 	err := C.vips_zoom_bridge(img.Image, &image, C.int(zoom), C.int(zoom))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("zoom")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -401,6 +633,7 @@ func (img *VipsImage) vipsWatermark(w Watermark) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"watermark_text"}).Inc()
+	defer observeOperation("watermark_text", time.Now())
 
 	//m.Lock()
 	//defer m.Unlock()
@@ -423,7 +656,7 @@ func (img *VipsImage) vipsWatermark(w Watermark) error {
 	if w.Relative { relative = 1 } else { relative = 0 }
 
 	textOpts := vipsWatermarkTextOptions{text, font, C.int(o.TextAlign)}
-	opts := vipsWatermarkOptions{C.int(w.Width), C.int(w.DPI), C.int(noReplicate), background, C.int(relative), C.double(o.HOffset), C.double(o.VOffset), C.int(o.HAlign), C.int(o.VAlign)}
+	opts := vipsWatermarkOptions{C.int(w.Width), C.int(w.DPI), C.int(noReplicate), background, C.int(relative), C.double(o.HOffset), C.double(o.VOffset), C.int(o.HAlign), C.int(o.VAlign), C.double(w.Rotate)}
 //fmt.Printf("X,Y: %+v, %+v\n", img.Image.Xsize, img.Image.Ysize)
 //fmt.Printf("Watermark: %+v\n", w)
 //fmt.Printf("Watermark Text: %+v\n", textOpts)
@@ -435,7 +668,7 @@ func (img *VipsImage) vipsWatermark(w Watermark) error {
 
 	if err != 0 {
 //		fmt.Printf("Watermark Error: %+v\n", err)
-		return catchVipsError()
+		return catchVipsError("watermark_text")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -459,17 +692,38 @@ func (img *VipsImage) vipsRead(buf *bytes.Buffer) error {
 	var image *C.VipsImage
 	length := C.size_t(len(img.Buffer))
 	imageBuf := unsafe.Pointer(&img.Buffer[0])
-	err := C.vips_init_image(imageBuf, length, C.int(imageType), &image)
+	// Only the first page or frame is decoded unless all of them are asked for
+	pages := C.int(1)
+	if img.Options.AllPages {
+		if img.Options.FirstFrameOnly {
+			return errors.New("AllPages and FirstFrameOnly can't both be set")
+		}
+		pages = -1
+	}
+	var err C.int
+	if imageType == PDF && (img.Options.Page != 0 || img.Options.PDFDPI != 0) {
+		if img.Options.Page < 0 || img.Options.PDFDPI < 0 {
+			return fmt.Errorf("Invalid PDF page %d or DPI %g", img.Options.Page, img.Options.PDFDPI)
+		}
+		err = C.vips_pdfload_bridge(imageBuf, length, &image, C.int(img.Options.Page), pages, C.double(img.Options.PDFDPI), 1)
+	} else if imageType == SVG && (img.Options.SVGScale != 0 || img.Options.SVGDPI != 0) {
+		if img.Options.SVGScale < 0 || img.Options.SVGDPI < 0 {
+			return fmt.Errorf("Invalid SVG scale %g or DPI %g", img.Options.SVGScale, img.Options.SVGDPI)
+		}
+		err = C.vips_svgload_bridge(imageBuf, length, &image, C.double(img.Options.SVGDPI), C.double(img.Options.svgScale()))
+	} else {
+		err = C.vips_init_image(imageBuf, length, C.int(imageType), &image, pages)
+	}
 	defer func() {
 		C.vips_thread_shutdown()
-		C.vips_error_clear()
+		clearVipsError()
 		//C.g_object_unref(C.gpointer(img.Image))
 	}()
 
 	if err != 0 {
 		img.Buffer = nil
 		//C.g_object_unref(C.gpointer(imageBuf))
-		return catchVipsError()
+		return catchVipsError("load")
 	}
 
 	if !reflect.ValueOf(img.Image).IsNil() {
@@ -480,6 +734,12 @@ func (img *VipsImage) vipsRead(buf *bytes.Buffer) error {
 	img.Type = imageType
 //	img.Buffer = buf
 
+	// Multi-page loads stack the frames vertically, remember how many there are so the save can split them up again
+	img.pages = 1
+	if pageHeight, ok := img.vipsImageGetInt("page-height"); ok && pageHeight > 0 && int(image.Ysize) % pageHeight == 0 {
+		img.pages = int(image.Ysize) / pageHeight
+	}
+
 	//C.g_object_unref(C.gpointer(imageBuf))
 
 	return nil
@@ -520,11 +780,285 @@ func (img *VipsImage) vipsInterpretation() (Interpretation, error) {
 	return Interpretation(C.vips_image_guess_interpretation_bridge(img.Image)), nil
 }
 
+func (img *VipsImage) vipsColourspace(interpretation Interpretation) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"colourspace"}).Inc()
+	defer observeOperation("colourspace", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_colourspace_bridge(img.Image, &image, C.VipsInterpretation(interpretation))
+	if err != 0 {
+		return catchVipsError("colourspace")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsBadge(b Badge) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"badge"}).Inc()
+	defer observeOperation("badge", time.Now())
+
+	var badge *C.VipsImage
+	var image *C.VipsImage
+
+	text := C.CString(b.Text)
+	defer C.free(unsafe.Pointer(text))
+	font := C.CString(b.Font)
+	defer C.free(unsafe.Pointer(font))
+	colour := [4]C.double{C.double(b.Color.R), C.double(b.Color.G), C.double(b.Color.B), 255}
+	background := [4]C.double{C.double(b.Background.R), C.double(b.Background.G), C.double(b.Background.B), C.double(255 * b.Opacity)}
+
+	err := C.vips_badge_bridge(&badge, text, font, C.int(b.DPI), C.int(b.Padding), C.int(b.Radius), &colour[0], &background[0])
+	if err != 0 {
+		return catchVipsError("badge")
+	}
+	defer C.g_object_unref(C.gpointer(badge))
+
+	// Place it as a crop of the same size would be taken, inside the margin
+	left, top := calculateCrop(int(img.Image.Xsize) - 2*b.Margin, int(img.Image.Ysize) - 2*b.Margin, int(badge.Xsize), int(badge.Ysize), b.Gravity)
+	err = C.vips_composite_bridge(img.Image, badge, &image, C.int(BlendOver), C.int(left + b.Margin), C.int(top + b.Margin))
+	if err != 0 {
+		return catchVipsError("badge")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsComposite(overlay *VipsImage, mode BlendMode, x, y int) error {
+	if reflect.ValueOf(img.Image).IsNil() || reflect.ValueOf(overlay.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"composite"}).Inc()
+	defer observeOperation("composite", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_composite_bridge(img.Image, overlay.Image, &image, C.int(mode), C.int(x), C.int(y))
+	if err != 0 {
+		return catchVipsError("composite")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsCompositeMulti(overlays []*VipsImage, layers []CompositeLayer) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"compositemulti"}).Inc()
+	defer observeOperation("compositemulti", time.Now())
+
+	images := []*C.VipsImage{img.Image}
+	modes := make([]C.int, len(layers))
+	xs := make([]C.int, len(layers))
+	ys := make([]C.int, len(layers))
+	for i, overlay := range overlays {
+		if reflect.ValueOf(overlay.Image).IsNil() {
+			return ErrVipsImageNotValidPointer
+		}
+		images = append(images, overlay.Image)
+		modes[i] = C.int(layers[i].Mode)
+		xs[i] = C.int(layers[i].X)
+		ys[i] = C.int(layers[i].Y)
+	}
+
+	var image *C.VipsImage
+
+	err := C.vips_composite_multi_bridge(&images[0], C.int(len(images)), &image, &modes[0], &xs[0], &ys[0])
+	if err != 0 {
+		return catchVipsError("compositemulti")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsAlphaMask(mask *VipsImage) error {
+	if reflect.ValueOf(img.Image).IsNil() || reflect.ValueOf(mask.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"alphamask"}).Inc()
+	defer observeOperation("alphamask", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_alpha_mask_bridge(img.Image, mask.Image, &image)
+	if err != 0 {
+		return catchVipsError("alphamask")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsContactSheet(angle Angle, flop bool, cols, thumbWidth, padding int, background Color) (*C.VipsImage, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"contactsheet"}).Inc()
+	defer observeOperation("contactsheet", time.Now())
+
+	pages := img.pages
+	if pages < 1 {
+		pages = 1
+	}
+
+	var image *C.VipsImage
+
+	err := C.vips_contact_sheet_bridge(img.Image, &image, C.int(pages), C.int(angle), C.int(boolToInt(flop)), C.int(cols), C.int(thumbWidth), C.int(padding), C.double(background.R), C.double(background.G), C.double(background.B), C.double(background.A))
+	if err != 0 {
+		return nil, catchVipsError("contactsheet")
+	}
+
+	return image, nil
+}
+
+// vipsMontage lays out the first page of each image, turned by angles and flops, as vipsContactSheet does pages.
+func vipsMontage(images []*VipsImage, angles []Angle, flops []bool, cols, thumbWidth, padding int, background Color) (*C.VipsImage, error) {
+	vimgOperations.With(prometheus.Labels{"type":"montage"}).Inc()
+	defer observeOperation("montage", time.Now())
+
+	in := make([]*C.VipsImage, len(images))
+	pageHeights := make([]C.int, len(images))
+	angleArgs := make([]C.int, len(images))
+	flopArgs := make([]C.int, len(images))
+	for i, img := range images {
+		if reflect.ValueOf(img.Image).IsNil() {
+			return nil, ErrVipsImageNotValidPointer
+		}
+		pages := img.pages
+		if pages < 1 {
+			pages = 1
+		}
+		in[i] = img.Image
+		pageHeights[i] = img.Image.Ysize / C.int(pages)
+		angleArgs[i] = C.int(angles[i])
+		flopArgs[i] = C.int(boolToInt(flops[i]))
+	}
+
+	var image *C.VipsImage
+
+	err := C.vips_montage_bridge(&in[0], C.int(len(in)), &image, &pageHeights[0], &angleArgs[0], &flopArgs[0], C.int(cols), C.int(thumbWidth), C.int(padding), C.double(background.R), C.double(background.G), C.double(background.B), C.double(background.A))
+	if err != 0 {
+		return nil, catchVipsError("montage")
+	}
+
+	return image, nil
+}
+
+func (img *VipsImage) vipsMaxDeviation() (float64, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return 0, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"stats"}).Inc()
+	defer observeOperation("stats", time.Now())
+
+	deviation := C.double(0)
+
+	err := C.vips_max_deviation_bridge(img.Image, &deviation)
+	if err != 0 {
+		return 0, catchVipsError("stats")
+	}
+
+	return float64(deviation), nil
+}
+
+func (img *VipsImage) vipsIsNegative() (bool, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return false, ErrVipsImageNotValidPointer
+	}
+	return int(C.vips_is_negative_bridge(img.Image)) == 1, nil
+}
+
+func (img *VipsImage) vipsInvertNegative() error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"invertnegative"}).Inc()
+	defer observeOperation("invertnegative", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_invert_negative_bridge(img.Image, &image)
+	if err != 0 {
+		return catchVipsError("invertnegative")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// vipsLinear applies a * in + b, with one value per band
+func (img *VipsImage) vipsLinear(a, b []float64) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	if len(a) == 0 || len(a) != len(b) {
+		return errors.New("Linear needs matching, non-empty multipliers and offsets")
+	}
+	vimgOperations.With(prometheus.Labels{"type":"linear"}).Inc()
+	defer observeOperation("linear", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_linear_bridge(img.Image, &image, (*C.double)(unsafe.Pointer(&a[0])), (*C.double)(unsafe.Pointer(&b[0])), C.int(len(a)))
+	if err != 0 {
+		return catchVipsError("linear")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsClampGamut() error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"clampgamut"}).Inc()
+	defer observeOperation("clampgamut", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_clamp_gamut_bridge(img.Image, &image)
+	if err != 0 {
+		return catchVipsError("clampgamut")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
 func (img *VipsImage) vipsFlattenBackground(background Color) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"flatten"}).Inc()
+	defer observeOperation("flatten", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -538,9 +1072,21 @@ func (img *VipsImage) vipsFlattenBackground(background Color) error {
 	}
 
 	if alpha, e := img.vipsHasAlpha(); alpha && e == nil {
-		err := C.vips_flatten_background_brigde(img.Image, &image, backgroundC[0], backgroundC[1], backgroundC[2], backgroundC[3])
-		if int(err) != 0 {
-			return catchVipsError()
+		// The background is RGB, so CMYK and greyscale images under a colour need converting first
+		space, err := img.vipsInterpretation()
+		if err != nil {
+			return err
+		}
+		grey := background.R == background.G && background.G == background.B
+		if space == InterpretationCMYK || img.Image.Bands == 2 && !grey {
+			if err = img.vipsColourspace(InterpretationSRGB); err != nil {
+				return err
+			}
+		}
+
+		code := C.vips_flatten_background_brigde(img.Image, &image, backgroundC[0], backgroundC[1], backgroundC[2], backgroundC[3])
+		if int(code) != 0 {
+			return catchVipsError("flatten")
 		}
 		C.g_object_unref(C.gpointer(img.Image))
 		img.Image = image
@@ -554,10 +1100,11 @@ func (img *VipsImage) vipsBlob(name Blob) (*[]byte, error) {
 		return nil, ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"blob"}).Inc()
+	defer observeOperation("blob", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
-	defer C.vips_error_clear()
+	defer clearVipsError()
 
 	length := C.size_t(0)
 	blobErr := C.int(0)
@@ -579,31 +1126,187 @@ func (img *VipsImage) vipsBlob(name Blob) (*[]byte, error) {
 	blobErr = C.vips_image_get_blob_bridge(img.Image, &ptr, &length, name.CString())
 
 	if int(blobErr) != 0 {
-		return nil, catchVipsError()
+		return nil, catchVipsError("blob")
 	}
 
 	buf := C.GoBytes(ptr, C.int(length))
 	return &buf, nil
 }
 
-func (img *VipsImage) vipsPreSave(o *vipsSaveOptions) error {
+func (img *VipsImage) vipsSetBlob(name Blob, data []byte) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
-	//m.Lock()
+	if len(data) == 0 {
+		return fmt.Errorf("Cannot set an empty %s", name)
+	}
+	vimgOperations.With(prometheus.Labels{"type":"setblob"}).Inc()
+	defer observeOperation("setblob", time.Now())
+
+	var image *C.VipsImage
+
+	// libvips takes its own copy of the data
+	err := C.vips_image_set_blob_bridge(img.Image, &image, name.CString(), unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	if err != 0 {
+		return catchVipsError("setblob")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// vipsSSIM measures the structural similarity of the luminance of img and other, 1 being identical.
+func (img *VipsImage) vipsSSIM(other *VipsImage) (float64, error) {
+	if reflect.ValueOf(img.Image).IsNil() || reflect.ValueOf(other.Image).IsNil() {
+		return 0, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"ssim"}).Inc()
+	defer observeOperation("ssim", time.Now())
+
+	ssim := C.double(0)
+	err := C.vips_ssim_bridge(img.Image, other.Image, &ssim)
+	if err != 0 {
+		return 0, catchVipsError("ssim")
+	}
+
+	return float64(ssim), nil
+}
+
+func vipsStackAverage(images []*VipsImage) (*C.VipsImage, error) {
+	vimgOperations.With(prometheus.Labels{"type":"stackaverage"}).Inc()
+	defer observeOperation("stackaverage", time.Now())
+
+	// The array of image pointers has to live in C memory
+	n := len(images)
+	in := (*[1 << 28]*C.VipsImage)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(uintptr(0)))))[:n:n]
+	defer C.free(unsafe.Pointer(&in[0]))
+	for i, img := range images {
+		in[i] = img.Image
+	}
+
+	var image *C.VipsImage
+
+	err := C.vips_stack_average_bridge(&in[0], &image, C.int(n))
+	if err != 0 {
+		return nil, catchVipsError("stackaverage")
+	}
+	return image, nil
+}
+
+func (img *VipsImage) vipsPreSave(o *vipsSaveOptions) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	//m.Lock()
 	//defer m.Unlock()
 
 	var image *C.VipsImage
+	current, err := img.vipsInterpretation()
+	if err != nil {
+		return err
+	}
+	hasProfile, err := img.hasProfile()
+	if err != nil {
+		return err
+	}
+
+	// Assign the input ICC profile, before any colour transforms. CMYK images keep an embedded one, as print
+	// workflows embed the profile for the press, so it's only a fallback for those.
+	if o.InputICC != "" && !(current == InterpretationCMYK && hasProfile) {
+		profile, err := ioutil.ReadFile(o.InputICC)
+		if err != nil {
+			return err
+		}
+		err = img.SetICCProfile(profile)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Remove ICC profile metadata
 	if o.NoProfile {
 		C.remove_profile(img.Image)
 	}
 
+	// Keep just the orientation and ICC profile, which stripping would remove too
+	if o.MetadataPreset == MetadataMinimal {
+		img.vipsRemoveMetadata(minimalMetadataPrefixes)
+		o.StripMetadata = false
+	}
+
+	// Strip by removing everything else, the saver's strip would take the kept blobs too
+	if o.StripMetadata && len(o.KeepMetadata) > 0 {
+		img.vipsRemoveMetadata(strippedMetadataPrefixes(o.KeepMetadata))
+		o.StripMetadata = false
+	}
+
+	// libvips writes the EXIF block from the tags left, so removed ones are left out
+	if len(o.RemoveEXIFTags) > 0 {
+		img.vipsRemoveEXIFTags(o.RemoveEXIFTags)
+	}
+
+	// Output resolution, if set
+	if o.XRes > 0 || o.YRes > 0 {
+		xres, yres := o.XRes, o.YRes
+		if yres <= 0 {
+			yres = xres
+		} else if xres <= 0 {
+			xres = yres
+		}
+		if err := img.vipsSetResolution(xres, yres); err != nil {
+			return err
+		}
+	}
+
+	// Resizing changes the frame height, savers need the new one to split the frames up again
+	if img.pages > 1 {
+		pageHeight := int(img.Image.Ysize) / img.pages
+		if pageHeight < 1 {
+			pageHeight = 1
+		}
+		// Shrinks round the whole stack, crop the leftover rows so the frames stay the same height
+		if height := pageHeight * img.pages; height < int(img.Image.Ysize) {
+			var image *C.VipsImage
+			err := C.vips_extract_area_bridge(img.Image, &image, 0, 0, img.Image.Xsize, C.int(height))
+			if err != 0 {
+				return catchVipsError("extract")
+			}
+			C.g_object_unref(C.gpointer(img.Image))
+			img.Image = image
+		}
+		if err := img.vipsImageSetInt("page-height", pageHeight); err != nil {
+			return err
+		}
+	}
+
 	// Use a default interpretation and cast it to C type
 	if o.Interpretation == 0 {
 		o.Interpretation = InterpretationSRGB
+		// Keep greyscale images single banded, a JPEG would otherwise get three identical components
+		if img.keepsGrayscale() {
+			o.Interpretation = InterpretationBW
+		}
 	}
 	interpretation := C.VipsInterpretation(o.Interpretation)
+
+	// A generic conversion out of CMYK guesses at the inks, import with the profile first when there is one
+	hasProfile, err = img.hasProfile()
+	if err != nil {
+		return err
+	}
+	if current == InterpretationCMYK && o.Interpretation != InterpretationCMYK && o.OutputICC == "" && hasProfile {
+		err := C.vips_icc_import_bridge(img.Image, &image)
+		if int(err) != 0 {
+			return catchVipsError("presave")
+		}
+		C.g_object_unref(C.gpointer(img.Image))
+		img.Image = image
+		// The profile describes the CMYK pixels, not the converted ones
+		C.remove_profile(img.Image)
+	}
+
 	// Apply the proper colour space
 	space, err := img.vipsColourspaceIsSupported()
 	if err != nil {
@@ -613,13 +1316,13 @@ func (img *VipsImage) vipsPreSave(o *vipsSaveOptions) error {
 	if space {
 		err := C.vips_colourspace_bridge(img.Image, &image, interpretation)
 		if int(err) != 0 {
-			return catchVipsError()
+			return catchVipsError("presave")
 		}
 		C.g_object_unref(C.gpointer(img.Image))
 		img.Image = image
 	}
 
-	hasProfile, err := img.hasProfile()
+	hasProfile, err = img.hasProfile()
 	if err != nil {
 		return err
 	}
@@ -629,7 +1332,7 @@ func (img *VipsImage) vipsPreSave(o *vipsSaveOptions) error {
 		defer C.free(unsafe.Pointer(outputIccPath))
 		err := C.vips_icc_transform_bridge(img.Image, &image, outputIccPath)
 		if int(err) != 0 {
-			return catchVipsError()
+			return catchVipsError("presave")
 		}
 		C.g_object_unref(C.gpointer(img.Image))
 		img.Image = image
@@ -638,18 +1341,125 @@ func (img *VipsImage) vipsPreSave(o *vipsSaveOptions) error {
 }
 
 func (img *VipsImage) vipsSave(o vipsSaveOptions) error {
+	ptr, length, err := img.vipsEncode(o)
+	if err != nil {
+		return err
+	}
+	img.Buffer = C.GoBytes(ptr, C.int(length))
+	C.g_free(C.gpointer(ptr))
+
+	return nil
+}
+
+// saveChunkSize is how much of the encoded image vipsSaveTo hands the writer at a time.
+const saveChunkSize = 64 * 1024
+
+// vipsSaveTo writes the encoded image to w straight from the libvips buffer, without copying all of it into Go first.
+func (img *VipsImage) vipsSaveTo(o vipsSaveOptions, w io.Writer) error {
+	ptr, length, err := img.vipsEncode(o)
+	if err != nil {
+		return err
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	for offset := C.size_t(0); offset < length; offset += saveChunkSize {
+		n := length - offset
+		if n > saveChunkSize {
+			n = saveChunkSize
+		}
+		chunk := (*[saveChunkSize]byte)(unsafe.Pointer(uintptr(ptr) + uintptr(offset)))[:n:n]
+		if _, err = w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// vipsSaveFile saves the image straight to the file at path, the saver picked by its extension. The options libvips
+// can take in a filename are passed that way, see vipsFileSaveOptions.
+func (img *VipsImage) vipsSaveFile(o vipsSaveOptions, path string) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
+	vimgOperations.With(prometheus.Labels{"type":"savefile"}).Inc()
+	defer observeOperation("savefile", time.Now())
+
+	if o.Type != 0 {
+		if err := CanSave(o.Type); err != nil {
+			return err
+		}
+	}
+
+	err := img.vipsPreSave(&o)
+	if err != nil {
+		return err
+	}
+
+	watch := img.vipsWatchProgress(img.Image)
+	defer unregisterProgress(watch)
+
+	filename := C.CString(path + vipsFileSaveOptions(o))
+	defer C.free(unsafe.Pointer(filename))
+	if int(C.vips_save_file_bridge(img.Image, filename)) != 0 {
+		return catchVipsError("savefile")
+	}
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = nil
+	return nil
+}
+
+// vipsFileSaveOptions returns the saver options for o in the bracketed form libvips reads from a filename. Only the
+// options the saver for o.Type accepts are given, libvips fails the save on any other.
+func vipsFileSaveOptions(o vipsSaveOptions) string {
+	var options []string
+	switch o.Type {
+	case PNG:
+		options = append(options, fmt.Sprintf("compression=%d", o.Compression))
+	case WEBP:
+		options = append(options, fmt.Sprintf("Q=%d", o.Quality))
+		if o.Lossless {
+			options = append(options, "lossless")
+		}
+	case JPEG, TIFF:
+		options = append(options, fmt.Sprintf("Q=%d", o.Quality))
+	}
+	if o.Interlace && (o.Type == JPEG || o.Type == PNG) {
+		options = append(options, "interlace")
+	}
+	if o.StripMetadata {
+		options = append(options, "strip")
+	}
+	return "[" + strings.Join(options, ",") + "]"
+}
+
+// vipsEncode saves the image to a libvips allocated buffer, which the caller must g_free.
+func (img *VipsImage) vipsEncode(o vipsSaveOptions) (unsafe.Pointer, C.size_t, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, 0, ErrVipsImageNotValidPointer
+	}
 	vimgOperations.With(prometheus.Labels{"type":"save"}).Inc()
+	defer observeOperation("save", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
 	var ptr unsafe.Pointer
 
+	// Check before the colour conversions in vipsPreSave
+	if o.Type != 0 {
+		if err := CanSave(o.Type); err != nil {
+			return nil, 0, err
+		}
+	}
+
 	err := img.vipsPreSave(&o)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	if o.BeforeEncode != nil {
+		if err = o.BeforeEncode(); err != nil {
+			return nil, 0, err
+		}
 	}
 
 	// When an image has an unsupported color space, vipsPreSave
@@ -668,9 +1478,28 @@ func (img *VipsImage) vipsSave(o vipsSaveOptions) error {
 	strip := C.int(boolToInt(o.StripMetadata))
 	lossless := C.int(boolToInt(o.Lossless))
 
-	if o.Type != 0 && !IsTypeSupportedSave(o.Type) {
-		return fmt.Errorf("VIPS cannot save to %#v", ImageTypes[o.Type])
+	subsample, err := vipsSubsampleMode(o.Subsampling)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tiff, err := vipsTiffOptions(o)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	palette, colours, err := vipsPaletteOptions(o)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nearLossless, effort, smartSubsample, err := vipsWebpOptions(o)
+	if err != nil {
+		return nil, 0, err
 	}
+
+	watch := img.vipsWatchProgress(img.Image)
+	defer unregisterProgress(watch)
 /*
 	switch o.Type {
 	case WEBP:
@@ -680,12 +1509,12 @@ func (img *VipsImage) vipsSave(o vipsSaveOptions) error {
 	case TIFF:
 		saveErr = C.vips_tiffsave_bridge(img.Image, &ptr, &length)
 	default:
-		saveErr = C.vips_jpegsave_bridge(img.Image, &ptr, &length, strip, quality, interlace)
+		saveErr = C.vips_jpegsave_bridge(img.Image, &ptr, &length, strip, quality, interlace, subsample)
 	}
 
 	if int(saveErr) != 0 {
 		C.g_free(C.gpointer(ptr))
-		return catchVipsError()
+		return catchVipsError("save")
 	}
 
 	buf := C.GoBytes(ptr, C.int(length))
@@ -698,27 +1527,34 @@ func (img *VipsImage) vipsSave(o vipsSaveOptions) error {
 
 	C.g_free(C.gpointer(ptr))*/
 
-	switch o.Type {
-	case WEBP:
-		saveErr = C.vips_webpsave_bridge(img.Image, &ptr, &length, strip, quality, lossless)
-	case PNG:
-		saveErr = C.vips_pngsave_bridge(img.Image, &ptr, &length, strip, C.int(o.Compression), quality, interlace)
-	case TIFF:
-		saveErr = C.vips_tiffsave_bridge(img.Image, &ptr, &length)
+	switch {
+	case o.Suffix != "":
+		suffix := C.CString(o.Suffix)
+		defer C.free(unsafe.Pointer(suffix))
+		saveErr = C.vips_save_suffix_bridge(img.Image, suffix, &ptr, &length)
+	case o.Type == WEBP:
+		saveErr = C.vips_webpsave_bridge(img.Image, &ptr, &length, strip, quality, lossless, nearLossless, effort, smartSubsample)
+	case o.Type == PNG:
+		saveErr = C.vips_pngsave_bridge(img.Image, &ptr, &length, strip, C.int(o.Compression), quality, interlace, palette, colours, C.double(o.Dither))
+	case o.Type == TIFF:
+		saveErr = C.vips_tiffsave_bridge(img.Image, &ptr, &length, tiff.compression, quality, tiff.tile, tiff.tileWidth, tiff.tileHeight, tiff.pyramid)
 	default:
-		saveErr = C.vips_jpegsave_bridge(img.Image, &ptr, &length, strip, quality, interlace)
+		saveErr = C.vips_jpegsave_bridge(img.Image, &ptr, &length, strip, quality, interlace, subsample)
 	}
 	if int(saveErr) != 0 {
 		C.g_free(C.gpointer(ptr))
-		return catchVipsError()
+		return nil, 0, catchVipsError("save")
 	}
-
-	buf := C.GoBytes(ptr, C.int(length))
-	img.Buffer = buf
 	C.g_object_unref(C.gpointer(img.Image))
-	C.g_free(C.gpointer(ptr))
+	img.Image = nil
 
-	return nil
+	// Without libimagequant libvips ignores the palette and saves a full colour PNG, the PNG header tells
+	if o.Suffix == "" && o.Type == PNG && palette != 0 && (length < 26 || !isIndexedPNG(C.GoBytes(ptr, 26))) {
+		C.g_free(C.gpointer(ptr))
+		return nil, 0, errors.New("This libvips build has no PNG quantisation support, so can't save a palette PNG")
+	}
+
+	return ptr, length, nil
 }
 
 func (img *VipsImage) getImageBuffer() ([]byte, error) {
@@ -726,6 +1562,7 @@ func (img *VipsImage) getImageBuffer() ([]byte, error) {
 		return nil, ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"getbuffer"}).Inc()
+	defer observeOperation("getbuffer", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -734,20 +1571,41 @@ func (img *VipsImage) getImageBuffer() ([]byte, error) {
 	interlace := C.int(0)
 	quality := C.int(100)
 
+	// Intermediate buffers are encoded from the output interpretation, not the (possibly float) working space
+	in := img.Image
+	if img.Options.WorkingSpace != 0 {
+		interpretation := img.Options.Interpretation
+		if interpretation == 0 {
+			interpretation = InterpretationSRGB
+		}
+		if C.vips_colourspace_bridge(img.Image, &in, C.VipsInterpretation(interpretation)) != 0 {
+			return nil, catchVipsError("getbuffer")
+		}
+		defer C.g_object_unref(C.gpointer(in))
+	}
+
+	watch := img.vipsWatchProgress(in)
+	defer unregisterProgress(watch)
+
 	err := C.int(0)
 	switch img.Type {
 	case WEBP:
-		err = C.vips_webpsave_bridge(img.Image, &ptr, &length, 0, quality, 1)
+		// A lossless quality 100 WEBP is very slow to encode, so use the configured options instead
+		webpQuality := C.int(img.Options.Quality)
+		if webpQuality == 0 {
+			webpQuality = C.int(Quality)
+		}
+		err = C.vips_webpsave_bridge(in, &ptr, &length, 0, webpQuality, C.int(boolToInt(img.Options.Lossless)), 0, defaultWebpEffort, 0)
 	case PNG:
-		err = C.vips_pngsave_bridge(img.Image, &ptr, &length, 0, 0, quality, interlace)
+		err = C.vips_pngsave_bridge(in, &ptr, &length, 0, 0, quality, interlace, 0, 0, 0)
 	case TIFF:
-		err = C.vips_tiffsave_bridge(img.Image, &ptr, &length)
+		err = C.vips_tiffsave_bridge(in, &ptr, &length, C.VIPS_FOREIGN_TIFF_COMPRESSION_NONE, quality, 0, 128, 128, 0)
 	default:
-		err = C.vips_jpegsave_bridge(img.Image, &ptr, &length, 0, quality, interlace)
+		err = C.vips_jpegsave_bridge(in, &ptr, &length, 0, quality, interlace, C.SUBSAMPLE_AUTO)
 	}
 	if int(err) != 0 {
 		C.g_free(C.gpointer(ptr))
-		return nil, catchVipsError()
+		return nil, catchVipsError("getbuffer")
 	}
 
 	buf := C.GoBytes(ptr, C.int(length))
@@ -757,39 +1615,221 @@ func (img *VipsImage) getImageBuffer() ([]byte, error) {
 	return buf, nil
 }
 
+// vipsSubsampleMode maps Options.JpegSubsampling to the libvips subsample mode.
+// libvips only lets chroma subsampling be switched on (4:2:0) or off (4:4:4), so 4:2:2 is rejected.
+func vipsSubsampleMode(subsampling string) (C.int, error) {
+	switch subsampling {
+	case "":
+		return C.SUBSAMPLE_AUTO, nil
+	case "420":
+		return C.SUBSAMPLE_ON, nil
+	case "444":
+		return C.SUBSAMPLE_OFF, nil
+	case "422":
+		return 0, errors.New("JPEG 4:2:2 chroma subsampling is not supported by libvips")
+	}
+	return 0, fmt.Errorf("Unsupported JPEG chroma subsampling %q", subsampling)
+}
+
+// vipsTiffSaveOptions holds the TIFF save settings as libvips takes them.
+type vipsTiffSaveOptions struct {
+	compression C.int
+	tile        C.int
+	tileWidth   C.int
+	tileHeight  C.int
+	pyramid     C.int
+}
+
+// vipsTiffOptions maps the TIFF save options to libvips, by default the TIFF is stripped and uncompressed.
+// A pyramid has to be tiled, so it turns tiling on.
+func vipsTiffOptions(o vipsSaveOptions) (vipsTiffSaveOptions, error) {
+	t := vipsTiffSaveOptions{
+		tile:       C.int(boolToInt(o.TIFFTile || o.TIFFPyramid)),
+		tileWidth:  128,
+		tileHeight: 128,
+		pyramid:    C.int(boolToInt(o.TIFFPyramid)),
+	}
+
+	switch o.TIFFCompression {
+	case "", "none":
+		t.compression = C.VIPS_FOREIGN_TIFF_COMPRESSION_NONE
+	case "lzw":
+		t.compression = C.VIPS_FOREIGN_TIFF_COMPRESSION_LZW
+	case "deflate":
+		t.compression = C.VIPS_FOREIGN_TIFF_COMPRESSION_DEFLATE
+	case "jpeg":
+		t.compression = C.VIPS_FOREIGN_TIFF_COMPRESSION_JPEG
+	default:
+		return t, fmt.Errorf("Unsupported TIFF compression %q", o.TIFFCompression)
+	}
+
+	// libvips needs tile sizes in multiples of 16
+	for _, size := range []struct {
+		value int
+		tile  *C.int
+	}{{o.TIFFTileWidth, &t.tileWidth}, {o.TIFFTileHeight, &t.tileHeight}} {
+		if size.value == 0 {
+			continue
+		}
+		if size.value < 0 || size.value%16 != 0 {
+			return t, fmt.Errorf("TIFF tile sizes must be a positive multiple of 16, got %d", size.value)
+		}
+		*size.tile = C.int(size.value)
+	}
+
+	return t, nil
+}
+
+// vipsPaletteOptions maps the PNG palette options to libvips, 256 colours unless Options.Colors says otherwise.
+func vipsPaletteOptions(o vipsSaveOptions) (C.int, C.int, error) {
+	if !o.Palette || o.Type != PNG {
+		return 0, 0, nil
+	}
+	if !(VipsMajorVersion > 8 || VipsMajorVersion == 8 && VipsMinorVersion >= 7) {
+		return 0, 0, errors.New("Palette PNGs need libvips 8.7 or later")
+	}
+	if o.Colors < 0 || o.Colors > 256 || o.Colors == 1 {
+		return 0, 0, fmt.Errorf("A PNG palette needs 2 to 256 colours, got %d", o.Colors)
+	}
+	if o.Dither < 0 || o.Dither > 1 {
+		return 0, 0, fmt.Errorf("PNG dithering must be between 0 and 1, got %g", o.Dither)
+	}
+
+	colours := o.Colors
+	if colours == 0 {
+		colours = 256
+	}
+	return 1, C.int(colours), nil
+}
+
+// defaultWebpEffort is libvips' own default reduction effort.
+const defaultWebpEffort = 4
+
+func vipsWebpOptions(o vipsSaveOptions) (C.int, C.int, C.int, error) {
+	if o.Type != WEBP || !o.WebPNearLossless && o.WebPEffort == nil && !o.WebPSmartSubsample {
+		return 0, defaultWebpEffort, 0, nil
+	}
+	if !(VipsMajorVersion > 8 || VipsMajorVersion == 8 && VipsMinorVersion >= 8) {
+		return 0, 0, 0, errors.New("WEBP near lossless, effort and smart subsampling need libvips 8.8 or later")
+	}
+
+	effort := defaultWebpEffort
+	if o.WebPEffort != nil {
+		effort = *o.WebPEffort
+		if effort < 0 || effort > 6 {
+			return 0, 0, 0, fmt.Errorf("WEBP effort must be between 0 and 6, got %d", effort)
+		}
+	}
+	return C.int(boolToInt(o.WebPNearLossless)), C.int(effort), C.int(boolToInt(o.WebPSmartSubsample)), nil
+}
+
+// isIndexedPNG checks the IHDR colour type of a PNG for a palette.
+func isIndexedPNG(buf []byte) bool {
+	return len(buf) > 25 && string(buf[12:16]) == "IHDR" && buf[25] == 3
+}
+
+// isLosslessWebP walks the RIFF chunks of a WebP for its bitstream, VP8L being lossless and VP8 lossy.
+func isLosslessWebP(buf []byte) bool {
+	for i := 12; i+8 <= len(buf); {
+		switch string(buf[i : i+4]) {
+		case "VP8L":
+			return true
+		case "VP8 ":
+			return false
+		}
+		size := int(buf[i+4]) | int(buf[i+5])<<8 | int(buf[i+6])<<16 | int(buf[i+7])<<24
+		// Chunks are padded to an even size
+		i += 8 + size + size%2
+	}
+	return false
+}
+
+// jpegStandardLuminanceSum is the sum of the example luminance quantisation table in the JPEG standard, which libjpeg
+// scales for its quality setting.
+const jpegStandardLuminanceSum = 3688
+
+// jpegQuality estimates the libjpeg quality a JPEG was saved at from its first quantisation table, 0 when there isn't
+// one.
+func jpegQuality(buf []byte) int {
+	for i := 2; i+4 <= len(buf); {
+		if buf[i] != 0xFF {
+			i++
+			continue
+		}
+		marker := buf[i+1]
+		length := int(buf[i+2])<<8 | int(buf[i+3])
+		// The tables come before the scan
+		if marker == 0xDA {
+			return 0
+		}
+		if marker == 0xDB && i+5+64 <= len(buf) {
+			sum := 0
+			if buf[i+4]>>4 == 0 {
+				for _, v := range buf[i+5 : i+5+64] {
+					sum += int(v)
+				}
+			} else if i+5+128 <= len(buf) {
+				for j := i + 5; j < i+5+128; j += 2 {
+					sum += int(buf[j])<<8 | int(buf[j+1])
+				}
+			}
+			// libjpeg scales the table by 5000 / quality below 50 and 200 - 2 * quality from there
+			scale := float64(sum) * 100 / jpegStandardLuminanceSum
+			quality := 5000 / scale
+			if scale <= 100 {
+				quality = (200 - scale) / 2
+			}
+			return int(math.Max(1, math.Min(100, math.Round(quality))))
+		}
+		i += 2 + length
+	}
+	return 0
+}
+
+// vipsWatchProgress connects Options.ProgressCallback to the libvips progress signals of the image about to be encoded,
+// libvips is lazy so progress is only reported as the image is evaluated, i.e. when it's encoded.
+// The returned watch must be passed to unregisterProgress once the evaluation is done.
+func (img *VipsImage) vipsWatchProgress(image *C.VipsImage) progressWatch {
+	if img.Options.ProgressCallback == nil {
+		return progressWatch{}
+	}
+	// Keep the image alive until the signals are disconnected, the caller may unref it first
+	C.g_object_ref(C.gpointer(image))
+	w := progressWatch{handle: registerProgress(img.Options.ProgressCallback), image: image}
+	C.vips_progress_bridge(image, C.int(w.handle), &w.eval, &w.posteval)
+	return w
+}
+
 func (img *VipsImage) vipsExtract(left, top, width, height float32) (*VipsImage, error) {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return nil, ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"extract"}).Inc()
+	defer observeOperation("extract", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 	var image *C.VipsImage
 
-	if width > MaxSize || height > MaxSize {
+	if limit := float32(img.maxImageSize()); width > limit || height > limit {
 		return nil, errors.New("Maximum image size exceeded")
 	}
 
-	srcX := float32(img.Image.Xsize)
-	srcY := float32(img.Image.Ysize)
-
 	if img.Options.Extract.Relative {
-		top = srcY * (top/100)
-		left = srcX * (left/100)
-		height = srcY * (height/100)
-		width = srcX * (width/100)
+		l, t, w, h := calculateRelativeArea(int(img.Image.Xsize), int(img.Image.Ysize), left, top, width, height)
+		left, top, width, height = float32(l), float32(t), float32(w), float32(h)
 	}
 
 	err := C.vips_extract_area_bridge(img.Image, &image, C.int(left), C.int(top), C.int(width), C.int(height))
 	if err != 0 {
-		return nil, catchVipsError()
+		return nil, catchVipsError("extract")
 	}
 
+	// Inherit the source type and options, so the buffer is encoded the same way (e.g. a PNG crop keeps its alpha)
 	var e error
 	i := AquireVipsImage()
 	i.Image = image
-	i.Type = JPEG
-	i.Options = Options{}
+	i.Type = img.Type
+	i.Options = img.Options
 	i.Buffer, e = i.getImageBuffer()
 	if e != nil {
 		return nil, e
@@ -797,22 +1837,38 @@ func (img *VipsImage) vipsExtract(left, top, width, height float32) (*VipsImage,
 	return i, nil
 }
 
-func (img *VipsImage) vipsSmartCrop(width, height int) error {
+func (img *VipsImage) vipsExtractBand(start, n int) (*C.VipsImage, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"extractband"}).Inc()
+	defer observeOperation("extractband", time.Now())
+	var image *C.VipsImage
+
+	err := C.vips_extract_band_bridge(img.Image, &image, C.int(start), C.int(n))
+	if err != 0 {
+		return nil, catchVipsError("extractband")
+	}
+	return image, nil
+}
+
+func (img *VipsImage) vipsSmartCrop(width, height int, strategy SmartCropStrategy) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"smartcrop"}).Inc()
+	defer observeOperation("smartcrop", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 	var image *C.VipsImage
 
-	if width > MaxSize || height > MaxSize {
+	if limit := img.maxImageSize(); width > limit || height > limit {
 		return errors.New("Maximum image size exceeded")
 	}
 
-	err := C.vips_smartcrop_bridge(img.Image, &image, C.int(width), C.int(height))
+	err := C.vips_smartcrop_bridge(img.Image, &image, C.int(width), C.int(height), C.int(strategy))
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("smartcrop")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -821,11 +1877,39 @@ func (img *VipsImage) vipsSmartCrop(width, height int) error {
 	return nil
 }
 
+// vipsSmartCropRect smart crops as vipsSmartCrop does and returns the area taken.
+func (img *VipsImage) vipsSmartCropRect(width, height int, strategy SmartCropStrategy) (ImageRect, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ImageRect{}, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"smartcrop"}).Inc()
+	defer observeOperation("smartcrop", time.Now())
+	var image *C.VipsImage
+
+	if limit := img.maxImageSize(); width > limit || height > limit {
+		return ImageRect{}, errors.New("Maximum image size exceeded")
+	}
+
+	left := C.int(0)
+	top := C.int(0)
+	err := C.vips_smartcrop_rect_bridge(img.Image, &image, C.int(width), C.int(height), C.int(strategy), &left, &top)
+	if err != 0 {
+		return ImageRect{}, catchVipsError("smartcrop")
+	}
+
+	rect := ImageRect{Left: int(left), Top: int(top), Width: int(image.Xsize), Height: int(image.Ysize)}
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return rect, nil
+}
+
 func (img *VipsImage) vipsTrim(background Color, threshold float64) (int, int, int, int, error) {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return 0, 0, 0, 0,ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"trim"}).Inc()
+	defer observeOperation("trim", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -839,17 +1923,38 @@ func (img *VipsImage) vipsTrim(background Color, threshold float64) (int, int, i
 		C.double(background.R), C.double(background.G), C.double(background.B),
 		C.double(threshold))
 	if err != 0 {
-		return 0, 0, 0, 0, catchVipsError()
+		return 0, 0, 0, 0, catchVipsError("trim")
 	}
 
 	return int(top), int(left), int(width), int(height), nil
 }
 
+// vipsCornerColor reads the top-left pixel, used as the background to trim against when none is given
+func (img *VipsImage) vipsCornerColor() (Color, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ColorBlack, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"getpoint"}).Inc()
+	defer observeOperation("getpoint", time.Now())
+
+	r := C.double(0)
+	g := C.double(0)
+	b := C.double(0)
+
+	err := C.vips_corner_colour_bridge(img.Image, &r, &g, &b)
+	if err != 0 {
+		return ColorBlack, catchVipsError("getpoint")
+	}
+
+	return Color{uint8(math.Round(float64(r))), uint8(math.Round(float64(g))), uint8(math.Round(float64(b))), 0}, nil
+}
+
 func (img *VipsImage) vipsShrinkJpeg(shrink int) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"shrink_jpeg"}).Inc()
+	defer observeOperation("shrink_jpeg", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -860,7 +1965,36 @@ func (img *VipsImage) vipsShrinkJpeg(shrink int) error {
 	err := C.vips_jpegload_buffer_shrink(ptr, C.size_t(len(img.Buffer)), &image, C.int(shrink))
 	if err != 0 {
 		//C.g_free(C.gpointer(ptr))
-		return catchVipsError()
+		return catchVipsError("shrink_jpeg")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsLoadVectorScaled(scale float64) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"load_vector"}).Inc()
+	defer observeOperation("load_vector", time.Now())
+
+	var image *C.VipsImage
+	var ptr = unsafe.Pointer(&img.Buffer[0])
+
+	var err C.int
+	if img.Type == PDF {
+		// Keep to the page and DPI it was loaded with
+		err = C.vips_pdfload_bridge(ptr, C.size_t(len(img.Buffer)), &image, C.int(img.Options.Page), 1, C.double(img.Options.PDFDPI), C.double(scale))
+	} else if img.Type == SVG && (img.Options.SVGScale != 0 || img.Options.SVGDPI != 0) {
+		err = C.vips_svgload_bridge(ptr, C.size_t(len(img.Buffer)), &image, C.double(img.Options.SVGDPI), C.double(scale * img.Options.svgScale()))
+	} else {
+		err = C.vips_vectorload_buffer_scale(ptr, C.size_t(len(img.Buffer)), &image, C.int(img.Type), C.double(scale))
+	}
+	if err != 0 {
+		return catchVipsError("load_vector")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -874,6 +2008,7 @@ func (img *VipsImage) vipsShrinkWebp(shrink int) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"shrink_webp"}).Inc()
+	defer observeOperation("shrink_webp", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -883,7 +2018,7 @@ func (img *VipsImage) vipsShrinkWebp(shrink int) error {
 	err := C.vips_webpload_buffer_shrink(ptr, C.size_t(len(img.Buffer)), &image, C.int(shrink))
 	if err != 0 {
 		//C.g_free(C.gpointer(ptr))
-		return catchVipsError()
+		return catchVipsError("shrink_webp")
 	}
 
 	//C.g_free(C.gpointer(ptr))
@@ -898,45 +2033,109 @@ func (img *VipsImage) vipsShrink(shrink int) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"shrink"}).Inc()
+	defer observeOperation("shrink", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
-	var image *C.VipsImage
+	return img.withPremultipliedAlpha(func() error {
+		var image *C.VipsImage
 
-	err := C.vips_shrink_bridge(img.Image, &image, C.double(float64(shrink)), C.double(float64(shrink)))
+		err := C.vips_shrink_bridge(img.Image, &image, C.double(float64(shrink)), C.double(float64(shrink)))
 
-	if err != 0 {
-		return catchVipsError()
+		if err != 0 {
+			return catchVipsError("shrink")
+		}
+
+		C.g_object_unref(C.gpointer(img.Image))
+		img.Image = image
+
+		return nil
+	})
+}
+
+// withPremultipliedAlpha runs resample on the image premultiplied by its alpha, unless Options.PremultiplyAlpha is
+// false, so the colour of transparent pixels doesn't bleed into the edges as a dark halo. Images without alpha are
+// resampled as they are.
+func (img *VipsImage) withPremultipliedAlpha(resample func() error) error {
+	alpha, err := img.vipsHasAlpha()
+	if err != nil {
+		return err
+	}
+	if !alpha || !img.Options.premultiplyAlpha() {
+		return resample()
 	}
 
+	var image *C.VipsImage
+	format := img.Image.BandFmt
+	if C.vips_premultiply_bridge(img.Image, &image) != 0 {
+		return catchVipsError("premultiply")
+	}
 	C.g_object_unref(C.gpointer(img.Image))
 	img.Image = image
 
+	if err = resample(); err != nil {
+		return err
+	}
+
+	if C.vips_unpremultiply_bridge(img.Image, &image, format) != 0 {
+		return catchVipsError("premultiply")
+	}
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
 	return nil
 }
 
+// imageInterpolatorToKernel maps interpolators to the kernel vips_resize uses, libvips ignores the interpolator
+// there since 8.3. Lanczos only exists as a kernel, so isn't a valid VipsInterpolate.
+var imageInterpolatorToKernel = map[Interpolator]C.int {
+	Nearest: C.VIPS_KERNEL_NEAREST,
+	Bilinear: C.VIPS_KERNEL_LINEAR,
+	Bicubic: C.VIPS_KERNEL_CUBIC,
+	Lanczos2: C.VIPS_KERNEL_LANCZOS2,
+	Lanczos3: C.VIPS_KERNEL_LANCZOS3,
+}
+
 func (img *VipsImage) vipsResize(scale float64, i Interpolator) error {
 	if reflect.ValueOf(img.Image).IsNil() {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"resize"}).Inc()
+	defer observeOperation("resize", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 	var image *C.VipsImage
 
-	interpolator := C.vips_interpolate_new(i.CString())
+	kernel, ok := imageInterpolatorToKernel[i]
+	if !ok {
+		kernel = -1
+	}
 
-	err := C.vips_resize_bridge(img.Image, &image, C.double(scale), interpolator)
+	// Round the frame height rather than the whole stack, so every frame of a multi-page image ends up the same height
+	vscale := scale
+	if img.pages > 1 {
+		pageHeight := float64(img.Image.Ysize) / float64(img.pages)
+		newPageHeight := math.Max(1, math.Round(pageHeight*scale))
+		vscale = newPageHeight * float64(img.pages) / float64(img.Image.Ysize)
+	}
 
-	C.g_object_unref(C.gpointer(interpolator))
+	return img.withPremultipliedAlpha(func() error {
+		// Lanczos has no VipsInterpolate, vips_resize only needs the kernel then
+		interpolator := C.vips_interpolate_new(i.CString())
 
-	if err != 0 {
-		return catchVipsError()
-	}
+		err := C.vips_resize_bridge(img.Image, &image, C.double(scale), C.double(vscale), interpolator, kernel)
 
-	C.g_object_unref(C.gpointer(img.Image))
-	img.Image = image
-	return nil
+		if interpolator != nil {
+			C.g_object_unref(C.gpointer(interpolator))
+		}
+
+		if err != 0 {
+			return catchVipsError("resize")
+		}
+
+		C.g_object_unref(C.gpointer(img.Image))
+		img.Image = image
+		return nil
+	})
 }
 
 func (img *VipsImage) vipsReduce(xshrink float64, yshrink float64) error {
@@ -944,21 +2143,24 @@ func (img *VipsImage) vipsReduce(xshrink float64, yshrink float64) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"reduce"}).Inc()
+	defer observeOperation("reduce", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
-	var image *C.VipsImage
+	return img.withPremultipliedAlpha(func() error {
+		var image *C.VipsImage
 
-	err := C.vips_reduce_bridge(img.Image, &image, C.double(xshrink), C.double(yshrink))
+		err := C.vips_reduce_bridge(img.Image, &image, C.double(xshrink), C.double(yshrink))
 
-	if err != 0 {
-		return catchVipsError()
-	}
+		if err != 0 {
+			return catchVipsError("reduce")
+		}
 
-	C.g_object_unref(C.gpointer(img.Image))
-	img.Image = image
+		C.g_object_unref(C.gpointer(img.Image))
+		img.Image = image
 
-	return nil
+		return nil
+	})
 }
 
 func (img *VipsImage) vipsEmbed(left, top, width, height int, extend Extend, background Color) error {
@@ -966,6 +2168,7 @@ func (img *VipsImage) vipsEmbed(left, top, width, height int, extend Extend, bac
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"embed"}).Inc()
+	defer observeOperation("embed", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -981,7 +2184,7 @@ func (img *VipsImage) vipsEmbed(left, top, width, height int, extend Extend, bac
 		C.int(height), C.int(extend), C.double(background.R), C.double(background.G), C.double(background.B))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("embed")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -995,10 +2198,16 @@ func (img *VipsImage) vipsAffine(residualx, residualy float64, i Interpolator) e
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"affine"}).Inc()
+	defer observeOperation("affine", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
 	var image *C.VipsImage
+
+	// vips_affine only takes a VipsInterpolate, which Lanczos isn't
+	if i == Lanczos2 || i == Lanczos3 {
+		i = Bicubic
+	}
 	interpolator := C.vips_interpolate_new(i.CString())
 
 	err := C.vips_affine_interpolator(img.Image, &image, C.double(residualx), 0, 0, C.double(residualy), interpolator)
@@ -1006,7 +2215,7 @@ func (img *VipsImage) vipsAffine(residualx, residualy float64, i Interpolator) e
 	C.g_object_unref(C.gpointer(interpolator))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("affine")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1015,6 +2224,20 @@ func (img *VipsImage) vipsAffine(residualx, residualy float64, i Interpolator) e
 	return nil
 }
 
+// vipsDecodeConfig reads the width and height from the image header without decoding the pixels.
+func vipsDecodeConfig(buf []byte) (int, int, error) {
+	vimgOperations.With(prometheus.Labels{"type":"decodeconfig"}).Inc()
+	defer observeOperation("decodeconfig", time.Now())
+
+	width := C.int(0)
+	height := C.int(0)
+	err := C.vips_decode_config_bridge(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &width, &height)
+	if err != 0 {
+		return 0, 0, catchVipsError("decodeconfig")
+	}
+	return int(width), int(height), nil
+}
+
 func vipsImageType(buf []byte) ImageType {
 	if len(buf) < 12 {
 		return UNKNOWN
@@ -1056,13 +2279,23 @@ func readImageType(buf []byte) string {
 	return C.GoString(load)
 }
 
-func catchVipsError() error {
+// catchVipsError turns the libvips error buffer into an error, counting it against the operation that failed.
+func catchVipsError(operation string) error {
+	vimgOperationErrors.With(prometheus.Labels{"type":operation}).Inc()
+	errorLock.Lock()
 	s := C.GoString(C.vips_error_buffer())
 	C.vips_error_clear()
+	errorLock.Unlock()
 	C.vips_thread_shutdown()
 	return errors.New(s)
 }
 
+func clearVipsError() {
+	errorLock.Lock()
+	defer errorLock.Unlock()
+	C.vips_error_clear()
+}
+
 func boolToInt(b bool) int {
 	if b {
 		return 1
@@ -1075,6 +2308,7 @@ func (img *VipsImage) vipsGaussianBlur(o GaussianBlur) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"blur"}).Inc()
+	defer observeOperation("blur", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -1085,7 +2319,41 @@ func (img *VipsImage) vipsGaussianBlur(o GaussianBlur) error {
 	err := C.vips_gaussblur_bridge(img.Image, &image, C.double(o.Sigma), C.double(o.MinAmpl))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("blur")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// validateMedian checks a median filter size, which has to be odd so the window has a centre pixel.
+func validateMedian(size int) error {
+	if size < 1 || size%2 == 0 {
+		return fmt.Errorf("Median size must be odd and at least 1, got %d", size)
+	}
+	return nil
+}
+
+// vipsMedian replaces each pixel with the median of the size x size window around it, removing salt and pepper noise
+// while keeping edges.
+func (img *VipsImage) vipsMedian(size int) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"median"}).Inc()
+	defer observeOperation("median", time.Now())
+
+	if err := validateMedian(size); err != nil {
+		return err
+	}
+
+	var image *C.VipsImage
+
+	err := C.vips_median_bridge(img.Image, &image, C.int(size))
+	if err != 0 {
+		return catchVipsError("median")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1099,6 +2367,7 @@ func (img *VipsImage) vipsSharpen(o Sharpen) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"sharpen"}).Inc()
+	defer observeOperation("sharpen", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -1107,7 +2376,7 @@ func (img *VipsImage) vipsSharpen(o Sharpen) error {
 	err := C.vips_sharpen_bridge(img.Image, &image, C.double(o.Sigma), C.double(o.X1), C.double(o.Y2), C.double(o.Y3), C.double(o.M1), C.double(o.M2))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("sharpen")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1125,6 +2394,7 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"watermark_image"}).Inc()
+	defer observeOperation("watermark_image", time.Now())
 
 	srcX := float32(img.Image.Xsize)
 	srcY := float32(img.Image.Ysize)
@@ -1155,6 +2425,12 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 	if e != nil {
 		return e
 	}
+	// Turned after sizing, the corners are filled with transparency and it's placed by its new size
+	if math.Mod(o.Rotate, 360) != 0 {
+		if e = watermark.vipsRotate(Angle(o.Rotate)); e != nil {
+			return e
+		}
+	}
 
 	wmX := float32(watermark.Image.Xsize)
 	wmY := float32(watermark.Image.Ysize)
@@ -1205,12 +2481,12 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 		}
 	}
 
-	opts := vipsWatermarkImageOptions{C.int(left), C.int(top), C.float(o.Opacity), C.int(o.BlendMode)}
+	opts := vipsWatermarkImageOptions{C.int(left), C.int(top), C.float(o.Opacity), C.int(o.BlendMode), C.int(boolToInt(o.Tile))}
 
 	err := C.vips_watermark_image(img.Image, watermark.Image, &image, (*C.WatermarkImageOptions)(unsafe.Pointer(&opts)))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("watermark_image")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1224,6 +2500,7 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 		return ErrVipsImageNotValidPointer
 	}
 	vimgOperations.With(prometheus.Labels{"type":"watermark_image"}).Inc()
+	defer observeOperation("watermark_image", time.Now())
 	//m.Lock()
 	//defer m.Unlock()
 
@@ -1243,7 +2520,7 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 	err := C.vips_watermark_image(img.Image, watermark.Image, &image, (*C.WatermarkImageOptions)(unsafe.Pointer(&opts)))
 
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("watermark_image")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1254,13 +2531,17 @@ func (img *VipsImage) vipsDrawWatermark(o WatermarkImage) error {
 */
 
 func (img *VipsImage) vipsGamma(Gamma float64) error {
-	defer C.g_object_unref(C.gpointer(img.Image))
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"gamma"}).Inc()
+	defer observeOperation("gamma", time.Now())
 
 	var image *C.VipsImage
 
 	err := C.vips_gamma_bridge(img.Image, &image, C.double(Gamma))
 	if err != 0 {
-		return catchVipsError()
+		return catchVipsError("gamma")
 	}
 
 	C.g_object_unref(C.gpointer(img.Image))
@@ -1270,11 +2551,207 @@ func (img *VipsImage) vipsGamma(Gamma float64) error {
 }
 
 func (img *VipsImage) vipsExifStringTag(tag string) string {
-	return vipsExifShort(C.GoString(C.vips_exif_tag(img.Image, C.CString(tag))))
+	value, _ := img.GetEXIFTag(tag)
+	return value
 }
 
+// vipsExifIntTag parses the leading number of a tag like atoi, 0 when it's missing
 func (img *VipsImage) vipsExifIntTag(tag string) int {
-	return int(C.vips_exif_tag_to_int(img.Image, C.CString(tag)))
+	value, _ := img.GetEXIFTag(tag)
+	end := 0
+	for end < len(value) && (value[end] >= '0' && value[end] <= '9' || end == 0 && value[end] == '-') {
+		end++
+	}
+	i, _ := strconv.Atoi(value[:end])
+	return i
+}
+
+func (img *VipsImage) vipsImageGetString(name string) (string, bool) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return "", false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var value *C.char
+	if C.vips_image_get_string_bridge(img.Image, cname, &value) != 0 {
+		return "", false
+	}
+	// The string belongs to the image, so isn't freed
+	return C.GoString(value), true
+}
+
+func (img *VipsImage) vipsHeader() (map[string]string, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+
+	fields := C.vips_image_get_fields(img.Image)
+	defer C.g_strfreev(fields)
+
+	header := map[string]string{}
+	// A NULL terminated array of field names
+	names := (*[1 << 16]*C.char)(unsafe.Pointer(fields))
+	for i := 0; names[i] != nil; i++ {
+		var value *C.char
+		if C.vips_image_get_as_string(img.Image, names[i], &value) != 0 {
+			return nil, catchVipsError("header")
+		}
+		header[C.GoString(names[i])] = C.GoString(value)
+		C.g_free(C.gpointer(value))
+	}
+	return header, nil
+}
+
+// vipsRemoveMetadata removes every header field starting with one of prefixes.
+func (img *VipsImage) vipsRemoveMetadata(prefixes []string) {
+	img.vipsRemoveFields(func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// vipsRemoveEXIFTags removes the named EXIF tags, either by their libvips name, e.g. "exif-ifd3-GPSLatitude", or just
+// the tag name, e.g. "GPSLatitude", in any IFD. Tags the image doesn't have are ignored.
+func (img *VipsImage) vipsRemoveEXIFTags(tags []string) {
+	img.vipsRemoveFields(func(name string) bool {
+		if !strings.HasPrefix(name, "exif-ifd") {
+			return false
+		}
+		for _, tag := range tags {
+			if name == tag || strings.HasSuffix(name, "-" + tag) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// vipsRemoveFields removes every metadata field whose name matches.
+func (img *VipsImage) vipsRemoveFields(match func(name string) bool) {
+	fields := C.vips_image_get_fields(img.Image)
+	defer C.g_strfreev(fields)
+
+	// A NULL terminated array of field names
+	names := (*[1 << 16]*C.char)(unsafe.Pointer(fields))
+	for i := 0; names[i] != nil; i++ {
+		if match(C.GoString(names[i])) {
+			C.vips_image_remove(img.Image, names[i])
+		}
+	}
+}
+
+func (img *VipsImage) vipsImageGetInt(name string) (int, bool) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return 0, false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	value := C.int(0)
+	if C.vips_image_get_int_bridge(img.Image, cname, &value) != 0 {
+		return 0, false
+	}
+	return int(value), true
+}
+
+func (img *VipsImage) vipsImageSetString(name, value string) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"setstring"}).Inc()
+	defer observeOperation("setstring", time.Now())
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+
+	var image *C.VipsImage
+
+	err := C.vips_image_set_string_bridge(img.Image, &image, cname, cvalue)
+	if err != 0 {
+		return catchVipsError("setstring")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// vipsSetResolution sets the resolution in DPI.
+func (img *VipsImage) vipsSetResolution(xres, yres float64) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"resolution"}).Inc()
+	defer observeOperation("resolution", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_resolution_bridge(img.Image, &image, C.double(xres / 25.4), C.double(yres / 25.4))
+	if err != 0 {
+		return catchVipsError("resolution")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+// vipsSampleSize returns the number of bytes in each band of a pixel.
+func (img *VipsImage) vipsSampleSize() (int, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return 0, ErrVipsImageNotValidPointer
+	}
+	return int(C.vips_sample_size_bridge(img.Image)), nil
+}
+
+// vipsCopy returns a new reference to the image's pixels with its own header, which the caller must unref.
+func (img *VipsImage) vipsCopy() (*C.VipsImage, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"copy"}).Inc()
+	defer observeOperation("copy", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_copy_bridge(img.Image, &image)
+	if err != 0 {
+		return nil, catchVipsError("copy")
+	}
+
+	return image, nil
+}
+
+func (img *VipsImage) vipsImageSetInt(name string, value int) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"setint"}).Inc()
+	defer observeOperation("setint", time.Now())
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var image *C.VipsImage
+
+	err := C.vips_image_set_int_bridge(img.Image, &image, cname, C.int(value))
+	if err != 0 {
+		return catchVipsError("setint")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
 }
 
 func vipsExifShort(s string) string {
@@ -1282,4 +2759,95 @@ func vipsExifShort(s string) string {
 		return s[:strings.Index(s, "(")-1]
 	}
 	return s
-}
\ No newline at end of file
+}
+
+func (img *VipsImage) vipsGrayscale(keepAlpha bool) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"grayscale"}).Inc()
+	defer observeOperation("grayscale", time.Now())
+
+	var image *C.VipsImage
+
+	err := C.vips_grayscale_bridge(img.Image, &image, C.int(boolToInt(keepAlpha)))
+	if err != 0 {
+		return catchVipsError("grayscale")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
+
+func (img *VipsImage) vipsDeltaE(other *VipsImage) (float64, error) {
+	if reflect.ValueOf(img.Image).IsNil() || reflect.ValueOf(other.Image).IsNil() {
+		return 0, ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"deltae"}).Inc()
+	defer observeOperation("deltae", time.Now())
+
+	deltaE := C.double(0)
+
+	err := C.vips_delta_e_bridge(img.Image, other.Image, &deltaE)
+	if err != 0 {
+		return 0, catchVipsError("deltae")
+	}
+
+	return float64(deltaE), nil
+}
+
+func (img *VipsImage) vipsApply(operation string, args map[string]interface{}) error {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ErrVipsImageNotValidPointer
+	}
+	vimgOperations.With(prometheus.Labels{"type":"apply"}).Inc()
+	defer observeOperation("apply", time.Now())
+
+	// Arguments go over as strings, libvips parses them to the type the operation declares
+	n := len(args)
+	names := make([]*C.char, 0, n+1)
+	values := make([]*C.char, 0, n+1)
+	defer func() {
+		for i := range names {
+			C.free(unsafe.Pointer(names[i]))
+			C.free(unsafe.Pointer(values[i]))
+		}
+	}()
+	for name, arg := range args {
+		var value string
+		switch v := arg.(type) {
+		case int:
+			value = strconv.Itoa(v)
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case string:
+			value = v
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("Unsupported type %T for argument %s", arg, name)
+		}
+		names = append(names, C.CString(name))
+		values = append(values, C.CString(value))
+	}
+	// Keep a valid pointer for operations without arguments
+	names = append(names, nil)
+	values = append(values, nil)
+
+	cOperation := C.CString(operation)
+	defer C.free(unsafe.Pointer(cOperation))
+
+	var image *C.VipsImage
+
+	err := C.vips_apply_bridge(img.Image, &image, cOperation, &names[0], &values[0], C.int(n))
+	if err != 0 {
+		return catchVipsError("apply")
+	}
+
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = image
+
+	return nil
+}
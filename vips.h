@@ -26,6 +26,10 @@
 #define EXIF_IFD0_SOFTWARE "exif-ifd0-Software"
 #define EXIF_IFD0_DATETIME "exif-ifd0-DateTime"
 
+#ifndef VIPS_META_ORIENTATION
+#define VIPS_META_ORIENTATION "orientation"
+#endif
+
 #define INT_TO_GBOOLEAN(bool) (bool > 0 ? TRUE : FALSE)
 
 
@@ -41,6 +45,13 @@ enum types {
 	MAGICK
 };
 
+// Mirrors VipsForeignSubsample, which only exists from libvips 8.10
+enum subsample {
+	SUBSAMPLE_AUTO = 0,
+	SUBSAMPLE_ON,
+	SUBSAMPLE_OFF
+};
+
 typedef struct {
 	const char *Text;
 	const char *Font;
@@ -57,6 +68,7 @@ typedef struct {
 	double VOffset;
 	int    HAlign;
 	int    VAlign;
+	double Rotate;
 } WatermarkOptions;
 
 typedef struct {
@@ -64,6 +76,7 @@ typedef struct {
 	int    Top;
 	float    Opacity;
 	int     Blend;
+	int     Tile;
 } WatermarkImageOptions;
 
 static unsigned long
@@ -116,8 +129,37 @@ vips_affine_interpolator(VipsImage *in, VipsImage **out, double a, double b, dou
 	return vips_affine(in, out, a, b, c, d, "interpolate", interpolator, NULL);
 }
 
-int vips_resize_bridge (VipsImage *in, VipsImage **out, double scale, VipsInterpolate *interpolator) {
-  return vips_resize(in, out, scale, "interpolate", interpolator, NULL);
+int vips_resize_bridge (VipsImage *in, VipsImage **out, double scale, double vscale, VipsInterpolate *interpolator, int kernel) {
+  // A separate vertical scale keeps the frames of a multi-page image the same height
+  if (vscale <= 0) {
+    vscale = scale;
+  }
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 3))
+  // Since 8.3 the interpolator is ignored and the kernel does the work, -1 keeps the libvips default
+  if (kernel >= 0) {
+    return vips_resize(in, out, scale, "vscale", vscale, "kernel", kernel, NULL);
+  }
+#endif
+  if (interpolator == NULL) {
+    return vips_resize(in, out, scale, "vscale", vscale, NULL);
+  }
+  return vips_resize(in, out, scale, "vscale", vscale, "interpolate", interpolator, NULL);
+}
+
+/**
+ * Reads only the header, sequential access means no pixels are decoded before the image is unreferenced.
+ */
+int
+vips_decode_config_bridge(void *buf, size_t len, int *width, int *height) {
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	if (image == NULL) {
+		return 1;
+	}
+
+	*width = image->Xsize;
+	*height = image->Ysize;
+	g_object_unref(image);
+	return 0;
 }
 
 int
@@ -130,6 +172,72 @@ vips_webpload_buffer_shrink(void *buf, size_t len, VipsImage **out, int shrink)
 	return vips_webpload_buffer(buf, len, out, "shrink", shrink, NULL);
 }
 
+/**
+ * Renders an SVG or PDF at scale times its native size, which is far sharper than resizing the default rendering.
+ */
+int
+vips_vectorload_buffer_scale(void *buf, size_t len, VipsImage **out, int imageType, double scale) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+	if (imageType == SVG) {
+		return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "scale", scale, NULL);
+	} else if (imageType == PDF) {
+		return vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "scale", scale, NULL);
+	}
+#endif
+	vips_error("vimg", "scaled vector loading needs an SVG or PDF and libvips 8.7 or later");
+	return 1;
+}
+
+/**
+ * Renders n pages of a PDF from page, counting from 0, at dpi and then scale times that, -1 pages for the rest of the
+ * document. libvips' default of 72 DPI is used when dpi is 0.
+ */
+int
+vips_pdfload_bridge(void *buf, size_t len, VipsImage **out, int page, int n, double dpi, double scale) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+	if (dpi <= 0) {
+		dpi = 72;
+	}
+	return vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "page", page, "n", n, "dpi", dpi, "scale", scale, NULL);
+#else
+	vips_error("vimg", "choosing the PDF page and DPI needs libvips 8.7 or later");
+	return 1;
+#endif
+}
+
+/**
+ * Renders an SVG at dpi and then scale times that. libvips' default of 72 DPI is used when dpi is 0.
+ */
+int
+vips_svgload_bridge(void *buf, size_t len, VipsImage **out, double dpi, double scale) {
+	if (dpi <= 0) {
+		dpi = 72;
+	}
+	return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "dpi", dpi, "scale", scale, NULL);
+}
+
+/**
+ * Transposes an image, or transposes and mirrors it, with an affine matrix of 0s and 1s. Nearest neighbour sampling
+ * at whole pixels copies them exactly, odx and ody move the result back onto width x height from 0, 0.
+ */
+int
+vips_transpose_bridge(VipsImage *in, VipsImage **out, int a, int b, int c, int d, int odx, int ody, int width, int height) {
+	int area[4] = {0, 0, width, height};
+	VipsArrayInt *oarea = vips_array_int_new(area, 4);
+	VipsInterpolate *nearest = vips_interpolate_new("nearest");
+
+	int code = vips_affine(in, out, (double) a, (double) b, (double) c, (double) d,
+		"interpolate", nearest,
+		"oarea", oarea,
+		"odx", (double) odx,
+		"ody", (double) ody,
+		NULL
+	);
+	g_object_unref(nearest);
+	vips_area_unref(VIPS_AREA(oarea));
+	return code;
+}
+
 int
 vips_flip_bridge(VipsImage *in, VipsImage **out, int direction) {
 	return vips_flip(in, out, direction, NULL);
@@ -145,6 +253,40 @@ vips_reduce_bridge(VipsImage *in, VipsImage **out, double xshrink, double yshrin
 	return vips_reduce(in, out, xshrink, yshrink, NULL);
 }
 
+/**
+ * The largest alpha value, 16-bit images go up to 65535.
+ */
+static double
+vips_max_alpha(VipsImage *in) {
+	if (in->Type == VIPS_INTERPRETATION_RGB16 || in->Type == VIPS_INTERPRETATION_GREY16) {
+		return 65535;
+	}
+	return 255;
+}
+
+int
+vips_premultiply_bridge(VipsImage *in, VipsImage **out) {
+	return vips_premultiply(in, out, "max_alpha", vips_max_alpha(in), NULL);
+}
+
+/**
+ * Unpremultiplies and casts back to format, vips_premultiply leaves a float image.
+ */
+int
+vips_unpremultiply_bridge(VipsImage *in, VipsImage **out, VipsBandFormat format) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+
+	if (vips_unpremultiply(in, &t[0], "max_alpha", vips_max_alpha(in), NULL) ||
+		vips_cast(t[0], out, format, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
 int
 vips_type_find_bridge(int t) {
 	if (t == GIF) {
@@ -222,7 +364,9 @@ vips_rotate_fill(VipsImage *in, VipsImage **out, double angle, double r, double
         VipsImage *base = vips_image_new();
         VipsImage **t;
         t = (VipsImage **) vips_object_local_array (VIPS_OBJECT(base), 2);
+        // The local array unrefs what it holds, so it takes its own references to in
         t[0] = in;
+        g_object_ref(in);
     	VipsArrayDouble *vipsBackground = vips_array_double_new(background, 4);
         if (!vips_image_hasalpha(in)) {
             if (vips_bandjoin_const1(t[0], &t[1], 255, NULL)) {
@@ -232,6 +376,7 @@ vips_rotate_fill(VipsImage *in, VipsImage **out, double angle, double r, double
             }
         } else {
             t[1] = t[0];
+            g_object_ref(in);
         }
 
 	    if (vips_similarity(t[1], out, "angle", angle, "background", vipsBackground, NULL)) {
@@ -245,6 +390,50 @@ vips_rotate_fill(VipsImage *in, VipsImage **out, double angle, double r, double
 	}
 }
 
+/**
+ * Rotates by any angle, growing the canvas to fit and filling the corners with the background. Right angles are
+ * done exactly with vips_rot rather than interpolated.
+ */
+int
+vips_rotate_float_bridge(VipsImage *in, VipsImage **out, double angle, double r, double g, double b, double a) {
+	double background[4] = {r, g, b, a};
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+	VipsImage *rotate = in;
+	VipsArrayDouble *vipsBackground;
+	int code;
+
+	angle = fmod(angle, 360);
+	if (angle < 0) {
+		angle += 360;
+	}
+
+	if (angle == 0) {
+		code = vips_copy(in, out, NULL);
+	} else if (angle == 90) {
+		code = vips_rot(in, out, VIPS_ANGLE_D90, NULL);
+	} else if (angle == 180) {
+		code = vips_rot(in, out, VIPS_ANGLE_D180, NULL);
+	} else if (angle == 270) {
+		code = vips_rot(in, out, VIPS_ANGLE_D270, NULL);
+	} else {
+		// The corners are filled with an alpha background, so the image needs an alpha band
+		if (!vips_image_hasalpha(in)) {
+			if (vips_bandjoin_const1(in, &t[0], 255, NULL)) {
+				g_object_unref(base);
+				return 1;
+			}
+			rotate = t[0];
+		}
+		vipsBackground = vips_array_double_new(background, 4);
+		code = vips_similarity(rotate, out, "angle", angle, "background", vipsBackground, NULL);
+		vips_area_unref(VIPS_AREA(vipsBackground));
+	}
+
+	g_object_unref(base);
+	return code;
+}
+
 int
 vips_rotate_vimg(VipsImage *in, VipsImage **out, double angle) {
     return vips_rotate_fill(in, out, angle, 0, 0, 0, 255);
@@ -262,6 +451,65 @@ vips_exif_tag(VipsImage *image, const char *tag) {
 	return "";
 }
 
+int
+vips_image_get_string_bridge(VipsImage *in, const char *name, const char **out) {
+	if (vips_image_get_typeof(in, name) == 0 || vips_image_get_string(in, name, out)) {
+		vips_error_clear();
+		return 1;
+	}
+	return 0;
+}
+
+int
+vips_image_get_int_bridge(VipsImage *in, const char *name, int *out) {
+	if (vips_image_get_typeof(in, name) == 0 || vips_image_get_int(in, name, out)) {
+		vips_error_clear();
+		return 1;
+	}
+	return 0;
+}
+
+int
+vips_image_set_string_bridge(VipsImage *in, VipsImage **out, const char *name, const char *value) {
+	// Copy first, setting metadata on an image libvips may have cached affects every user of it
+	if (vips_copy(in, out, NULL)) {
+		return 1;
+	}
+	vips_image_set_string(*out, name, value);
+	return 0;
+}
+
+/**
+ * Sets the resolution, in pixels per millimetre like the header, and marks it as inches for the savers.
+ */
+int
+vips_resolution_bridge(VipsImage *in, VipsImage **out, double xres, double yres) {
+	if (vips_copy(in, out, "xres", xres, "yres", yres, NULL)) {
+		return 1;
+	}
+	vips_image_set_string(*out, "resolution-unit", "in");
+	return 0;
+}
+
+int
+vips_sample_size_bridge(VipsImage *in) {
+	return vips_format_sizeof(in->BandFmt);
+}
+
+int
+vips_copy_bridge(VipsImage *in, VipsImage **out) {
+	return vips_copy(in, out, NULL);
+}
+
+int
+vips_image_set_int_bridge(VipsImage *in, VipsImage **out, const char *name, int value) {
+	if (vips_copy(in, out, NULL)) {
+		return 1;
+	}
+	vips_image_set_int(*out, name, value);
+	return 0;
+}
+
 int
 vips_exif_tag_to_int(VipsImage *image, const char *tag) {
 	int value = 0;
@@ -285,10 +533,32 @@ vips_exif_orientation(VipsImage *image) {
 	return orientation;
 }
 
+int
+vips_reset_orientation_bridge(VipsImage *in, VipsImage **out) {
+	// Copy first, setting metadata on an image libvips may have cached affects every user of it
+	if (vips_copy(in, out, NULL)) {
+		return 1;
+	}
+
+	vips_image_set_int(*out, VIPS_META_ORIENTATION, 1);
+	if (vips_image_get_typeof(*out, EXIF_IFD0_ORIENTATION) != 0) {
+		vips_image_set_string(*out, EXIF_IFD0_ORIENTATION, "1 (Top-left, Short, 1 components, 2 bytes)");
+	}
+	return 0;
+}
+
 
 
 int
 interpolator_window_size(char const *name) {
+	// Lanczos is only a resize kernel, its window is twice the number of lobes
+	if (!strcmp(name, "lanczos2")) {
+		return 4;
+	}
+	if (!strcmp(name, "lanczos3")) {
+		return 6;
+	}
+
 	VipsInterpolate *interpolator = vips_interpolate_new(name);
 	int window_size = vips_interpolate_get_window_size(interpolator);
 	g_object_unref(interpolator);
@@ -320,6 +590,11 @@ vips_extract_area_bridge(VipsImage *in, VipsImage **out, int left, int top, int
 	return vips_extract_area(in, out, left, top, width, height, NULL);
 }
 
+int
+vips_extract_band_bridge(VipsImage *in, VipsImage **out, int band, int n) {
+	return vips_extract_band(in, out, band, "n", n, NULL);
+}
+
 int
 vips_colourspace_issupported_bridge(VipsImage *in) {
 	return vips_colourspace_issupported(in) ? 1 : 0;
@@ -341,6 +616,12 @@ vips_icc_transform_bridge (VipsImage *in, VipsImage **out, const char *output_ic
 	return vips_icc_transform(in, out, output_icc_profile, "embedded", TRUE, NULL);
 }
 
+int
+vips_icc_import_bridge (VipsImage *in, VipsImage **out) {
+	// Into the profile connection space with the embedded profile, the caller converts on to the target
+	return vips_icc_import(in, out, "embedded", TRUE, NULL);
+}
+
 int
 vips_image_get_blob_bridge (VipsImage *in, const void **data, size_t *length, const char *name ) {
   if (vips_image_get_typeof(in, name) == VIPS_TYPE_BLOB) {
@@ -351,18 +632,80 @@ vips_image_get_blob_bridge (VipsImage *in, const void **data, size_t *length, co
 }
 
 int
-vips_jpegsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int quality, int interlace) {
+vips_image_set_blob_bridge(VipsImage *in, VipsImage **out, const char *name, const void *data, size_t length) {
+	// Copy first, setting metadata on an image libvips may have cached affects every user of it
+	if (vips_copy(in, out, NULL)) {
+		return 1;
+	}
+
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+	vips_image_set_blob_copy(*out, name, data, length);
+#else
+	void *copy = g_malloc(length);
+	memcpy(copy, data, length);
+	vips_image_set_blob(*out, name, (VipsCallbackFn) g_free, copy, length);
+#endif
+	return 0;
+}
+
+/**
+ * Saves with whichever saver libvips picks for a filename style suffix, with any options in brackets, e.g.
+ * ".jpg[Q=80,strip]".
+ */
+int
+vips_save_suffix_bridge(VipsImage *in, const char *suffix, void **buf, size_t *len) {
+	return vips_image_write_to_buffer(in, suffix, buf, len, NULL);
+}
+
+/**
+ * Saves to a file with the saver libvips picks for its extension, with any options in brackets after it.
+ */
+int
+vips_save_file_bridge(VipsImage *in, const char *filename) {
+	return vips_image_write_to_file(in, filename, NULL);
+}
+
+int
+vips_jpegsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int quality, int interlace, int subsample) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 10))
+	return vips_jpegsave_buffer(in, buf, len,
+		"strip", INT_TO_GBOOLEAN(strip),
+		"Q", quality,
+		"optimize_coding", TRUE,
+		"interlace", INT_TO_GBOOLEAN(interlace),
+		"subsample_mode", subsample,
+		NULL
+	);
+#else
+	// Before 8.10 chroma is always subsampled unless no_subsample is set
 	return vips_jpegsave_buffer(in, buf, len,
 		"strip", INT_TO_GBOOLEAN(strip),
 		"Q", quality,
 		"optimize_coding", TRUE,
 		"interlace", INT_TO_GBOOLEAN(interlace),
+		"no_subsample", subsample == SUBSAMPLE_OFF ? TRUE : FALSE,
 		NULL
 	);
+#endif
 }
 
 int
-vips_pngsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int compression, int quality, int interlace) {
+vips_pngsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int compression, int quality, int interlace, int palette, int colours, double dither) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+	if (palette) {
+		return vips_pngsave_buffer(in, buf, len,
+			"strip", INT_TO_GBOOLEAN(strip),
+			"compression", compression,
+			"interlace", INT_TO_GBOOLEAN(interlace),
+			"filter", VIPS_FOREIGN_PNG_FILTER_NONE,
+			"palette", TRUE,
+			"Q", quality,
+			"colours", colours,
+			"dither", dither,
+			NULL
+		);
+	}
+#endif
 #if (VIPS_MAJOR_VERSION >= 8 || (VIPS_MAJOR_VERSION >= 7 && VIPS_MINOR_VERSION >= 42))
 	return vips_pngsave_buffer(in, buf, len,
 		"strip", INT_TO_GBOOLEAN(strip),
@@ -382,19 +725,39 @@ vips_pngsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int compr
 }
 
 int
-vips_webpsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int quality, int lossless) {
+vips_webpsave_bridge(VipsImage *in, void **buf, size_t *len, int strip, int quality, int lossless, int near_lossless, int effort, int smart_subsample) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+	return vips_webpsave_buffer(in, buf, len,
+		"strip", INT_TO_GBOOLEAN(strip),
+		"Q", quality,
+		"lossless", INT_TO_GBOOLEAN(lossless),
+		"near_lossless", INT_TO_GBOOLEAN(near_lossless),
+		"reduction_effort", effort,
+		"smart_subsample", INT_TO_GBOOLEAN(smart_subsample),
+		NULL
+	);
+#else
 	return vips_webpsave_buffer(in, buf, len,
 		"strip", INT_TO_GBOOLEAN(strip),
 		"Q", quality,
 		"lossless", INT_TO_GBOOLEAN(lossless),
 		NULL
 	);
+#endif
 }
 
 int
-vips_tiffsave_bridge(VipsImage *in, void **buf, size_t *len) {
+vips_tiffsave_bridge(VipsImage *in, void **buf, size_t *len, int compression, int quality, int tile, int tile_width, int tile_height, int pyramid) {
 #if (VIPS_MAJOR_VERSION >= 8 && VIPS_MINOR_VERSION >= 5)
-	return vips_tiffsave_buffer(in, buf, len, NULL);
+	return vips_tiffsave_buffer(in, buf, len,
+		"compression", compression,
+		"Q", quality,
+		"tile", INT_TO_GBOOLEAN(tile),
+		"tile_width", tile_width,
+		"tile_height", tile_height,
+		"pyramid", INT_TO_GBOOLEAN(pyramid),
+		NULL
+	);
 #else
 	return 0;
 #endif
@@ -415,17 +778,24 @@ vips_flatten_background_brigde(VipsImage *in, VipsImage **out, double r, double
 	}
 
 	double background[4] = {r, g, b, a};
-	VipsArrayDouble *vipsBackground = vips_array_double_new(background, 3);
+	// Greyscale images take a single grey
+	VipsArrayDouble *vipsBackground = vips_array_double_new(background, in->Bands == 2 ? 1 : 3);
 
-	return vips_flatten(in, out,
+	int code = vips_flatten(in, out,
 		"background", vipsBackground,
 		"max_alpha", vips_is_16bit(in->Type) ? 65535.0 : 255.0,
 		NULL
 	);
+	vips_area_unref(VIPS_AREA(vipsBackground));
+	return code;
 }
 
+/**
+ * Loads an image, n is the number of pages or frames to load from multi-page formats, -1 for all of them. They're
+ * stacked vertically, with the page-height metadata giving the height of each.
+ */
 int
-vips_init_image (void *buf, size_t len, int imageType, VipsImage **out) {
+vips_init_image (void *buf, size_t len, int imageType, VipsImage **out, int n) {
 	int code = 1;
 
 	if (imageType == JPEG) {
@@ -433,15 +803,31 @@ vips_init_image (void *buf, size_t len, int imageType, VipsImage **out) {
 	} else if (imageType == PNG) {
 		code = vips_pngload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
 	} else if (imageType == WEBP) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+		code = vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "n", n, NULL);
+#else
 		code = vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
+#endif
 	} else if (imageType == TIFF) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 5))
+		code = vips_tiffload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "n", n, NULL);
+#else
 		code = vips_tiffload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
+#endif
 #if (VIPS_MAJOR_VERSION >= 8)
 #if (VIPS_MINOR_VERSION >= 3)
 	} else if (imageType == GIF) {
+#if (VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 5)
+		code = vips_gifload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "n", n, NULL);
+#else
 		code = vips_gifload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
+#endif
 	} else if (imageType == PDF) {
+#if (VIPS_MAJOR_VERSION > 8 || VIPS_MINOR_VERSION >= 5)
+		code = vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, "n", n, NULL);
+#else
 		code = vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
+#endif
 	} else if (imageType == SVG) {
 		code = vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_RANDOM, NULL);
 #endif
@@ -628,6 +1014,7 @@ vips_watermark(VipsImage *in, VipsImage **out, WatermarkTextOptions *to, Waterma
     double left, top;
     double hOffset, vOffset;
     double opacity;
+    VipsImage *mask;
 
 	opacity = (o->Background[3] / 255)*255;
 //printf("Opacity: %f\n", o->Background[3]);
@@ -646,6 +1033,20 @@ vips_watermark(VipsImage *in, VipsImage **out, WatermarkTextOptions *to, Waterma
 		g_object_unref(base);
 		return 1;
 	}
+	mask = t[3];
+
+	// Turn the mask before placing it, the corners are filled with 0 so stay clear of text
+	if (fmod(o->Rotate, 360) != 0) {
+		double zero[1] = {0};
+		VipsArrayDouble *maskBackground = vips_array_double_new(zero, 1);
+		int code = vips_similarity(t[3], &t[12], "angle", o->Rotate, "background", maskBackground, NULL);
+		vips_area_unref(VIPS_AREA(maskBackground));
+		if (code) {
+			g_object_unref(base);
+			return 1;
+		}
+		mask = t[12];
+	}
 
 //	printf("SRC Bands: %d\n", t[0]->Bands);
 
@@ -660,8 +1061,8 @@ vips_watermark(VipsImage *in, VipsImage **out, WatermarkTextOptions *to, Waterma
 //    printf("SRC Bands: %d\n", t[0]->Bands);
 //	printf("Text Bands: %d\n", t[3]->Bands);
 
-	int wmX = t[3]->Xsize;
-	int wmY = t[3]->Ysize;
+	int wmX = mask->Xsize;
+	int wmY = mask->Ysize;
 
 	if (o->Relative) {
 		switch (o->HAlign) {
@@ -710,7 +1111,7 @@ vips_watermark(VipsImage *in, VipsImage **out, WatermarkTextOptions *to, Waterma
 	}
 
     // Now we have our positionings, we can create the text overlay image.
-	if (vips_embed(t[3], &t[4], left, top, t[3]->Xsize + left, t[3]->Ysize + top, NULL) ) {
+	if (vips_embed(mask, &t[4], left, top, mask->Xsize + left, mask->Ysize + top, NULL) ) {
 	    g_object_unref(base);
         return 1;
 	}
@@ -796,6 +1197,11 @@ vips_watermark(VipsImage *in, VipsImage **out, WatermarkTextOptions *to, Waterma
 	return 0;
 }
 
+int
+vips_median_bridge(VipsImage *in, VipsImage **out, int size) {
+	return vips_median(in, out, size, NULL);
+}
+
 int
 vips_gaussblur_bridge(VipsImage *in, VipsImage **out, double sigma, double min_ampl) {
 #if (VIPS_MAJOR_VERSION == 7 && VIPS_MINOR_VERSION < 41)
@@ -931,6 +1337,27 @@ vips_watermark_image(VipsImage *in, VipsImage *sub, VipsImage **out, WatermarkIm
             return 1;
         }
     }
+
+    // Tiles edge to edge over the whole image, one of them where the single watermark would go
+    if (o->Tile) {
+        int width = t[2]->Xsize;
+        int height = t[2]->Ysize;
+        int dx = (o->Left % width + width) % width;
+        int dy = (o->Top % height + height) % height;
+
+        if (
+            vips_replicate(t[2], &t[3], 2 + in->Xsize / width, 2 + in->Ysize / height, NULL) ||
+            vips_crop(t[3], &t[4], width - dx, height - dy, in->Xsize, in->Ysize, NULL) ||
+            vips_composite2(t[0], t[4], out, o->Blend, "x", 0, "y", 0, "premultiplied", FALSE, NULL)
+        ) {
+            g_object_unref(base);
+            return 1;
+        }
+
+        g_object_unref(base);
+        return 0;
+    }
+
     if (vips_composite2(t[0], t[2], out, o->Blend, "x", o->Left, "y", o->Top, "premultiplied", FALSE, NULL )) {
         g_object_unref(base);
         return 1;
@@ -940,32 +1367,781 @@ vips_watermark_image(VipsImage *in, VipsImage *sub, VipsImage **out, WatermarkIm
 	return 0;
 }
 
+/**
+ * Composites overlay onto in at x, y. libvips converts both to a common colour space and premultiplies the alpha,
+ * an overlay without alpha is opaque. The result only keeps an alpha channel if in had one.
+ */
 int
-vips_smartcrop_bridge(VipsImage *in, VipsImage **out, int width, int height) {
-#if (VIPS_MAJOR_VERSION >= 8 && VIPS_MINOR_VERSION >= 5)
-	return vips_smartcrop(in, out, width, height, NULL);
-#else
+vips_composite_bridge(VipsImage *in, VipsImage *overlay, VipsImage **out, int mode, int x, int y) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+
+	if (vips_composite2(in, overlay, &t[0], mode, "x", x, "y", y, "premultiplied", FALSE, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	if (vips_image_hasalpha(in)) {
+		*out = t[0];
+		g_object_ref(*out);
+	} else if (vips_extract_band(t[0], out, 0, "n", t[0]->Bands - 1, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
 	return 0;
-#endif
 }
 
-int vips_find_trim_bridge(VipsImage *in, int *top, int *left, int *width, int *height, double r, double g, double b, double threshold) {
-#if (VIPS_MAJOR_VERSION >= 8 && VIPS_MINOR_VERSION >= 6)
-	if (vips_is_16bit(in->Type)) {
-		r = 65535 * r / 255;
-		g = 65535 * g / 255;
-		b = 65535 * b / 255;
+/**
+ * Composites n images in one pass, in[0] is the base and each of the others is blended onto the result so far with
+ * mode[i - 1] at x[i - 1], y[i - 1]. vips_composite brings them all to a common colour space and adds alpha where
+ * it's missing.
+ */
+int
+vips_composite_multi_bridge(VipsImage **in, int n, VipsImage **out, int *mode, int *x, int *y) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+	VipsArrayInt *xs = vips_array_int_new(x, n - 1);
+	VipsArrayInt *ys = vips_array_int_new(y, n - 1);
+
+	int code = vips_composite(in, &t[0], n, mode, "x", xs, "y", ys, "premultiplied", FALSE, NULL);
+	vips_area_unref(VIPS_AREA(xs));
+	vips_area_unref(VIPS_AREA(ys));
+	if (code) {
+		g_object_unref(base);
+		return 1;
 	}
 
-	double background[3] = {r, g, b};
-	VipsArrayDouble *vipsBackground = vips_array_double_new(background, 3);
-	return vips_find_trim(in, top, left, width, height, "background", vipsBackground, "threshold", threshold, NULL);
-#else
+	if (vips_image_hasalpha(in[0])) {
+		*out = t[0];
+		g_object_ref(*out);
+	} else if (vips_extract_band(t[0], out, 0, "n", t[0]->Bands - 1, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
 	return 0;
-#endif
 }
 
-int vips_gamma_bridge(VipsImage *in, VipsImage **out, double exponent)
-{
-  return vips_gamma(in, out, "exponent", 1.0 / exponent, NULL);
-}
\ No newline at end of file
+/**
+ * Renders text centred on a rounded rectangle, padding pixels in from its edges, as an sRGB image with alpha. colour
+ * and background are r, g, b and alpha, all 0 to 255.
+ */
+int
+vips_badge_bridge(VipsImage **out, const char *text, const char *font, int dpi, int padding, int radius, double *colour, double *background) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 17);
+	double ink[1] = { 255 };
+	double zeroes[3] = { 0, 0, 0 };
+
+	if (vips_text(&t[0], text, "font", font, "dpi", dpi, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	int width = t[0]->Xsize + 2 * padding;
+	int height = t[0]->Ysize + 2 * padding;
+	radius = VIPS_MIN(radius, VIPS_MIN(width, height) / 2);
+
+	// The shape's mask, two overlapping rectangles with a circle filling each corner
+	if (
+		vips_black(&t[1], width, height, NULL) ||
+		vips_cast(t[1], &t[2], VIPS_FORMAT_UCHAR, NULL) ||
+		!(t[3] = vips_image_copy_memory(t[2])) ||
+		vips_draw_rect(t[3], ink, 1, radius, 0, width - 2 * radius, height, "fill", TRUE, NULL) ||
+		vips_draw_rect(t[3], ink, 1, 0, radius, width, height - 2 * radius, "fill", TRUE, NULL) ||
+		vips_draw_circle(t[3], ink, 1, radius, radius, radius, "fill", TRUE, NULL) ||
+		vips_draw_circle(t[3], ink, 1, width - 1 - radius, radius, radius, "fill", TRUE, NULL) ||
+		vips_draw_circle(t[3], ink, 1, radius, height - 1 - radius, radius, "fill", TRUE, NULL) ||
+		vips_draw_circle(t[3], ink, 1, width - 1 - radius, height - 1 - radius, radius, "fill", TRUE, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Paint the shape and the text with their colours, each mask scaled by its alpha becomes the alpha channel
+	if (
+		vips_black(&t[4], width, height, "bands", 3, NULL) ||
+		vips_linear(t[4], &t[5], zeroes, background, 3, NULL) ||
+		vips_linear1(t[3], &t[6], background[3] / 255, 0, NULL) ||
+		vips_bandjoin2(t[5], t[6], &t[7], NULL) ||
+		vips_cast(t[7], &t[8], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_copy(t[8], &t[9], "interpretation", VIPS_INTERPRETATION_sRGB, NULL) ||
+		vips_embed(t[0], &t[10], padding, padding, width, height, NULL) ||
+		vips_linear(t[4], &t[11], zeroes, colour, 3, NULL) ||
+		vips_linear1(t[10], &t[12], colour[3] / 255, 0, NULL) ||
+		vips_bandjoin2(t[11], t[12], &t[13], NULL) ||
+		vips_cast(t[13], &t[14], VIPS_FORMAT_UCHAR, NULL) ||
+		vips_copy(t[14], &t[15], "interpretation", VIPS_INTERPRETATION_sRGB, NULL) ||
+		vips_composite2(t[9], t[15], &t[16], VIPS_BLEND_MODE_OVER, "premultiplied", FALSE, NULL) ||
+		vips_cast(t[16], out, VIPS_FORMAT_UCHAR, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * Replaces any alpha channel of in with the first band of mask, stretched to the size of in and scaled to its alpha
+ * range, so an 8-bit mask is fully opaque on a 16-bit image.
+ */
+int
+vips_alpha_mask_bridge(VipsImage *in, VipsImage *mask, VipsImage **out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+	VipsImage *colour = in;
+	VipsImage *alpha;
+	double scale = vips_max_alpha(in) / vips_max_alpha(mask);
+
+	if (vips_image_hasalpha(in)) {
+		if (vips_extract_band(in, &t[0], 0, "n", in->Bands - 1, NULL)) {
+			g_object_unref(base);
+			return 1;
+		}
+		colour = t[0];
+	}
+
+	if (
+		vips_extract_band(mask, &t[1], 0, NULL) ||
+		vips_resize(t[1], &t[2], (double) in->Xsize / mask->Xsize, "vscale", (double) in->Ysize / mask->Ysize, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+	alpha = t[2];
+
+	if (scale != 1) {
+		if (vips_linear1(t[2], &t[3], scale, 0, NULL)) {
+			g_object_unref(base);
+			return 1;
+		}
+		alpha = t[3];
+	}
+
+	if (
+		vips_cast(alpha, &t[4], colour->BandFmt, NULL) ||
+		vips_bandjoin2(colour, t[4], out, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * Cuts the page height rows high at top out of in, turns it upright by a clockwise right angle and an optional left to
+ * right mirror, then shrinks it to thumb_width.
+ */
+static int
+vips_upright_thumbnail(VipsImage *in, VipsImage **out, int top, int height, int angle, int flop, int thumb_width) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+	VipsAngle rotate = VIPS_ANGLE_D0;
+	VipsImage *frame;
+	int code;
+
+	angle = angle % 360;
+	if (angle == 90) {
+		rotate = VIPS_ANGLE_D90;
+	} else if (angle == 180) {
+		rotate = VIPS_ANGLE_D180;
+	} else if (angle == 270) {
+		rotate = VIPS_ANGLE_D270;
+	}
+
+	if (
+		vips_extract_area(in, &t[0], 0, top, in->Xsize, height, NULL) ||
+		vips_rot(t[0], &t[1], rotate, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+	frame = t[1];
+
+	if (flop) {
+		if (vips_flip(frame, &t[2], VIPS_DIRECTION_HORIZONTAL, NULL)) {
+			g_object_unref(base);
+			return 1;
+		}
+		frame = t[2];
+	}
+
+	code = vips_resize(frame, out, (double) thumb_width / frame->Xsize, NULL);
+	g_object_unref(base);
+	return code;
+}
+
+/**
+ * Joins n thumbnails into a grid cols across, spaced by padding pixels of the background colour.
+ */
+static int
+vips_thumbnail_grid(VipsImage **thumbs, int n, VipsImage **out, int cols, int padding, double r, double g, double b, double a) {
+	double background[4] = {r, g, b, a};
+	int bands = thumbs[0]->Bands < 4 ? thumbs[0]->Bands : 4;
+	VipsArrayDouble *vipsBackground;
+	int code;
+
+	// Greyscale images take the red value and any alpha
+	if (thumbs[0]->Bands < 3) {
+		background[1] = a;
+	}
+
+	vipsBackground = vips_array_double_new(background, bands);
+	code = vips_arrayjoin(thumbs, out, n, "across", cols, "shim", padding, "background", vipsBackground, NULL);
+	vips_area_unref(VIPS_AREA(vipsBackground));
+	return code;
+}
+
+/**
+ * Lays the pages of a multi-page image out in a grid, cols across, each turned upright by angle and flop, shrunk to
+ * thumb_width and spaced by padding pixels of the background colour.
+ */
+int
+vips_contact_sheet_bridge(VipsImage *in, VipsImage **out, int pages, int angle, int flop, int cols, int thumb_width, int padding, double r, double g, double b, double a) {
+	int page_height = in->Ysize / pages;
+	VipsImage *base = vips_image_new();
+	VipsImage **thumbs = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), pages);
+	int code;
+
+	for (int i = 0; i < pages; i++) {
+		if (vips_upright_thumbnail(in, &thumbs[i], i * page_height, page_height, angle, flop, thumb_width)) {
+			g_object_unref(base);
+			return 1;
+		}
+	}
+
+	code = vips_thumbnail_grid(thumbs, pages, out, cols, padding, r, g, b, a);
+	g_object_unref(base);
+	return code;
+}
+
+/**
+ * Lays the first page of each of n images out in a grid as vips_contact_sheet_bridge, in[i] turned upright by
+ * angle[i] and flop[i]. The grid is rendered into memory, so it doesn't hold on to the sources.
+ */
+int
+vips_montage_bridge(VipsImage **in, int n, VipsImage **out, int *page_height, int *angle, int *flop, int cols, int thumb_width, int padding, double r, double g, double b, double a) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), n + 1);
+
+	for (int i = 0; i < n; i++) {
+		if (vips_upright_thumbnail(in[i], &t[i], 0, page_height[i], angle[i], flop[i], thumb_width)) {
+			g_object_unref(base);
+			return 1;
+		}
+	}
+
+	if (
+		vips_thumbnail_grid(t, n, &t[n], cols, padding, r, g, b, a) ||
+		!(*out = vips_image_copy_memory(t[n]))
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * Smart crops to width x height. strategy 1 picks the most entropy, anything else attention, libvips' default.
+ */
+int
+vips_smartcrop_bridge(VipsImage *in, VipsImage **out, int width, int height, int strategy) {
+#if (VIPS_MAJOR_VERSION >= 8 && VIPS_MINOR_VERSION >= 5)
+	VipsInteresting interesting = strategy == 1 ? VIPS_INTERESTING_ENTROPY : VIPS_INTERESTING_ATTENTION;
+	return vips_smartcrop(in, out, width, height, "interesting", interesting, NULL);
+#else
+	return 0;
+#endif
+}
+
+/**
+ * Smart crops as vips_smartcrop_bridge and sets left and top to where the crop was taken from. The crop is centred on
+ * the point libvips picked, kept inside the image.
+ */
+int
+vips_smartcrop_rect_bridge(VipsImage *in, VipsImage **out, int width, int height, int strategy, int *left, int *top) {
+#if (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+	VipsInteresting interesting = strategy == 1 ? VIPS_INTERESTING_ENTROPY : VIPS_INTERESTING_ATTENTION;
+	int x, y;
+
+	if (vips_smartcrop(in, out, width, height,
+		"interesting", interesting,
+		"attention_x", &x,
+		"attention_y", &y,
+		NULL)) {
+		return 1;
+	}
+
+	*left = VIPS_CLIP(0, x - (*out)->Xsize / 2, in->Xsize - (*out)->Xsize);
+	*top = VIPS_CLIP(0, y - (*out)->Ysize / 2, in->Ysize - (*out)->Ysize);
+	return 0;
+#else
+	vips_error("vips_smartcrop_rect_bridge", "needs libvips 8.8 or later");
+	return 1;
+#endif
+}
+
+int vips_find_trim_bridge(VipsImage *in, int *top, int *left, int *width, int *height, double r, double g, double b, double threshold) {
+#if (VIPS_MAJOR_VERSION >= 8 && VIPS_MINOR_VERSION >= 6)
+	if (vips_is_16bit(in->Type)) {
+		r = 65535 * r / 255;
+		g = 65535 * g / 255;
+		b = 65535 * b / 255;
+	}
+
+	double background[3] = {r, g, b};
+	VipsArrayDouble *vipsBackground = vips_array_double_new(background, 3);
+	return vips_find_trim(in, top, left, width, height, "background", vipsBackground, "threshold", threshold, NULL);
+#else
+	return 0;
+#endif
+}
+
+int vips_corner_colour_bridge(VipsImage *in, double *r, double *g, double *b) {
+	double *point;
+	int n;
+
+	if (vips_getpoint(in, &point, &n, 0, 0, NULL)) {
+		return 1;
+	}
+
+	*r = point[0];
+	*g = n >= 3 ? point[1] : point[0];
+	*b = n >= 3 ? point[2] : point[0];
+
+	// A transparent corner reads as the black it's trimmed against
+	if (has_alpha_channel(in)) {
+		double alpha = point[n - 1] / (vips_is_16bit(in->Type) ? 65535.0 : 255.0);
+		*r *= alpha;
+		*g *= alpha;
+		*b *= alpha;
+	}
+
+	// vips_find_trim_bridge takes 8-bit values
+	if (vips_is_16bit(in->Type)) {
+		*r = 255 * *r / 65535;
+		*g = 255 * *g / 65535;
+		*b = 255 * *b / 65535;
+	}
+
+	g_free(point);
+	return 0;
+}
+
+int vips_gamma_bridge(VipsImage *in, VipsImage **out, double exponent)
+{
+  return vips_gamma(in, out, "exponent", 1.0 / exponent, NULL);
+}
+int
+vips_grayscale_bridge(VipsImage *in, VipsImage **out, int keep_alpha) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+
+	if (keep_alpha && vips_image_hasalpha(in)) {
+		g_object_unref(base);
+		return vips_colourspace(in, out, VIPS_INTERPRETATION_B_W, NULL);
+	}
+
+	// Extract the first band only, this drops any alpha channel
+	if (
+		vips_colourspace(in, &t[0], VIPS_INTERPRETATION_B_W, NULL) ||
+		vips_extract_band(t[0], out, 0, "n", 1, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+extern void vimgProgressCallback(int handle, int percent);
+
+static void
+vips_progress_eval_cb(VipsImage *image, VipsProgress *progress, void *handle) {
+	vimgProgressCallback((int) (size_t) handle, progress->percent);
+}
+
+static void
+vips_progress_posteval_cb(VipsImage *image, VipsProgress *progress, void *handle) {
+	vimgProgressCallback((int) (size_t) handle, 100);
+}
+
+void
+vips_progress_bridge(VipsImage *image, int handle, gulong *eval, gulong *posteval) {
+	vips_image_set_progress(image, TRUE);
+	*eval = g_signal_connect(image, "eval", G_CALLBACK(vips_progress_eval_cb), (void *) (size_t) handle);
+	*posteval = g_signal_connect(image, "posteval", G_CALLBACK(vips_progress_posteval_cb), (void *) (size_t) handle);
+}
+
+int
+vips_delta_e_bridge(VipsImage *a, VipsImage *b, double *out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+
+	// Only compare the colour bands, any alpha is dropped after the Lab conversion
+	if (
+		vips_colourspace(a, &t[0], VIPS_INTERPRETATION_LAB, NULL) ||
+		vips_colourspace(b, &t[1], VIPS_INTERPRETATION_LAB, NULL) ||
+		vips_extract_band(t[0], &t[2], 0, "n", 3, NULL) ||
+		vips_extract_band(t[1], &t[3], 0, "n", 3, NULL) ||
+		vips_dE00(t[2], t[3], &t[4], NULL) ||
+		vips_avg(t[4], out, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * Finds the largest standard deviation of any colour band, alpha is ignored.
+ */
+int
+vips_max_deviation_bridge(VipsImage *in, double *out) {
+	VipsImage *stats;
+	int bands = vips_image_hasalpha(in) ? in->Bands - 1 : in->Bands;
+	int b;
+
+	if (vips_stats(in, &stats, NULL)) {
+		return 1;
+	}
+
+	// Row n is band n - 1, column 5 is the standard deviation
+	*out = 0;
+	for (b = 1; b <= bands; b++) {
+		*out = VIPS_MAX(*out, *VIPS_MATRIX(stats, 5, b));
+	}
+	g_object_unref(stats);
+
+	return 0;
+}
+
+/**
+ * Film negatives scan as inverted luminance under the orange film base, so the red band never gets near black
+ * while the blue band sits well below it. This is a best-effort heuristic, not a guarantee.
+ */
+int
+vips_is_negative_bridge(VipsImage *in) {
+	VipsImage *stats;
+	double r_min, r_mean, g_mean, b_mean;
+
+	if (in->Bands < 3 || in->BandFmt != VIPS_FORMAT_UCHAR || vips_stats(in, &stats, NULL)) {
+		vips_error_clear();
+		return 0;
+	}
+
+	// Row 0 is all bands together, row n is band n - 1. Column 0 is the minimum and column 4 the mean
+	r_min = *VIPS_MATRIX(stats, 0, 1);
+	r_mean = *VIPS_MATRIX(stats, 4, 1);
+	g_mean = *VIPS_MATRIX(stats, 4, 2);
+	b_mean = *VIPS_MATRIX(stats, 4, 3);
+	g_object_unref(stats);
+
+	return (r_mean > g_mean && g_mean > b_mean && b_mean < 0.75 * r_mean && r_min > 0.15 * 255) ? 1 : 0;
+}
+
+int
+vips_invert_negative_bridge(VipsImage *in, VipsImage **out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 6);
+	double scale[3], offset[3];
+	int b;
+
+	if (
+		vips_extract_band(in, &t[0], 0, "n", 3, NULL) ||
+		vips_stats(t[0], &t[1], NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Stretching each band to the full range removes the orange mask and re-normalizes the histogram
+	for (b = 0; b < 3; b++) {
+		double min = *VIPS_MATRIX(t[1], 0, b + 1);
+		double max = *VIPS_MATRIX(t[1], 1, b + 1);
+		scale[b] = max > min ? 255.0 / (max - min) : 1.0;
+		offset[b] = -min * scale[b];
+	}
+
+	if (
+		vips_linear(t[0], &t[2], scale, offset, 3, "uchar", TRUE, NULL) ||
+		vips_invert(t[2], &t[3], NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Any alpha is kept as it was
+	if (in->Bands > 3) {
+		if (
+			vips_extract_band(in, &t[4], 3, "n", in->Bands - 3, NULL) ||
+			vips_bandjoin2(t[3], t[4], &t[5], NULL) ||
+			vips_copy(t[5], out, NULL)
+		) {
+			g_object_unref(base);
+			return 1;
+		}
+	} else if (vips_copy(t[3], out, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+int
+vips_stack_average_bridge(VipsImage **in, VipsImage **out, int n) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+	// Sum in a wider format, then divide and cast back to the input format
+	if (
+		vips_sum(in, &t[0], n, NULL) ||
+		vips_linear1(t[0], &t[1], 1.0 / n, 0, NULL) ||
+		vips_cast(t[1], out, in[0]->BandFmt, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+// The 0 to 255 float luminance of in, without any alpha
+static int
+vips_ssim_luma(VipsImage *in, VipsImage **out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+	if (
+		vips_colourspace(in, &t[0], VIPS_INTERPRETATION_B_W, NULL) ||
+		vips_extract_band(t[0], &t[1], 0, NULL) ||
+		vips_linear1(t[1], out, t[1]->BandFmt == VIPS_FORMAT_USHORT ? 1.0 / 257 : 1.0, 0, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * The mean structural similarity of the luminance of a and b, which must be the same size, using a gaussian window
+ * with a sigma of 1.5. vips_gaussblur's default min_ampl cuts the window to 5x5 rather than the 11x11 of the SSIM
+ * paper, so scores are close to, but not the same as, the reference implementation.
+ */
+int
+vips_ssim_bridge(VipsImage *a, VipsImage *b, double *out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 24);
+	double c1 = (0.01 * 255) * (0.01 * 255);
+	double c2 = (0.03 * 255) * (0.03 * 255);
+
+	if (a->Xsize != b->Xsize || a->Ysize != b->Ysize) {
+		vips_error("vips_ssim_bridge", "images differ in size");
+		g_object_unref(base);
+		return 1;
+	}
+
+	if (
+		vips_ssim_luma(a, &t[0]) ||
+		vips_ssim_luma(b, &t[1]) ||
+		// Local means, variances and covariance
+		vips_gaussblur(t[0], &t[2], 1.5, NULL) ||
+		vips_gaussblur(t[1], &t[3], 1.5, NULL) ||
+		vips_multiply(t[2], t[2], &t[4], NULL) ||
+		vips_multiply(t[3], t[3], &t[5], NULL) ||
+		vips_multiply(t[2], t[3], &t[6], NULL) ||
+		vips_multiply(t[0], t[0], &t[7], NULL) ||
+		vips_multiply(t[1], t[1], &t[8], NULL) ||
+		vips_multiply(t[0], t[1], &t[9], NULL) ||
+		vips_gaussblur(t[7], &t[10], 1.5, NULL) ||
+		vips_gaussblur(t[8], &t[11], 1.5, NULL) ||
+		vips_gaussblur(t[9], &t[12], 1.5, NULL) ||
+		vips_subtract(t[10], t[4], &t[13], NULL) ||
+		vips_subtract(t[11], t[5], &t[14], NULL) ||
+		vips_subtract(t[12], t[6], &t[15], NULL) ||
+		// (2 mu_ab + c1)(2 sigma_ab + c2) / ((mu_a^2 + mu_b^2 + c1)(sigma_a^2 + sigma_b^2 + c2))
+		vips_linear1(t[6], &t[16], 2, c1, NULL) ||
+		vips_linear1(t[15], &t[17], 2, c2, NULL) ||
+		vips_multiply(t[16], t[17], &t[18], NULL) ||
+		vips_add(t[4], t[5], &t[19], NULL) ||
+		vips_add(t[13], t[14], &t[20], NULL) ||
+		vips_linear1(t[19], &t[21], 1, c1, NULL) ||
+		vips_linear1(t[20], &t[22], 1, c2, NULL) ||
+		vips_multiply(t[21], t[22], &t[23], NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	VipsImage *ssim;
+	if (vips_divide(t[18], t[23], &ssim, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+	int code = vips_avg(ssim, out, NULL);
+	g_object_unref(ssim);
+	g_object_unref(base);
+	return code;
+}
+
+int
+vips_linear_bridge(VipsImage *in, VipsImage **out, double *a, double *b, int n) {
+	return vips_linear(in, out, a, b, n, NULL);
+}
+
+/**
+ * Brings out of gamut scRGB values back into range while keeping the hue. Negative channels are desaturated towards
+ * the luminance, then pixels with a channel over 1 are scaled down as a whole rather than clipped channel by channel.
+ * Anything other than a float image is already in gamut and just copied.
+ */
+int
+vips_clamp_gamut_bridge(VipsImage *in, VipsImage **out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 29);
+	VipsImage *bands[3];
+	int i;
+
+	if (in->Bands < 3 || (in->BandFmt != VIPS_FORMAT_FLOAT && in->BandFmt != VIPS_FORMAT_DOUBLE)) {
+		g_object_unref(base);
+		return vips_copy(in, out, NULL);
+	}
+
+	t[0] = vips_image_new_matrixv(3, 1, 0.2126, 0.7152, 0.0722);
+
+	// Luminance, clamped at 0 as (y + |y|) / 2
+	if (
+		vips_extract_band(in, &t[1], 0, "n", 3, NULL) ||
+		vips_recomb(t[1], &t[2], t[0], NULL) ||
+		vips_abs(t[2], &t[3], NULL) ||
+		vips_add(t[2], t[3], &t[4], NULL) ||
+		vips_linear1(t[4], &t[5], 0.5, 0, NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Desaturate by y / (y - min(min, 0)), which is 1 unless a channel is negative
+	for (i = 0; i < 3; i++) {
+		if (vips_extract_band(t[1], &t[6 + i], i, NULL)) {
+			g_object_unref(base);
+			return 1;
+		}
+		bands[i] = t[6 + i];
+	}
+	if (
+		vips_bandrank(bands, &t[9], 3, "index", 0, NULL) ||
+		vips_abs(t[9], &t[10], NULL) ||
+		vips_subtract(t[9], t[10], &t[11], NULL) ||
+		vips_linear1(t[11], &t[12], 0.5, 0, NULL) ||
+		vips_subtract(t[5], t[12], &t[13], NULL) ||
+		vips_divide(t[5], t[13], &t[14], NULL) ||
+		vips_subtract(t[1], t[5], &t[15], NULL) ||
+		vips_multiply(t[15], t[14], &t[16], NULL) ||
+		vips_add(t[16], t[5], &t[17], NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Scale down by max(max, 1) as (max + 1 + |max - 1|) / 2
+	for (i = 0; i < 3; i++) {
+		if (vips_extract_band(t[17], &t[18 + i], i, NULL)) {
+			g_object_unref(base);
+			return 1;
+		}
+		bands[i] = t[18 + i];
+	}
+	if (
+		vips_bandrank(bands, &t[21], 3, "index", 2, NULL) ||
+		vips_linear1(t[21], &t[22], 1, -1, NULL) ||
+		vips_abs(t[22], &t[23], NULL) ||
+		vips_add(t[21], t[23], &t[24], NULL) ||
+		vips_linear1(t[24], &t[25], 0.5, 0.5, NULL) ||
+		vips_divide(t[17], t[25], &t[26], NULL)
+	) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	// Any alpha is kept as it was
+	if (in->Bands > 3) {
+		if (
+			vips_extract_band(in, &t[27], 3, "n", in->Bands - 3, NULL) ||
+			vips_bandjoin2(t[26], t[27], &t[28], NULL) ||
+			vips_copy(t[28], out, "interpretation", in->Type, NULL)
+		) {
+			g_object_unref(base);
+			return 1;
+		}
+	} else if (vips_copy(t[26], out, "interpretation", in->Type, NULL)) {
+		g_object_unref(base);
+		return 1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+/**
+ * Runs any libvips operation taking an image "in" and giving an image "out". The other arguments are set from strings
+ * so libvips parses them to whatever type the operation declares, enums by their nickname.
+ */
+int
+vips_apply_bridge(VipsImage *in, VipsImage **out, const char *name, char **argument_names, char **argument_values, int n) {
+	VipsOperation *operation;
+	GParamSpec *pspec;
+	VipsArgumentClass *argument_class;
+	VipsArgumentInstance *argument_instance;
+	int i;
+
+	if (!(operation = vips_operation_new(name))) {
+		return 1;
+	}
+
+	if (
+		vips_object_get_argument(VIPS_OBJECT(operation), "in", &pspec, &argument_class, &argument_instance) ||
+		G_PARAM_SPEC_VALUE_TYPE(pspec) != VIPS_TYPE_IMAGE ||
+		vips_object_get_argument(VIPS_OBJECT(operation), "out", &pspec, &argument_class, &argument_instance) ||
+		G_PARAM_SPEC_VALUE_TYPE(pspec) != VIPS_TYPE_IMAGE
+	) {
+		vips_error("vimg", "%s does not take an image in and give an image out", name);
+		g_object_unref(operation);
+		return 1;
+	}
+
+	vips_object_set(VIPS_OBJECT(operation), "in", in, NULL);
+	for (i = 0; i < n; i++) {
+		if (vips_object_set_argument_from_string(VIPS_OBJECT(operation), argument_names[i], argument_values[i])) {
+			g_object_unref(operation);
+			return 1;
+		}
+	}
+
+	if (vips_cache_operation_buildp(&operation)) {
+		vips_object_unref_outputs(VIPS_OBJECT(operation));
+		g_object_unref(operation);
+		return 1;
+	}
+
+	g_object_get(operation, "out", out, NULL);
+	vips_object_unref_outputs(VIPS_OBJECT(operation));
+	g_object_unref(operation);
+	return 0;
+}
@@ -1,6 +1,12 @@
 package vimg
 
 import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"image"
+	"image/color"
+	"image/png"
 	"io/ioutil"
 	"os"
 	"path"
@@ -162,6 +168,248 @@ func TestVipsMemory(t *testing.T) {
 	}
 }
 
+func TestVipsConcurrency(t *testing.T) {
+	previous := VipsConcurrencyGet()
+	defer VipsConcurrencySet(previous)
+
+	VipsConcurrencySet(3)
+	if n := VipsConcurrencyGet(); n != 3 {
+		t.Errorf("Expected a concurrency of 3, got %d", n)
+	}
+}
+
+func TestSetDefaultInterpolator(t *testing.T) {
+	defer SetDefaultInterpolator(Bicubic)
+
+	downscale := func(o Options) []byte {
+		o.Width = 100
+		o.Type = PNG
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), o)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if o.Interpolator == Bicubic && !o.InterpolatorSet && img.Options.Interpolator != DefaultInterpolator() {
+			t.Errorf("Expected the default %s, got %s", DefaultInterpolator(), img.Options.Interpolator)
+		}
+		if (o.Interpolator != Bicubic || o.InterpolatorSet) && img.Options.Interpolator != o.Interpolator {
+			t.Errorf("Expected %s to be kept, got %s", o.Interpolator, img.Options.Interpolator)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return img.Buffer
+	}
+
+	if i := DefaultInterpolator(); i != Bicubic {
+		t.Fatalf("Expected Bicubic by default, got %s", i)
+	}
+	// Unset is the documented default and comes out the same every time
+	unset := downscale(Options{})
+	if !bytes.Equal(unset, downscale(Options{})) {
+		t.Error("Expected the same downscale every time")
+	}
+
+	SetDefaultInterpolator(Nearest)
+	if i := DefaultInterpolator(); i != Nearest {
+		t.Fatalf("Expected Nearest, got %s", i)
+	}
+	nearest := downscale(Options{})
+	if bytes.Equal(nearest, unset) {
+		t.Error("Expected the new default to change the downscale")
+	}
+	if !bytes.Equal(nearest, downscale(Options{Interpolator: Nearest})) {
+		t.Error("Expected the default to match asking for Nearest")
+	}
+	// Asking for Bicubic isn't the same as leaving it unset
+	if !bytes.Equal(unset, downscale(Options{Interpolator: Bicubic, InterpolatorSet: true})) {
+		t.Error("Expected an explicit Bicubic to ignore the default")
+	}
+
+	SetDefaultInterpolator(Interpolator(99))
+	if i := DefaultInterpolator(); i != Bicubic {
+		t.Errorf("Expected an unknown interpolator to restore Bicubic, got %s", i)
+	}
+}
+
+func TestVipsSetMaxImageSize(t *testing.T) {
+	defer VipsSetMaxImageSize(0)
+
+	// A 20000px wide strip, a region of it is wider than MaxSize
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 20000, 8))); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	img, err := NewVipsImage(&buf, Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	if _, err = img.vipsExtract(0, 0, 18000, 8); err == nil {
+		t.Fatal("Expected extracting 18000px to exceed the default limit")
+	}
+
+	VipsSetMaxImageSize(20000)
+	if n := VipsMaxImageSize(); n != 20000 {
+		t.Errorf("Expected a limit of 20000, got %d", n)
+	}
+	extracted, err := img.vipsExtract(0, 0, 18000, 8)
+	if err != nil {
+		t.Fatalf("Cannot extract the region: %s", err)
+	}
+	defer extracted.DecrementReferenceCount()
+	if size, _ := extracted.Dimensions(); size.Width != 18000 || size.Height != 8 {
+		t.Errorf("Expected an 18000x8 region, got %dx%d", size.Width, size.Height)
+	}
+
+	// The option takes precedence over the package limit
+	img.Options.MaxImageSize = 10000
+	if _, err = img.vipsExtract(0, 0, 18000, 8); err == nil {
+		t.Error("Expected Options.MaxImageSize to refuse the region")
+	}
+}
+
+func TestVipsOperationErrors(t *testing.T) {
+	loadErrors := vimgOperationErrors.With(prometheus.Labels{"type": "load"})
+	before := testutil.ToFloat64(loadErrors)
+
+	// A JPEG signature with nothing usable after it
+	malformed := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0x42}, 64)...)
+	if _, err := NewVipsImage(bytes.NewBuffer(malformed), Options{}); err == nil {
+		t.Fatal("Expected an error reading a malformed JPEG")
+	}
+
+	if after := testutil.ToFloat64(loadErrors); after != before+1 {
+		t.Errorf("Expected the load error count to go from %g to %g, got %g", before, before+1, after)
+	}
+}
+
+func TestVipsExtractKeepsType(t *testing.T) {
+	image, err := NewVipsImage(bytes.NewBuffer(readImage("transparent.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+
+	extracted, err := image.vipsExtract(10, 10, 100, 100)
+	if err != nil {
+		t.Fatalf("Cannot extract the image: %s", err)
+	}
+	defer extracted.DecrementReferenceCount()
+
+	if extracted.Type != PNG {
+		t.Errorf("Unexpected image type: %s", ImageTypeName(extracted.Type))
+	}
+	if DetermineImageType(extracted.Buffer) != PNG {
+		t.Errorf("Extracted buffer is not png")
+	}
+
+	alpha, err := extracted.vipsHasAlpha()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alpha {
+		t.Error("Extracted image lost its alpha channel")
+	}
+}
+
+func TestVipsResizeLanczos3Sharpness(t *testing.T) {
+	// A chart of hard edged black and white bars, 10 pixels wide
+	chart := image.NewGray(image.Rect(0, 0, 400, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 400; x++ {
+			if (x/10)%2 == 0 {
+				chart.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	source := &bytes.Buffer{}
+	if err := png.Encode(source, chart); err != nil {
+		t.Fatalf("Cannot encode the chart: %s", err)
+	}
+
+	// Sum of the horizontal gradient along the middle row, larger is sharper
+	sharpness := func(interpolator Interpolator) int {
+		img, err := NewVipsImage(bytes.NewBuffer(source.Bytes()), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the chart: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		err = img.vipsResize(0.35, interpolator)
+		if err != nil {
+			t.Fatalf("Cannot resize with %s: %s", interpolator, err)
+		}
+		buf, err := img.getImageBuffer()
+		if err != nil {
+			t.Fatalf("Cannot encode the chart: %s", err)
+		}
+		resized, err := png.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("Cannot decode the chart: %s", err)
+		}
+
+		bounds := resized.Bounds()
+		y := bounds.Dy() / 2
+		total := 0
+		for x := bounds.Min.X + 1; x < bounds.Max.X; x++ {
+			a := color.GrayModel.Convert(resized.At(x-1, y)).(color.Gray).Y
+			b := color.GrayModel.Convert(resized.At(x, y)).(color.Gray).Y
+			if a > b {
+				total += int(a - b)
+			} else {
+				total += int(b - a)
+			}
+		}
+		return total
+	}
+
+	bicubic := sharpness(Bicubic)
+	lanczos3 := sharpness(Lanczos3)
+	if lanczos3 <= bicubic {
+		t.Errorf("Expected lanczos3 to be sharper than bicubic, got %d and %d", lanczos3, bicubic)
+	}
+
+	if size := vipsWindowSize(Lanczos3.String()); size != 6 {
+		t.Errorf("Expected a lanczos3 window of 6, got %f", size)
+	}
+}
+
+// libvips has no lossless JPEG transforms, a crop is decoded and re-encoded, but the ICC profile must still be
+// carried over untouched
+func TestVipsExtractKeepsICCProfile(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readImage("test_icc_prophoto.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	profile, err := img.GetICCProfile()
+	if err != nil {
+		t.Fatalf("Cannot read the profile: %s", err)
+	}
+
+	extracted, err := img.vipsExtract(10, 10, 100, 100)
+	if err != nil {
+		t.Fatalf("Cannot extract the image: %s", err)
+	}
+	defer extracted.DecrementReferenceCount()
+
+	cropped, err := NewVipsImage(bytes.NewBuffer(extracted.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the crop: %s", err)
+	}
+	defer cropped.DecrementReferenceCount()
+	kept, err := cropped.GetICCProfile()
+	if err != nil {
+		t.Fatalf("Cannot read the cropped profile: %s", err)
+	}
+	if !bytes.Equal(kept, profile) {
+		t.Errorf("Expected the ICC profile to be identical, got %d bytes from %d", len(kept), len(profile))
+	}
+}
+
 func readImage(file string) []byte {
 	img, _ := os.Open(path.Join("testdata", file))
 	buf, _ := ioutil.ReadAll(img)
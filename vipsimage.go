@@ -9,9 +9,15 @@ import "C"
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"github.com/KarlAustin/refcount"
 	"github.com/prometheus/client_golang/prometheus"
 	"math"
+	"os"
+	"reflect"
+	"time"
 )
 
 type VipsImage struct {
@@ -20,21 +26,56 @@ type VipsImage struct {
 	Image 		*C.VipsImage
 	Type    	ImageType
 	Options		Options
+	pages			int
 }
 
 func NewVipsImage(buf *bytes.Buffer, opt Options) (*VipsImage, error) {
 	vimgImageBuffer.With(prometheus.Labels{"action":"request", "type":"vips"}).Inc()
 	ret := AquireVipsImage()
+	// Options go first, loading looks at AllPages
+	ret.Options = opt
 	if err := ret.Load(buf); err != nil {
+		ret.DecrementReferenceCount()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// NewVipsImageFromReader reads the whole image from r into a new buffer, libvips needs the complete buffer anyway.
+// If opt.MaxBytes is set, reading stops and ErrMaxBytesExceeded is returned once it's exceeded.
+func NewVipsImageFromReader(r io.Reader, opt Options) (*VipsImage, error) {
+	vimgImageBuffer.With(prometheus.Labels{"action":"request", "type":"vips"}).Inc()
+	ret := AquireVipsImage()
+
+	if opt.MaxBytes > 0 {
+		r = io.LimitReader(r, opt.MaxBytes+1)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(r); err != nil {
+		ret.DecrementReferenceCount()
 		return nil, err
 	}
+	if opt.MaxBytes > 0 && int64(buf.Len()) > opt.MaxBytes {
+		ret.DecrementReferenceCount()
+		return nil, ErrMaxBytesExceeded
+	}
+
 	ret.Options = opt
+	if err := ret.Load(buf); err != nil {
+		ret.DecrementReferenceCount()
+		return nil, err
+	}
 	return ret, nil
 }
 
 var (
 	ErrExtractAreaParamsRequired = errors.New("extract area width/height params are required")
 	ErrVipsImageNotValidPointer = errors.New("Image is not a valid pointer to *C.VipsImage")
+	ErrMaxBytesExceeded = errors.New("Image exceeds the maximum number of bytes allowed")
+	ErrMaxProcessingMemoryExceeded = errors.New("Image would need more than the maximum processing memory allowed")
+	ErrAnimatedNotAllowed = errors.New("Animated images are not allowed")
+	ErrMaxAspectRatioExceeded = errors.New("Image exceeds the maximum aspect ratio allowed")
 )
 
 func ResetVipsImage(i interface{}) error {
@@ -53,12 +94,31 @@ func AquireVipsImage() *VipsImage {
 var vipsImagePool = refcount.NewReferenceCountedPool(
 		func(counter refcount.ReferenceCounter) refcount.ReferenceCountable {
 			vimgImageBuffer.With(prometheus.Labels{"action":"new", "type":"vips"}).Inc()
+			// No buffer is preallocated, libvips reads lazily from whatever buffer an image was loaded from, and it's
+			// dropped in Reset, so it can't be reused safely
 			vi := new(VipsImage)
-			vi.Buffer = make([]byte, 1024 * 2048)
 			vi.ReferenceCounter = counter
 			return vi
 		}, ResetVipsImage)
 
+// Clone returns an independent VipsImage from the pool sharing the decoded image, without reading the buffer again.
+// libvips images are immutable, so processing or freeing either one leaves the other alone. The clone keeps its
+// own reference to the source buffer, which libvips may still be reading from.
+func (img *VipsImage) Clone() (*VipsImage, error) {
+	image, err := img.vipsCopy()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := AquireVipsImage()
+	ret.Image = image
+	ret.Buffer = img.Buffer
+	ret.Type = img.Type
+	ret.Options = img.Options
+	ret.pages = img.pages
+	return ret, nil
+}
+
 func (img *VipsImage) Load(buf *bytes.Buffer) error {
 	if buf.Len() == 0 {
 		return errors.New("Image buffer is empty")
@@ -78,6 +138,7 @@ func (img *VipsImage) Reset() {
 	img.Type = UNKNOWN
 	img.Options = Options{}
 	img.Image = nil
+	img.pages = 0
 }
 
 /**
@@ -92,6 +153,52 @@ func (img *VipsImage) Process() error {
 		return errors.New("Unsupported image output type")
 	}
 
+	// Fail before the real work if the output can't be saved, PreferredTypes picks a type that can at save time
+	if len(img.Options.PreferredTypes) == 0 {
+		if err := CanSave(img.Options.Type); err != nil {
+			return err
+		}
+	}
+
+	// Refuse animations before any of the work, if asked to
+	if img.Options.RejectAnimated && img.isAnimated() {
+		return ErrAnimatedNotAllowed
+	}
+
+	// Refuse extreme shapes, a sliver of an image can still take a lot of memory to resize
+	if img.Options.MaxAspectRatio > 0 && img.aspectRatio() > img.Options.MaxAspectRatio {
+		return ErrMaxAspectRatioExceeded
+	}
+
+	// Refuse images over the memory budget before any of the work
+	if img.Options.MaxProcessingMemory > 0 {
+		memory, err := img.estimatedProcessingMemory()
+		if err != nil {
+			return err
+		}
+		if memory > img.Options.MaxProcessingMemory {
+			return ErrMaxProcessingMemoryExceeded
+		}
+	}
+
+	// Fail early on sharpening libvips would reject
+	err := img.Options.Sharpen.Validate()
+	if err != nil {
+		return err
+	}
+	if img.Options.Median != 0 {
+		if err = validateMedian(img.Options.Median); err != nil {
+			return err
+		}
+	}
+	// and on chroma subsampling libvips can't write, rather than after all the work at save time
+	if _, err = vipsSubsampleMode(img.Options.JpegSubsampling); err != nil {
+		return err
+	}
+	if err = validateForceOrientation(img.Options.ForceOrientation); err != nil {
+		return err
+	}
+
 	/**
 	 * Rotate early, so the output image is the correct size requested
 	 */
@@ -100,6 +207,14 @@ func (img *VipsImage) Process() error {
 		return err
 	}
 
+	// The EXIF orientation has been applied, so reset it to stop viewers applying it again
+	if rotated && !img.Options.NoAutoRotate {
+		err = img.vipsResetOrientation()
+		if err != nil {
+			return err
+		}
+	}
+
 	/**
 	 * If the image has been rotated retrieve the buffer, otherwise the rotation will not manifest
 	 */
@@ -110,36 +225,56 @@ func (img *VipsImage) Process() error {
 		}
 	}
 
-	// Infer the required operation based on the in/out image sizes for a coherent transformation
-	img.normalizeOperation()
-
-	inWidth := int(img.Image.Xsize)
-	inHeight := int(img.Image.Ysize)
+	// A pure conversion keeps the auto-rotated dimensions, so there's no resize to work out
+	pureConversion := img.isPureConversion()
+	shrink, residual, downscale := 1, 0.0, 1.0
+	if !pureConversion {
+		// Infer the required operation based on the in/out image sizes for a coherent transformation
+		img.normalizeOperation()
+
+		inWidth := int(img.Image.Xsize)
+		inHeight := int(img.Image.Ysize)
+
+		// Do not enlarge the output if the input width or height
+		// are already less than the required dimensions
+		if !img.Options.Enlarge && !img.Options.Force &&
+		(inWidth < img.Options.Width && inHeight < img.Options.Height) {
+				img.Options.Width = inWidth
+				img.Options.Height = inHeight
+		}
 
-	// Do not enlarge the output if the input width or height
-	// are already less than the required dimensions
-	if !img.Options.Enlarge && !img.Options.Force &&
-	(inWidth < img.Options.Width && inHeight < img.Options.Height) {
-			img.Options.Width = inWidth
-			img.Options.Height = inHeight
+		factor := img.ScaleFactor()
+		downscale = factor
+		shrink = img.calculateShrink()
+		residual = img.calculateResidual()
+
+		// Try to use libjpeg/libwebp shrink-on-load
+		supportsShrinkOnLoad := img.Type == WEBP && VipsMajorVersion >= 8 && VipsMinorVersion >= 3
+		supportsShrinkOnLoad = supportsShrinkOnLoad || img.Type == JPEG
+		supportsShrinkOnLoad = supportsShrinkOnLoad || img.Type == PDF && (VipsMajorVersion > 8 || VipsMajorVersion == 8 && VipsMinorVersion >= 7)
+		// Shrink-on-load reloads just the first frame
+		if supportsShrinkOnLoad && shrink >= 2 && img.pages <= 1 {
+			factor, err = img.shrinkOnLoad()
+			if err != nil {
+				return err
+			}
+
+			factor = math.Max(factor, 1.0)
+			shrink = int(math.Floor(factor))
+			residual = float64(shrink) / factor
+		}
 	}
 
-	factor := img.ScaleFactor()
-	shrink := img.calculateShrink()
-	residual := img.calculateResidual()
-
-	// Try to use libjpeg/libwebp shrink-on-load
-	supportsShrinkOnLoad := img.Type == WEBP && VipsMajorVersion >= 8 && VipsMinorVersion >= 3
-	supportsShrinkOnLoad = supportsShrinkOnLoad || img.Type == JPEG
-	if supportsShrinkOnLoad && shrink >= 2 {
-		factor, err = img.shrinkOnLoad()
-		if err != nil {
-			return err
-		}
+	// Fix scanned film negatives, if necessary
+	err = img.applyAutoInvertNegative()
+	if err != nil {
+		return err
+	}
 
-		factor = math.Max(factor, 1.0)
-		shrink = int(math.Floor(factor))
-		residual = float64(shrink) / factor
+	// Move into the working space, if necessary
+	err = img.enterWorkingSpace()
+	if err != nil {
+		return err
 	}
 
 	// Zoom image, if necessary
@@ -149,8 +284,8 @@ func (img *VipsImage) Process() error {
 	}
 
 	// Transform image, if necessary
-	if img.shouldTransformImage() {
-		err = img.transformImage(shrink, residual)
+	if !pureConversion && img.shouldTransformImage() {
+		err = img.transformImage(shrink, residual, downscale)
 		if err != nil {
 			return err
 		}
@@ -164,85 +299,895 @@ func (img *VipsImage) Process() error {
 		}
 	}
 
+	// Bring colours back into gamut while still in the scRGB working space, if necessary
+	err = img.applyClampGamut()
+	if err != nil {
+		return err
+	}
+
+	// Watermarks and backgrounds are 8-bit values, so leave the working space for them
+	err = img.leaveWorkingSpace()
+	if err != nil {
+		return err
+	}
+
 	// Add watermark, if necessary
 	err = img.watermarkWithText()
 	if err != nil {
 		return err
 	}
 
-	// Add watermark, if necessary
-	err = img.watermarkWithImage()
+	// Add watermark, if necessary
+	err = img.watermarkWithImage()
+	if err != nil {
+		return err
+	}
+
+	// Add badge, if necessary
+	err = img.drawBadge()
+	if err != nil {
+		return err
+	}
+
+	// Flatten image on a background, if necessary
+	err = img.Flatten()
+	if err != nil {
+		return err
+	}
+
+	// Replace the alpha with a mask, if necessary
+	err = img.applyAlphaMask()
+	if err != nil {
+		return err
+	}
+
+	// Apply Gamma filter, if necessary
+	err = img.applyGamma()
+	if err != nil {
+		return err
+	}
+
+	// Convert to grayscale, if necessary
+	err = img.applyGrayscale()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (img *VipsImage) applyDefaults() {
+	o := &img.Options
+	if o.Quality == 0 {
+		o.Quality = Quality
+	}
+	if o.Compression == 0 {
+		o.Compression = 6
+	}
+	if o.Type == 0 {
+		o.Type = img.Type
+	}
+	o.Interpolator = o.interpolator()
+	if o.Interpretation == 0 {
+		o.Interpretation = InterpretationSRGB
+		if img.keepsCMYK() {
+			o.Interpretation = InterpretationCMYK
+		} else if img.keepsGrayscale() {
+			o.Interpretation = InterpretationBW
+		}
+	}
+}
+
+// keepsCMYK reports whether a CMYK image can stay CMYK through Process when no Interpretation was asked for, so print
+// colours aren't shifted by a round trip through sRGB. It has to be saved as JPEG or TIFF, without a WorkingSpace or
+// anything drawn or flattened in RGB colours.
+func (img *VipsImage) keepsCMYK() bool {
+	o := &img.Options
+	if o.Type != JPEG && o.Type != TIFF || len(o.PreferredTypes) > 0 || o.WorkingSpace != 0 {
+		return false
+	}
+	if o.Grayscale || o.BackgroundSet || len(o.AlphaMask) > 0 || o.Watermark.Text != "" || len(o.WatermarkImage.Buf) > 0 || o.Badge.Text != "" {
+		return false
+	}
+	space, err := img.vipsInterpretation()
+	return err == nil && space == InterpretationCMYK
+}
+
+// keepsGrayscale reports whether a greyscale image can stay greyscale when no Interpretation was asked for, so a JPEG
+// is written with a single component instead of three identical ones. Like keepsCMYK, nothing can be drawn or
+// flattened in RGB colours. Both Process and a Save without it use this to pick the default.
+func (img *VipsImage) keepsGrayscale() bool {
+	o := &img.Options
+	if len(o.PreferredTypes) > 0 || o.WorkingSpace != 0 {
+		return false
+	}
+	if o.BackgroundSet || len(o.AlphaMask) > 0 || o.Watermark.Text != "" || len(o.WatermarkImage.Buf) > 0 || o.Badge.Text != "" {
+		return false
+	}
+	space, err := img.vipsInterpretation()
+	return err == nil && (space == InterpretationBW || space == InterpretationGREY16)
+}
+
+func (img *VipsImage) Save() error {
+	saveOptions, err := img.saveOptions()
+	if err != nil {
+		return err
+	}
+	return img.vipsSave(saveOptions)
+}
+
+// ProcessAndDescribe processes and saves the image with o, returning the encoded buffer and its metadata together.
+// The metadata is read from the image as it's handed to the saver, after the output colour conversions, rather than
+// by loading the buffer again. The type, alpha channel and profile follow what the saver writes.
+func (img *VipsImage) ProcessAndDescribe(o Options) ([]byte, ImageMetadata, error) {
+	img.Options = o
+	if err := img.Process(); err != nil {
+		return nil, ImageMetadata{}, err
+	}
+	saveOptions, err := img.saveOptions()
+	if err != nil {
+		return nil, ImageMetadata{}, err
+	}
+	var m ImageMetadata
+	saveOptions.BeforeEncode = func() (err error) {
+		m, err = img.Metadata()
+		return err
+	}
+	if err = img.vipsSave(saveOptions); err != nil {
+		return nil, ImageMetadata{}, err
+	}
+
+	t := DetermineImageType(img.Buffer)
+	m.Type = ImageTypeName(t)
+	// Savers without alpha support drop the channel
+	if m.Alpha && !typeSupportsAlpha(t) {
+		m.Alpha = false
+		m.Channels--
+	}
+	// Stripping happens in the saver, which drops the profile with the rest of the metadata
+	if saveOptions.StripMetadata {
+		m.Profile = false
+	}
+	return img.Buffer, m, nil
+}
+
+// SaveWithSSIM processes the image with o and saves it at the lowest quality whose SSIM against the processed image
+// is at least target, returning the buffer and the quality picked. The quality is binary searched from 1 to 100, so
+// expect around seven encodes, and if even 100 misses the target that's what's used. Only JPEG and WEBP have a
+// quality to search.
+func (img *VipsImage) SaveWithSSIM(target float64, o Options) ([]byte, int, error) {
+	if target <= 0 || target > 1 {
+		return nil, 0, fmt.Errorf("SSIM target must be above 0 and at most 1, got %g", target)
+	}
+
+	img.Options = o
+	if err := img.Process(); err != nil {
+		return nil, 0, err
+	}
+	if _, err := img.saveOptions(); err != nil {
+		return nil, 0, err
+	}
+	if t := img.Options.Type; t != JPEG && t != WEBP {
+		return nil, 0, fmt.Errorf("SSIM quality search needs a JPEG or WEBP output, not %s", ImageTypeName(t))
+	}
+
+	var best []byte
+	quality := 100
+	for low, high := 1, 100; low <= high; {
+		q := (low + high) / 2
+		buf, ssim, err := img.encodeWithSSIM(q)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ssim >= target {
+			best, quality = buf, q
+			high = q - 1
+		} else {
+			low = q + 1
+		}
+	}
+	if best == nil {
+		var err error
+		if best, _, err = img.encodeWithSSIM(100); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	img.Options.Quality = quality
+	img.Buffer = best
+	return best, quality, nil
+}
+
+// encodeWithSSIM encodes a copy of the image at quality q and measures the SSIM of the result against the image.
+func (img *VipsImage) encodeWithSSIM(q int) ([]byte, float64, error) {
+	clone, err := img.Clone()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer clone.DecrementReferenceCount()
+	clone.Options.Quality = q
+	if err = clone.Save(); err != nil {
+		return nil, 0, err
+	}
+
+	decoded, err := NewVipsImage(bytes.NewBuffer(clone.Buffer), Options{})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer decoded.DecrementReferenceCount()
+	ssim, err := img.vipsSSIM(decoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	return clone.Buffer, ssim, nil
+}
+
+// SaveAs processes the image with o and saves it with the saver libvips picks for a filename style suffix, with any
+// saver options in brackets, e.g. "out.jpg[Q=80,strip]". The saver options in o, such as Quality, are ignored, but
+// the colour handling before the save (Interpretation, the ICC options and resolution) still applies.
+func (img *VipsImage) SaveAs(suffix string, o Options) ([]byte, error) {
+	t := imageTypeFromSuffix(suffix)
+	if t == UNKNOWN {
+		return nil, fmt.Errorf("Cannot tell the image type from the suffix %q", suffix)
+	}
+
+	img.Options = o
+	img.Options.Type = t
+	img.Options.PreferredTypes = nil
+	if err := img.Process(); err != nil {
+		return nil, err
+	}
+	saveOptions, err := img.saveOptions()
+	if err != nil {
+		return nil, err
+	}
+	saveOptions.Suffix = suffix
+	if err = img.vipsSave(saveOptions); err != nil {
+		return nil, err
+	}
+	return img.Buffer, nil
+}
+
+// SaveTo encodes the image as Save does, but writes it to w in chunks straight from the libvips buffer rather than
+// setting Buffer, so a large image isn't held in memory twice. Buffer is left alone.
+func (img *VipsImage) SaveTo(w io.Writer) error {
+	saveOptions, err := img.saveOptions()
+	if err != nil {
+		return err
+	}
+	return img.vipsSaveTo(saveOptions, w)
+}
+
+// SaveToTempFile processes the image with o and has libvips write it straight to a new temporary file, so a large
+// output is never copied into Go. The caller owns the file, cleanup removes it. Only the Quality, Compression,
+// Interlace, Lossless and StripMetadata saver options apply, as they're passed to libvips in the filename.
+func (img *VipsImage) SaveToTempFile(o Options) (string, func(), error) {
+	img.Options = o
+	if err := img.Process(); err != nil {
+		return "", nil, err
+	}
+	saveOptions, err := img.saveOptions()
+	if err != nil {
+		return "", nil, err
+	}
+	if saveOptions.Type == UNKNOWN {
+		saveOptions.Type = JPEG
+	}
+
+	// libvips picks the saver by the extension
+	file, err := ioutil.TempFile("", "vimg-*." + ImageTypes[saveOptions.Type])
+	if err != nil {
+		return "", nil, err
+	}
+	path := file.Name()
+	cleanup := func() {
+		os.Remove(path)
+	}
+	if err = file.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if err = img.vipsSaveFile(saveOptions, path); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// RecompressWebP saves a WebP again at another effort, 0 to 6, keeping it lossy or lossless as it was along with its
+// frames and metadata. libvips can't transcode the compressed data, so a lossy WebP is decoded and encoded again at
+// the default Quality, which is close to the original but not lossless.
+func RecompressWebP(buf []byte, effort int) ([]byte, error) {
+	if DetermineImageType(buf) != WEBP {
+		return nil, errors.New("The image is not a WEBP")
+	}
+	if effort < 0 || effort > 6 {
+		return nil, fmt.Errorf("WEBP effort must be between 0 and 6, got %d", effort)
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(buf), Options{
+		Type:       WEBP,
+		AllPages:   true,
+		Quality:    Quality,
+		Lossless:   isLosslessWebP(buf),
+		WebPEffort: &effort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Save(); err != nil {
+		return nil, err
+	}
+	return img.Buffer, nil
+}
+
+// ConvertICCVariants encodes the image once per named output profile, e.g. an sRGB and a Display-P3 version from
+// the same decode. Each variant is transformed to and tagged with its profile, NoProfile is ignored but StripMetadata
+// still drops the tag. The image needs an embedded profile, or Options.InputICC, to convert from. The image itself
+// is left alone.
+func (img *VipsImage) ConvertICCVariants(profiles map[string][]byte) (map[string][]byte, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("No profiles to convert to")
+	}
+	hasProfile, err := img.hasProfile()
+	if err != nil {
+		return nil, err
+	}
+	if !hasProfile && img.Options.InputICC == "" {
+		return nil, errors.New("Cannot convert an image without an ICC profile")
+	}
+
+	variants := make(map[string][]byte, len(profiles))
+	for name, profile := range profiles {
+		if len(profile) == 0 {
+			return nil, fmt.Errorf("ICC profile %q is empty", name)
+		}
+		buf, err := img.encodeWithProfile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot convert to ICC profile %q: %s", name, err)
+		}
+		variants[name] = buf
+	}
+	return variants, nil
+}
+
+// encodeWithProfile saves a copy of the image converted to the given ICC profile. libvips takes the output profile
+// as a path, so it's written to a temporary file for the transform.
+func (img *VipsImage) encodeWithProfile(profile []byte) ([]byte, error) {
+	file, err := ioutil.TempFile("", "vimg-*.icc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(profile)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clone, err := img.Clone()
+	if err != nil {
+		return nil, err
+	}
+	defer clone.DecrementReferenceCount()
+	clone.Options.OutputICC = file.Name()
+	clone.Options.NoProfile = false
+	if err = clone.Save(); err != nil {
+		return nil, err
+	}
+	return clone.Buffer, nil
+}
+
+func (img *VipsImage) saveOptions() (vipsSaveOptions, error) {
+	o := &img.Options
+	if len(o.PreferredTypes) > 0 {
+		t, err := img.preferredType()
+		if err != nil {
+			return vipsSaveOptions{}, err
+		}
+		o.Type = t
+	}
+
+	return vipsSaveOptions{
+		Quality:        o.Quality,
+		Type:           o.Type,
+		Compression:    o.Compression,
+		Interlace:      o.Interlace,
+		NoProfile:      o.NoProfile,
+		Interpretation: o.Interpretation,
+		InputICC:       o.InputICC,
+		OutputICC:      o.OutputICC,
+		StripMetadata:  o.StripMetadata,
+		Lossless:       o.Lossless,
+		Subsampling:    o.JpegSubsampling,
+		TIFFCompression: o.TIFFCompression,
+		TIFFTile:        o.TIFFTile,
+		TIFFTileWidth:   o.TIFFTileWidth,
+		TIFFTileHeight:  o.TIFFTileHeight,
+		TIFFPyramid:     o.TIFFPyramid,
+		Palette:         o.Palette,
+		Colors:          o.Colors,
+		Dither:          o.Dither,
+		XRes:            o.XRes,
+		YRes:            o.YRes,
+		WebPNearLossless:   o.WebPNearLossless,
+		WebPEffort:         o.WebPEffort,
+		WebPSmartSubsample: o.WebPSmartSubsample,
+		MetadataPreset:     o.MetadataPreset,
+		KeepMetadata:       o.KeepMetadata,
+		RemoveEXIFTags:     o.RemoveEXIFTags,
+	}, nil
+}
+
+func (img *VipsImage) GetICCProfile() ([]byte, error) {
+	vimgOperations.With(prometheus.Labels{"type":"geticc"}).Inc()
+	defer observeOperation("geticc", time.Now())
+	hasProfile, err := img.hasProfile()
+	if err != nil {
+		return nil, err
+	}
+	if !hasProfile {
+		return nil, errors.New("No Profile")
+	}
+	blob, err := img.vipsBlob(VIPS_META_ICC_NAME)
+	if err != nil {
+		return nil, err
+	}
+	return *blob, nil
+}
+
+// StackAverage averages aligned images of the same size into a new image, e.g. to reduce noise from a burst of
+// photos. The result has the type and options of the first image.
+func StackAverage(images []*VipsImage) (*VipsImage, error) {
+	if len(images) == 0 {
+		return nil, errors.New("No images to stack")
+	}
+
+	first := images[0]
+	for _, img := range images {
+		if img == nil || reflect.ValueOf(img.Image).IsNil() {
+			return nil, ErrVipsImageNotValidPointer
+		}
+		if img.Image.Xsize != first.Image.Xsize || img.Image.Ysize != first.Image.Ysize || img.Image.Bands != first.Image.Bands {
+			return nil, fmt.Errorf("Cannot stack images of different sizes, %dx%dx%d and %dx%dx%d",
+				first.Image.Xsize, first.Image.Ysize, first.Image.Bands, img.Image.Xsize, img.Image.Ysize, img.Image.Bands)
+		}
+	}
+
+	image, err := vipsStackAverage(images)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := AquireVipsImage()
+	ret.Image = image
+	ret.Type = first.Type
+	ret.Options = first.Options
+	ret.Buffer, err = ret.getImageBuffer()
+	if err != nil {
+		C.g_object_unref(C.gpointer(image))
+		ret.DecrementReferenceCount()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// processingMemoryFactor allows for the intermediate images of a typical pipeline, each up to a copy of the pixels.
+const processingMemoryFactor = 3
+
+// estimatedProcessingMemory is a rough estimate of the bytes Process needs, from the decoded image size.
+func (img *VipsImage) estimatedProcessingMemory() (int64, error) {
+	sampleSize, err := img.vipsSampleSize()
+	if err != nil {
+		return 0, err
+	}
+	pixels := int64(img.Image.Xsize) * int64(img.Image.Ysize)
+	return pixels * int64(img.Image.Bands) * int64(sampleSize) * processingMemoryFactor, nil
+}
+
+// EstimateOutputSize roughly estimates the bytes saving the image with o would take, without processing or encoding
+// it, e.g. for capacity planning or a progress bar. It works from the output size o asks for, the type and quality,
+// taking how detailed the image is from how well its source compressed, so it can easily be out by half or double.
+func (img *VipsImage) EstimateOutputSize(o Options) (int, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return 0, ErrVipsImageNotValidPointer
+	}
+
+	t := o.Type
+	if t == UNKNOWN {
+		t = img.Type
+	}
+	quality := o.Quality
+	if quality == 0 {
+		quality = Quality
+	}
+
+	inWidth, inHeight := int(img.Image.Xsize), int(img.Image.Ysize)
+	width, height := estimatedOutputDimensions(inWidth, inHeight, o)
+	inPixels, pixels := float64(inWidth) * float64(inHeight), float64(width) * float64(height)
+
+	// Uncompressed TIFFs are just the pixels
+	if t == TIFF && (o.TIFFCompression == "" || o.TIFFCompression == "none") {
+		sampleSize, err := img.vipsSampleSize()
+		if err != nil {
+			return 0, err
+		}
+		return int(pixels) * int(img.Image.Bands) * sampleSize, nil
+	}
+
+	// Bits per pixel as a JPEG at quality 75, and shrinking packs more detail into each pixel
+	detail := float64(len(img.Buffer)) * 8 / inPixels / img.sourceSizeFactor()
+	detail = math.Max(0.1, math.Min(4, detail)) * math.Pow(inPixels / pixels, 0.25)
+
+	factor := encodedSizeFactor(t, quality, o.Lossless)
+	if t == TIFF && o.TIFFCompression == "jpeg" {
+		factor = encodedSizeFactor(JPEG, quality, false)
+	}
+	// Headers and tables
+	const overhead = 600
+	return int(detail * factor * pixels / 8) + overhead, nil
+}
+
+// sourceSizeFactor is encodedSizeFactor for the buffer the image was loaded from.
+func (img *VipsImage) sourceSizeFactor() float64 {
+	switch img.Type {
+	case JPEG:
+		quality := jpegQuality(img.Buffer)
+		if quality == 0 {
+			quality = 75
+		}
+		return encodedSizeFactor(JPEG, quality, false)
+	case WEBP:
+		return encodedSizeFactor(WEBP, Quality, isLosslessWebP(img.Buffer))
+	case TIFF:
+		// Often uncompressed, so about the pixels
+		return 12
+	}
+	return encodedSizeFactor(img.Type, Quality, false)
+}
+
+// encodedSizeFactor is roughly how much bigger an image saved as t is than as a JPEG at quality 75.
+func encodedSizeFactor(t ImageType, quality int, lossless bool) float64 {
+	// libjpeg file sizes at each quality, relative to 75
+	jpeg := func(quality int) float64 {
+		sizes := [][2]float64{{0, 0.2}, {10, 0.27}, {25, 0.45}, {50, 0.68}, {75, 1}, {80, 1.13}, {85, 1.33}, {90, 1.7}, {95, 2.5}, {100, 5}}
+		q := math.Max(0, math.Min(100, float64(quality)))
+		for i := 1; i < len(sizes); i++ {
+			if q <= sizes[i][0] {
+				lo, hi := sizes[i-1], sizes[i]
+				return lo[1] + (hi[1] - lo[1]) * (q - lo[0]) / (hi[0] - lo[0])
+			}
+		}
+		return sizes[len(sizes)-1][1]
+	}
+
+	switch t {
+	case JPEG:
+		return jpeg(quality)
+	case WEBP:
+		if lossless {
+			return 4
+		}
+		return 0.75 * jpeg(quality)
+	case PNG, TIFF:
+		return 5
+	case GIF:
+		return 3
+	}
+	return jpeg(quality)
+}
+
+// estimatedOutputDimensions works out the size Process would produce from the dimensions and crop or fit options in
+// o, without the rounding of the real resize.
+func estimatedOutputDimensions(inWidth, inHeight int, o Options) (int, int) {
+	width, height := o.Width, o.Height
+	switch {
+	case width > 0 && height > 0:
+		if o.Crop || o.Embed || o.Force {
+			return width, height
+		}
+		scale := math.Min(float64(width) / float64(inWidth), float64(height) / float64(inHeight))
+		width, height = int(math.Round(float64(inWidth) * scale)), int(math.Round(float64(inHeight) * scale))
+	case width > 0:
+		height = int(math.Round(float64(inHeight) * float64(width) / float64(inWidth)))
+	case height > 0:
+		width = int(math.Round(float64(inWidth) * float64(height) / float64(inHeight)))
+	default:
+		return inWidth, inHeight
+	}
+	if !o.Enlarge && width > inWidth {
+		return inWidth, inHeight
+	}
+	return int(math.Max(1, float64(width))), int(math.Max(1, float64(height)))
+}
+
+// maxImageSize is the largest width or height extract and smartcrop will produce for this image.
+func (img *VipsImage) maxImageSize() int {
+	if img.Options.MaxImageSize > 0 {
+		return img.Options.MaxImageSize
+	}
+	return VipsMaxImageSize()
+}
+
+// preferredType picks the first of Options.PreferredTypes libvips can save that keeps the image's features, so an
+// alpha channel rules out JPEG. It falls back to the source type.
+func (img *VipsImage) preferredType() (ImageType, error) {
+	alpha, err := img.vipsHasAlpha()
+	if err != nil {
+		return UNKNOWN, err
+	}
+
+	for _, t := range img.Options.PreferredTypes {
+		if !IsTypeSupportedSave(t) || (alpha && !typeSupportsAlpha(t)) {
+			continue
+		}
+		return t, nil
+	}
+	return img.Type, nil
+}
+
+// SetICCProfile embeds the given ICC profile, replacing any existing one, e.g. to tag untagged scans.
+func (img *VipsImage) SetICCProfile(profile []byte) error {
+	return img.vipsSetBlob(VIPS_META_ICC_NAME, profile)
+}
+
+// WouldEnlarge reports whether the dimensions requested in o are larger than the loaded image, without running
+// the pipeline. EXIF auto rotation and right angle rotations are taken into account.
+func (img *VipsImage) WouldEnlarge(o Options) (bool, error) {
+	orientation, err := img.vipsExifOrientation()
+	if err != nil {
+		return false, err
+	}
+
+	width := int(img.Image.Xsize)
+	height := int(img.Image.Ysize)
+
+	// Orientations 5-8 are rotated by 90 or 270 degrees
+	swap := !o.NoAutoRotate && orientation >= 5
+	if int(o.Rotate)%180 == 90 {
+		swap = !swap
+	}
+	if swap {
+		width, height = height, width
+	}
+
+	return o.Width > width || o.Height > height, nil
+}
+
+// DeltaE returns the mean CIEDE2000 colour difference between the image and other, both are converted to Lab
+// before comparing. The images must have the same dimensions.
+func (img *VipsImage) DeltaE(other *VipsImage) (float64, error) {
+	if other == nil {
+		return 0, errors.New("No image to compare against")
+	}
+	if img.Image != nil && other.Image != nil &&
+		(img.Image.Xsize != other.Image.Xsize || img.Image.Ysize != other.Image.Ysize) {
+		return 0, fmt.Errorf("Image dimensions differ: %dx%d != %dx%d",
+			img.Image.Xsize, img.Image.Ysize, other.Image.Xsize, other.Image.Ysize)
+	}
+	return img.vipsDeltaE(other)
+}
+
+// RenderVectorToWidth renders an SVG or PDF directly at the scale that makes it width pixels wide, keeping the
+// aspect ratio, rather than rendering at the default density and resizing. It replaces any processing done so far.
+func (img *VipsImage) RenderVectorToWidth(width int) error {
+	if img.Type != SVG && img.Type != PDF {
+		return fmt.Errorf("Only SVG and PDF images can be rendered to a width, not %s", ImageTypeName(img.Type))
+	}
+	if width <= 0 {
+		return errors.New("The width to render to must be positive")
+	}
+
+	// Start from the native size
+	err := img.vipsLoadVectorScaled(1)
+	if err != nil {
+		return err
+	}
+	err = img.vipsLoadVectorScaled(float64(width) / float64(img.Image.Xsize))
+	if err != nil {
+		return err
+	}
+
+	// The renderer rounds the size, so it can be a pixel out
+	if int(img.Image.Xsize) != width {
+		return img.vipsResize(float64(width)/float64(img.Image.Xsize), img.Options.interpolator())
+	}
+	return nil
+}
+
+// Composite draws overlay onto the image with its top left corner at x, y, blending with mode. The images may have
+// different band counts and colour spaces, and any alpha is premultiplied for the blend. The image only keeps an
+// alpha channel if it already had one.
+func (img *VipsImage) Composite(overlay *VipsImage, mode BlendMode, x, y int) error {
+	if overlay == nil {
+		return errors.New("No image to composite")
+	}
+	return img.vipsComposite(overlay, mode, x, y)
+}
+
+// RotateFloat rotates the image clockwise by any number of degrees, negative for anticlockwise. The canvas grows to
+// fit the rotated image and the corners are filled with Options.Background.
+func (img *VipsImage) RotateFloat(degrees float64) error {
+	return img.vipsRotateFloat(degrees)
+}
+
+// ContactSheet returns a new image with every page or frame shrunk to thumbWidth and laid out in a grid cols wide,
+// padding pixels apart on a background colour. Load the image with Options.AllPages, otherwise there's only the first
+// page. Each page is turned upright by the EXIF orientation, or Options.ForceOrientation, unless
+// Options.NoAutoRotate is set. The sheet keeps the image's type and must be freed with DecrementReferenceCount.
+func (img *VipsImage) ContactSheet(cols int, thumbWidth int, padding int, background Color) (*VipsImage, error) {
+	if cols < 1 || thumbWidth < 1 || padding < 0 {
+		return nil, fmt.Errorf("Invalid contact sheet of %d columns %d pixels wide, %d apart", cols, thumbWidth, padding)
+	}
+
+	angle, flop, err := img.autoUpright()
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := img.vipsContactSheet(angle, flop, cols, thumbWidth, padding, background)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := AquireVipsImage()
+	ret.Image = image
+	// libvips may still be reading the pages from the source buffer
+	ret.Buffer = img.Buffer
+	ret.Type = img.Type
+	ret.Options = Options{Type: img.Type}
+	return ret, nil
+}
+
+// Montage returns a new image with the first page of each image shrunk to thumbWidth and laid out in a grid cols
+// wide, padding pixels apart on a background colour, like ContactSheet does pages. Each image is turned upright by its
+// own EXIF orientation, or Options.ForceOrientation, unless its Options.NoAutoRotate is set, so photos taken at
+// different angles line up. The montage is rendered into memory and doesn't hold on to the images, it takes the type
+// of the first and must be freed with DecrementReferenceCount.
+func Montage(images []*VipsImage, cols int, thumbWidth int, padding int, background Color) (*VipsImage, error) {
+	if len(images) == 0 {
+		return nil, errors.New("No images to montage")
+	}
+	if cols < 1 || thumbWidth < 1 || padding < 0 {
+		return nil, fmt.Errorf("Invalid montage of %d columns %d pixels wide, %d apart", cols, thumbWidth, padding)
+	}
+
+	angles := make([]Angle, len(images))
+	flops := make([]bool, len(images))
+	for i, img := range images {
+		if img == nil {
+			return nil, errors.New("No image to montage")
+		}
+		var err error
+		if angles[i], flops[i], err = img.autoUpright(); err != nil {
+			return nil, err
+		}
+	}
+
+	image, err := vipsMontage(images, angles, flops, cols, thumbWidth, padding, background)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := AquireVipsImage()
+	ret.Image = image
+	ret.Type = images[0].Type
+	ret.Options = Options{Type: images[0].Type}
+	return ret, nil
+}
+
+// autoUpright is calculateUpright unless Options.NoAutoRotate is set, when the image is left as it is.
+func (img *VipsImage) autoUpright() (Angle, bool, error) {
+	if img.Options.NoAutoRotate {
+		return D0, false, nil
+	}
+	return img.calculateUpright()
+}
+
+// CompositeLayer is one image for CompositeMulti, blended with Mode with its top left corner at X, Y.
+type CompositeLayer struct {
+	Buf		[]byte
+	Mode	BlendMode
+	X, Y	int
+}
+
+// CompositeMulti draws the layers onto the image in order, in a single libvips operation rather than one Composite
+// per layer. Layers may have any band count and colour space, like Composite the image only keeps an alpha channel
+// if it already had one.
+func (img *VipsImage) CompositeMulti(layers []CompositeLayer) error {
+	if len(layers) == 0 {
+		return errors.New("No layers to composite")
+	}
+
+	overlays := make([]*VipsImage, 0, len(layers))
+	defer func() {
+		for _, overlay := range overlays {
+			overlay.DecrementReferenceCount()
+		}
+	}()
+	for i, layer := range layers {
+		overlay, err := NewVipsImage(bytes.NewBuffer(layer.Buf), Options{})
+		if err != nil {
+			return fmt.Errorf("Cannot load composite layer %d: %s", i, err)
+		}
+		overlays = append(overlays, overlay)
+	}
+
+	return img.vipsCompositeMulti(overlays, layers)
+}
+
+// IsBlank reports whether the image is a solid colour, give or take noise: no colour band has a standard deviation
+// above tolerance. The tolerance is in pixel values, so 0-255 for 8-bit images. Alpha is ignored.
+func (img *VipsImage) IsBlank(tolerance float64) (bool, error) {
+	deviation, err := img.vipsMaxDeviation()
 	if err != nil {
-		return err
+		return false, err
 	}
+	return deviation <= tolerance, nil
+}
 
-	// Flatten image on a background, if necessary
-	err = img.Flatten()
+// Apply runs any libvips operation that takes an image "in" and gives an image "out", for the many operations without
+// a wrapper here. Arguments may be int, float64, string or bool, enums are given by their nickname, e.g.
+// img.Apply("colourspace", map[string]interface{}{"space": "b-w"}).
+func (img *VipsImage) Apply(operation string, args map[string]interface{}) error {
+	return img.vipsApply(operation, args)
+}
+
+// AutoOrient applies only the EXIF orientation correction and resets the orientation tag to 1, leaving size, type
+// and the rest of the Options alone. Options.Rotate, Flip and Flop are ignored.
+func (img *VipsImage) AutoOrient() error {
+	rotation, flip, err := img.calculateUpright()
 	if err != nil {
 		return err
 	}
 
-	// Apply Gamma filter, if necessary
-	err = img.applyGamma()
+	// EXIF mirroring is left to right, after the rotation
+	err = img.vipsOrient(rotation, false, flip)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (img *VipsImage) applyDefaults() {
-	o := &img.Options
-	if o.Quality == 0 {
-		o.Quality = Quality
-	}
-	if o.Compression == 0 {
-		o.Compression = 6
-	}
-	if o.Type == 0 {
-		o.Type = img.Type
-	}
-	if o.Interpretation == 0 {
-		o.Interpretation = InterpretationSRGB
-	}
+	return img.vipsResetOrientation()
 }
 
-func (img *VipsImage) Save() error {
-	o := &img.Options
-	saveOptions := vipsSaveOptions{
-		Quality:        o.Quality,
-		Type:           o.Type,
-		Compression:    o.Compression,
-		Interlace:      o.Interlace,
-		NoProfile:      o.NoProfile,
-		Interpretation: o.Interpretation,
-		OutputICC:      o.OutputICC,
-		StripMetadata:  o.StripMetadata,
-		Lossless:       o.Lossless,
-	}
+// AutoRotate applies the EXIF orientation like AutoOrient and saves the result to Buffer, in the type and quality
+// of the Options. Unlike Process nothing is resized and no effects are applied.
+func (img *VipsImage) AutoRotate() error {
+	img.applyDefaults()
 
-	err := img.vipsSave(saveOptions)
+	err := img.AutoOrient()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return img.Save()
 }
 
-func (img *VipsImage) GetICCProfile() ([]byte, error) {
-	vimgOperations.With(prometheus.Labels{"type":"geticc"}).Inc()
-	hasProfile, err := img.hasProfile()
-	if err != nil {
-		return nil, err
-	}
-	if !hasProfile {
-		return nil, errors.New("No Profile")
+// aspectRatio returns the ratio of the longer side to the shorter side of a page, so it doesn't grow with the frames
+// of a multi-page load.
+func (img *VipsImage) aspectRatio() float64 {
+	width, height := float64(img.Image.Xsize), float64(img.Image.Ysize)
+	if img.pages > 1 {
+		height /= float64(img.pages)
 	}
-	blob, err := img.vipsBlob(VIPS_META_ICC_NAME)
-	if err != nil {
-		return nil, err
+	return math.Max(width, height) / math.Max(1, math.Min(width, height))
+}
+
+// isAnimated reports whether the image has more than one frame, loaded or not. Multi-page documents, PDFs and TIFFs,
+// aren't animations.
+func (img *VipsImage) isAnimated() bool {
+	if img.Type == PDF || img.Type == TIFF {
+		return false
 	}
-	return *blob, nil
+	pages, ok := img.vipsImageGetInt("n-pages")
+	return img.pages > 1 || ok && pages > 1
 }
 
 func (img *VipsImage) normalizeOperation() {
@@ -252,6 +1197,12 @@ func (img *VipsImage) normalizeOperation() {
 	}
 }
 
+// isPureConversion reports whether the options ask for no change of geometry, only a change of format or effects.
+func (img *VipsImage) isPureConversion() bool {
+	o := &img.Options
+	return o.Width == 0 && o.Height == 0 && o.Extract.Width == 0 && o.Extract.Height == 0 && !o.Trim
+}
+
 func (img *VipsImage) shouldTransformImage() bool {
 	o := &img.Options
 	inWidth := int(img.Image.Xsize)
@@ -270,11 +1221,16 @@ func (img *VipsImage) shouldTransformImage() bool {
 
 func (img *VipsImage) shouldApplyEffects() bool {
 	o := &img.Options
-	return o.GaussianBlur.Sigma > 0 || o.GaussianBlur.MinAmpl > 0 || o.Sharpen.Sigma > 0 && o.Sharpen.Y2 > 0 || o.Sharpen.Y3 > 0
+	return o.Median != 0 || o.GaussianBlur.Sigma > 0 || o.GaussianBlur.MinAmpl > 0 || o.Sharpen.isSet()
 }
 
-func (img *VipsImage) transformImage(shrink int, residual float64) error {
-	var err error
+func (img *VipsImage) transformImage(shrink int, residual float64, downscale float64) error {
+	// Resample in linear light, if necessary
+	space, err := img.enterLinearLight()
+	if err != nil {
+		return err
+	}
+
 	// Use vips_shrink with the integral reduction
 	if shrink > 1 {
 		residual, err = img.shrinkImage(img.Options, residual, shrink)
@@ -290,6 +1246,19 @@ func (img *VipsImage) transformImage(shrink int, residual float64) error {
 		}
 	}
 
+	if space != 0 {
+		err = img.vipsColourspace(space)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Restore some of the detail lost to downscaling, if necessary
+	err = img.autoSharpen(downscale)
+	if err != nil {
+		return err
+	}
+
 	if img.Options.Force {
 		img.Options.Crop = false
 		img.Options.Embed = false
@@ -319,6 +1288,14 @@ func (img *VipsImage) transformImage(shrink int, residual float64) error {
 func (img *VipsImage) applyEffects() error {
 	var err error
 
+	// Denoise before anything spreads the noise around
+	if img.Options.Median != 0 {
+		err = img.vipsMedian(img.Options.Median)
+		if err != nil {
+			return err
+		}
+	}
+
 	if img.Options.GaussianBlur.Sigma > 0 || img.Options.GaussianBlur.MinAmpl > 0 {
 		err = img.vipsGaussianBlur(img.Options.GaussianBlur)
 		if err != nil {
@@ -326,8 +1303,8 @@ func (img *VipsImage) applyEffects() error {
 		}
 	}
 
-	if img.Options.Sharpen.Sigma > 0 && img.Options.Sharpen.Y2 > 0 || img.Options.Sharpen.Y3 > 0 {
-		err = img.vipsSharpen(img.Options.Sharpen)
+	if img.Options.Sharpen.isSet() {
+		err = img.vipsSharpen(img.Options.Sharpen.resolve())
 		if err != nil {
 			return err
 		}
@@ -337,7 +1314,7 @@ func (img *VipsImage) applyEffects() error {
 }
 
 /**
- * TODO: Make crop & embed work with relative numbers
+ * TODO: Make embed work with relative numbers, crops can use Extract.Relative
  */
 func (img *VipsImage) extractOrEmbedImage(o Options) (*VipsImage, error) {
 	var err error = nil
@@ -348,14 +1325,28 @@ func (img *VipsImage) extractOrEmbedImage(o Options) (*VipsImage, error) {
 
 	switch {
 	case o.Gravity == GravitySmart, o.SmartCrop:
-		err = img.vipsSmartCrop(o.Width, o.Height)
+		err = img.vipsSmartCrop(o.Width, o.Height, o.SmartCropStrategy)
 		break
 	case o.Crop:
+		// Crop no more than the image has, the offsets of a larger area would be negative
 		width := int(math.Min(float64(inWidth), float64(o.Width)))
 		height := int(math.Min(float64(inHeight), float64(o.Height)))
-		left, top := calculateCrop(inWidth, inHeight, o.Width, o.Height, o.Gravity)
-		left, top = int(math.Max(float64(left), 0)), int(math.Max(float64(top), 0))
+		if width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("Cannot crop a %dx%d image to %dx%d", inWidth, inHeight, o.Width, o.Height)
+		}
+		left, top := calculateCrop(inWidth, inHeight, width, height, o.Gravity)
+		if o.Gravity == GravityFocal {
+			if o.FocalX < 0 || o.FocalX > 1 || o.FocalY < 0 || o.FocalY > 1 {
+				return nil, fmt.Errorf("The focal point must be from 0 to 1, got %g,%g", o.FocalX, o.FocalY)
+			}
+			left, top = calculateFocalCrop(inWidth, inHeight, width, height, o.FocalX, o.FocalY)
+		}
 		image, err = img.vipsExtract(float32(left), float32(top), float32(width), float32(height))
+		// With Embed the output is the size asked for, the crop placed by gravity and the remainder extended
+		if err == nil && o.Embed && (width < o.Width || height < o.Height) {
+			left, top = calculateCrop(o.Width, o.Height, width, height, o.Gravity)
+			err = image.vipsEmbed(left, top, o.Width, o.Height, o.Extend, o.Background)
+		}
 		break
 	case o.Embed:
 		left, top := (o.Width-inWidth)/2, (o.Height-inHeight)/2
@@ -363,9 +1354,10 @@ func (img *VipsImage) extractOrEmbedImage(o Options) (*VipsImage, error) {
 		image = nil
 		break
 	case o.Trim:
-		left, top, width, height, err := img.vipsTrim(o.Background, o.Threshold)
+		var box ImageRect
+		box, err = img.TrimBox()
 		if err == nil {
-			image, err = img.vipsExtract(float32(left), float32(top), float32(width), float32(height))
+			image, err = img.vipsExtract(float32(box.Left), float32(box.Top), float32(box.Width), float32(box.Height))
 		}
 		break
 	case o.Extract.Top != 0 || o.Extract.Left != 0 || o.Extract.Width != 0 || o.Extract.Height != 0:
@@ -392,18 +1384,26 @@ func (img *VipsImage) rotateAndFlipImage(additive bool) (bool, error) {
 	rotation, flip, err := img.calculateRotationAndFlip(additive)
 	if err != nil { return false, err }
 
+	// Work on copies, the caller's Options keep what they asked for
+	rotate, flop := img.Options.Rotate, img.Options.Flop
 	if img.Options.NoAutoRotate == false {
-		// Cancel out the EXIF flip if user has requested flip
-		if flip && img.Options.Flip {
-			img.Options.Flip = false
+		// EXIF mirroring is left to right after the rotation, so it cancels out or adds to a requested flop
+		if flip {
+			flop = !flop
 		}
-		img.Options.Rotate = rotation
+		rotate = rotation
+	}
+
+	// Right angles combine with the mirrors into a single operation
+	if math.Mod(float64(rotate), 90) == 0 {
+		rotated = rotate > 0 || img.Options.Flip || flop
+		return rotated, img.vipsOrient(rotate, img.Options.Flip, flop)
 	}
 
-	if img.Options.Rotate > 0 {
+	if rotate > 0 {
 		rotated = true
 		//err = img.vipsRotate(getAngle(img.Options.Rotate))
-		err = img.vipsRotate(img.Options.Rotate)
+		err = img.vipsRotate(rotate)
 	}
 
 	if img.Options.Flip {
@@ -411,7 +1411,7 @@ func (img *VipsImage) rotateAndFlipImage(additive bool) (bool, error) {
 		err = img.vipsFlip(Vertical)
 	}
 
-	if img.Options.Flop {
+	if flop {
 		rotated = true
 		err = img.vipsFlip(Horizontal)
 	}
@@ -468,14 +1468,212 @@ func (img *VipsImage) watermarkWithImage() error {
 	return nil
 }
 
+func (img *VipsImage) drawBadge() error {
+	b := img.Options.Badge
+	if b.Text == "" {
+		return nil
+	}
+
+	// Defaults
+	if b.Font == "" {
+		b.Font = WatermarkFont
+	}
+	if b.DPI == 0 {
+		b.DPI = 150
+	}
+	if b.Opacity == 0.0 {
+		b.Opacity = 1.0
+	}
+
+	return img.vipsBadge(b)
+}
+
+// Flatten flattens any alpha onto Options.Background. Any image is flattened when Options.BackgroundSet is given,
+// including onto ColorBlack, otherwise only PNGs with a Background other than ColorBlack are.
 func (img *VipsImage) Flatten() error {
-	var err error
-	// Only PNG images are supported for now
-	if img.Type != PNG || img.Options.Background == ColorBlack {
+	if !img.shouldFlatten() {
 		return nil
 	}
-	err = img.vipsFlattenBackground(img.Options.Background)
-	return err
+	return img.FlattenOnto(img.Options.Background)
+}
+
+// FlattenOnto flattens any alpha channel onto c, whatever the image type and including black.
+func (img *VipsImage) FlattenOnto(c Color) error {
+	return img.vipsFlattenBackground(c)
+}
+
+// FlattenTo flattens any alpha channel onto background and saves the image as t in one go, for viewers without alpha
+// support. Greyscale, CMYK and 16-bit images with alpha are handled as well as RGB ones.
+func (img *VipsImage) FlattenTo(background Color, t ImageType) ([]byte, error) {
+	if err := img.FlattenOnto(background); err != nil {
+		return nil, err
+	}
+	img.Options.Type = t
+	img.Options.PreferredTypes = nil
+	img.applyDefaults()
+	if err := img.Save(); err != nil {
+		return nil, err
+	}
+	return img.Buffer, nil
+}
+
+// SmartCropRect crops the image to width x height around its most interesting part, as GravitySmart does, and
+// returns the area taken so other renditions can be cropped to match. Options.SmartCropStrategy picks what counts
+// as interesting. It needs libvips 8.8 or later.
+func (img *VipsImage) SmartCropRect(width, height int) (ImageRect, error) {
+	return img.vipsSmartCropRect(width, height, img.Options.SmartCropStrategy)
+}
+
+// FaceDetector finds faces for CropToFaces, so callers can plug in whichever detector they build with. DetectFaces
+// must leave the image alone and return boxes in its pixel coordinates.
+type FaceDetector interface {
+	DetectFaces(img *VipsImage) ([]ImageRect, error)
+}
+
+// CropToFaces crops the image to width x height centred on the box around every face the detector finds, kept
+// inside the image, and returns the area taken. Without any faces it falls back to SmartCropRect.
+func (img *VipsImage) CropToFaces(width, height int, detector FaceDetector) (ImageRect, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return ImageRect{}, ErrVipsImageNotValidPointer
+	}
+	if detector == nil {
+		return ImageRect{}, errors.New("No face detector")
+	}
+
+	faces, err := detector.DetectFaces(img)
+	if err != nil {
+		return ImageRect{}, err
+	}
+	if len(faces) == 0 {
+		return img.SmartCropRect(width, height)
+	}
+
+	inWidth := int(img.Image.Xsize)
+	inHeight := int(img.Image.Ysize)
+	width = int(math.Min(float64(inWidth), float64(width)))
+	height = int(math.Min(float64(inHeight), float64(height)))
+	if width <= 0 || height <= 0 {
+		return ImageRect{}, fmt.Errorf("Cannot crop a %dx%d image to %dx%d", inWidth, inHeight, width, height)
+	}
+
+	// Centre on the box around all the faces
+	left, top := faces[0].Left, faces[0].Top
+	right, bottom := left + faces[0].Width, top + faces[0].Height
+	for _, face := range faces[1:] {
+		left = int(math.Min(float64(left), float64(face.Left)))
+		top = int(math.Min(float64(top), float64(face.Top)))
+		right = int(math.Max(float64(right), float64(face.Left + face.Width)))
+		bottom = int(math.Max(float64(bottom), float64(face.Top + face.Height)))
+	}
+	x := float64(left + right) / 2 / float64(inWidth)
+	y := float64(top + bottom) / 2 / float64(inHeight)
+	left, top = calculateFocalCrop(inWidth, inHeight, width, height, x, y)
+
+	cropped, err := img.vipsExtract(float32(left), float32(top), float32(width), float32(height))
+	if err != nil {
+		return ImageRect{}, err
+	}
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = cropped.Image
+	img.Buffer = cropped.Buffer
+	cropped.DecrementReferenceCount()
+
+	return ImageRect{Left: left, Top: top, Width: width, Height: height}, nil
+}
+
+// ExtractBand returns a new image of n bands from start, e.g. ExtractBand(1, 1) for the green channel of an RGB
+// image. The image itself is left alone. A single band result is saved as greyscale unless Options.Interpretation
+// says otherwise.
+func (img *VipsImage) ExtractBand(start, n int) (*VipsImage, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return nil, ErrVipsImageNotValidPointer
+	}
+	bands := img.Bands()
+	if start < 0 || n < 1 || start+n > bands {
+		return nil, fmt.Errorf("Cannot extract %d bands from band %d of an image with %d bands", n, start, bands)
+	}
+
+	image, err := img.vipsExtractBand(start, n)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := AquireVipsImage()
+	ret.Image = image
+	ret.Type = img.Type
+	ret.Options = img.Options
+	if n == 1 && ret.Options.Interpretation == 0 {
+		ret.Options.Interpretation = InterpretationBW
+	}
+	ret.Buffer, err = ret.getImageBuffer()
+	if err != nil {
+		C.g_object_unref(C.gpointer(image))
+		ret.DecrementReferenceCount()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// TrimBox finds the area Trim keeps, using Options.Threshold and Options.TrimBackground. Without a TrimBackground,
+// or a Background, the colour of the top-left pixel is used, so white-bordered scans trim without being told.
+func (img *VipsImage) TrimBox() (ImageRect, error) {
+	var err error
+	background := img.Options.Background
+	switch {
+	case img.Options.TrimBackground != nil:
+		background = *img.Options.TrimBackground
+	case !img.Options.hasBackground():
+		background, err = img.vipsCornerColor()
+		if err != nil {
+			return ImageRect{}, err
+		}
+	}
+
+	left, top, width, height, err := img.vipsTrim(background, img.Options.Threshold)
+	if err != nil {
+		return ImageRect{}, err
+	}
+	return ImageRect{Left: left, Top: top, Width: width, Height: height}, nil
+}
+
+// TrimWithInfo trims the background colour from the edges of the image straight away, with threshold as for
+// Options.Threshold, and reports how much came off each side, e.g. to log and catch over-trimming. An image that's
+// all background is left alone with an error.
+func (img *VipsImage) TrimWithInfo(background Color, threshold float64) (TrimInfo, error) {
+	if reflect.ValueOf(img.Image).IsNil() {
+		return TrimInfo{}, ErrVipsImageNotValidPointer
+	}
+
+	original := ImageSize{Width: int(img.Image.Xsize), Height: int(img.Image.Ysize)}
+	left, top, width, height, err := img.vipsTrim(background, threshold)
+	if err != nil {
+		return TrimInfo{}, err
+	}
+	if width <= 0 || height <= 0 {
+		return TrimInfo{}, errors.New("Nothing left to keep, the image is all background")
+	}
+
+	cropped, err := img.vipsExtract(float32(left), float32(top), float32(width), float32(height))
+	if err != nil {
+		return TrimInfo{}, err
+	}
+	C.g_object_unref(C.gpointer(img.Image))
+	img.Image = cropped.Image
+	img.Buffer = cropped.Buffer
+	cropped.DecrementReferenceCount()
+
+	return TrimInfo{
+		Top:          top,
+		Bottom:       original.Height - top - height,
+		Left:         left,
+		Right:        original.Width - left - width,
+		OriginalSize: original,
+		TrimmedSize:  ImageSize{Width: width, Height: height},
+	}, nil
+}
+
+func (img *VipsImage) shouldFlatten() bool {
+	return img.Options.BackgroundSet || img.Type == PNG && img.Options.hasBackground()
 }
 
 func (img *VipsImage) zoomImage() error {
@@ -534,6 +1732,13 @@ func (img *VipsImage) shrinkOnLoad() (float64, error) {
 		err = img.vipsShrinkJpeg(shrinkOnLoad)
 	} else if img.Type == WEBP && shrink >= 2 {
 		err = img.vipsShrinkWebp(shrink)
+	} else if img.Type == PDF && shrink >= 2 {
+		// PDFs are rendered again at the smaller scale. libvips can't shrink TIFFs on load, so they're left alone
+		width := float64(img.Image.Xsize)
+		err = img.vipsLoadVectorScaled(1 / float64(shrink))
+		if err == nil {
+			factor = factor * float64(img.Image.Xsize) / width
+		}
 	}
 
 	return factor, err
@@ -616,23 +1821,78 @@ func calculateCrop(inWidth, inHeight, outWidth, outHeight int, gravity Gravity)
 	return left, top
 }
 
+// calculateFocalCrop centres an outWidth x outHeight crop on the relative focal point x, y, moving it back inside
+// the image where it would go over an edge.
+func calculateFocalCrop(inWidth, inHeight, outWidth, outHeight int, x, y float64) (int, int) {
+	left := int(math.Round(x*float64(inWidth))) - outWidth/2
+	top := int(math.Round(y*float64(inHeight))) - outHeight/2
+
+	left = int(math.Max(0, math.Min(float64(left), float64(inWidth-outWidth))))
+	top = int(math.Max(0, math.Min(float64(top), float64(inHeight-outHeight))))
+	return left, top
+}
+
+// calculateRelativeArea turns an area given in percentages of an inWidth x inHeight image into pixels. The edges are
+// rounded rather than the size, so neighbouring areas meet, and clamped to the image keeping at least a pixel.
+func calculateRelativeArea(inWidth, inHeight int, left, top, width, height float32) (int, int, int, int) {
+	edge := func(percent float32, size int) int {
+		return int(math.Max(0, math.Min(float64(size), math.Round(float64(percent)*float64(size)/100))))
+	}
+	x0, y0 := edge(left, inWidth), edge(top, inHeight)
+	x1, y1 := edge(left+width, inWidth), edge(top+height, inHeight)
+
+	x0 = int(math.Min(float64(x0), float64(inWidth-1)))
+	y0 = int(math.Min(float64(y0), float64(inHeight-1)))
+	x1 = int(math.Max(float64(x1), float64(x0+1)))
+	y1 = int(math.Max(float64(y1), float64(y0+1)))
+	return x0, y0, x1 - x0, y1 - y0
+}
+
 // calculateRotationAndFlip works out the angles and flips needed to get an image to look "normal" based on EXIF
 // metadata for orientation.
 // If an angle is specified in the image Options then it will use that.
+// Options.ForceOrientation replaces the EXIF orientation, for when it's known to be wrong.
 // If additive is true, it will add the EXIF auto rotation and specified angle together, which is what end users would
 // probably expect to happen.
 func (img *VipsImage) calculateRotationAndFlip(additive bool) (Angle, bool, error) {
 	angle := img.Options.Rotate
-	rotate := D0
-	flip := false
 
 	if angle > 0 && !additive {
-		return rotate, flip, nil
+		return D0, false, nil
 	}
 
-	o, err := img.vipsExifOrientation()
+	rotate, flip, err := img.calculateUpright()
 	if err != nil { return D0, false, err }
 
+	if additive { rotate+= angle }
+
+	return rotate, flip, nil
+}
+
+// validateForceOrientation checks Options.ForceOrientation is an EXIF orientation, or 0 to read the image's own.
+func validateForceOrientation(o int) error {
+	if o < 0 || o > 8 {
+		return fmt.Errorf("ForceOrientation must be from 1 to 8, or 0 for the EXIF orientation, got %d", o)
+	}
+	return nil
+}
+
+// calculateUpright works out the clockwise rotation, and whether to mirror left to right after it, that turns the
+// image upright, from Options.ForceOrientation or else the EXIF orientation.
+func (img *VipsImage) calculateUpright() (Angle, bool, error) {
+	rotate := D0
+	flip := false
+
+	o := img.Options.ForceOrientation
+	if err := validateForceOrientation(o); err != nil {
+		return D0, false, err
+	}
+	if o == 0 {
+		var err error
+		o, err = img.vipsExifOrientation()
+		if err != nil { return D0, false, err }
+	}
+
 	switch o {
 	case 6:
 		rotate = D90
@@ -660,8 +1920,6 @@ func (img *VipsImage) calculateRotationAndFlip(additive bool) (Angle, bool, erro
 		break // flip 8
 	}
 
-	if additive { rotate+= angle }
-
 	return rotate, flip, nil
 }
 
@@ -675,7 +1933,7 @@ func (img *VipsImage) calculateShrink() int {
 	factor := img.ScaleFactor()
 
 	// Calculate integral box shrink
-	windowSize := vipsWindowSize(img.Options.Interpolator.String())
+	windowSize := vipsWindowSize(img.Options.interpolator().String())
 	if factor >= 2 && windowSize > 3 {
 		// Shrink less, affine more with interpolators that use at least 4x4 pixel window, e.g. bicubic
 		shrink = float64(math.Floor(factor * 3.0 / windowSize))
@@ -703,6 +1961,121 @@ func getAngle(angle Angle) Angle {
 }
 */
 
+// applyAutoInvertNegative inverts the image and removes the orange film mask when it looks like a scanned negative.
+func (img *VipsImage) applyAutoInvertNegative() error {
+	if !img.Options.AutoInvertNegative {
+		return nil
+	}
+
+	negative, err := img.vipsIsNegative()
+	if err != nil || !negative {
+		return err
+	}
+	return img.vipsInvertNegative()
+}
+
+// autoSharpen applies a mild unsharp mask for Options.AutoSharpenOnDownscale, stronger the more the image was
+// reduced. It's skipped below a 2x reduction, or when Options.Sharpen is already set.
+func (img *VipsImage) autoSharpen(downscale float64) error {
+	if !img.Options.AutoSharpenOnDownscale || downscale < 2 || img.Options.Sharpen.isSet() {
+		return nil
+	}
+
+	// 1 at 2x, up to 2 from 8x, the libvips default being 3
+	m2 := math.Min(0.5+0.5*math.Log2(downscale), 2)
+	return img.vipsSharpen(Sharpen{
+		Sigma: SharpenSigma,
+		X1:    SharpenX1,
+		Y2:    SharpenY2,
+		Y3:    SharpenY3,
+		M1:    SharpenM1,
+		M2:    m2,
+	})
+}
+
+// enterLinearLight converts an RGB image to scRGB for Options.LinearProcessing, so resampling averages light rather
+// than gamma encoded values. It returns the interpretation to go back to, or 0 if the image was left alone.
+func (img *VipsImage) enterLinearLight() (Interpretation, error) {
+	if !img.Options.LinearProcessing {
+		return 0, nil
+	}
+
+	// Other spaces, or an scRGB WorkingSpace, are left alone
+	space, err := img.vipsInterpretation()
+	if err != nil || (space != InterpretationSRGB && space != InterpretationRGB) {
+		return 0, err
+	}
+	return space, img.vipsColourspace(InterpretationScRGB)
+}
+
+// enterWorkingSpace converts the image to Options.WorkingSpace, unless it's already in it.
+// It's converted to Options.Interpretation when saved.
+func (img *VipsImage) enterWorkingSpace() error {
+	if img.Options.WorkingSpace == 0 {
+		return nil
+	}
+
+	space, err := img.vipsInterpretation()
+	if err != nil {
+		return err
+	}
+	if space == img.Options.WorkingSpace {
+		return nil
+	}
+
+	supported, err := img.vipsColourspaceIsSupported()
+	if err != nil || !supported {
+		return err
+	}
+	return img.vipsColourspace(img.Options.WorkingSpace)
+}
+
+// leaveWorkingSpace converts the image back to Options.Interpretation before text or image watermarks, badges, or flattening
+// onto a background, all of which expect 8-bit values.
+func (img *VipsImage) leaveWorkingSpace() error {
+	o := &img.Options
+	if o.WorkingSpace == 0 || o.WorkingSpace == o.Interpretation {
+		return nil
+	}
+	if o.Watermark.Text == "" && len(o.WatermarkImage.Buf) == 0 && o.Badge.Text == "" && !img.shouldFlatten() {
+		return nil
+	}
+	return img.vipsColourspace(o.Interpretation)
+}
+
+// applyAlphaMask uses Options.AlphaMask as the alpha channel, replacing any the image has. The mask is stretched to
+// the image size and only its first band is used, white being opaque.
+func (img *VipsImage) applyAlphaMask() error {
+	o := &img.Options
+	if len(o.AlphaMask) == 0 {
+		return nil
+	}
+	if len(o.PreferredTypes) == 0 && !typeSupportsAlpha(o.Type) {
+		return fmt.Errorf("An alpha mask can't be saved as %s", ImageTypeName(o.Type))
+	}
+
+	mask, err := NewVipsImage(bytes.NewBuffer(o.AlphaMask), Options{})
+	if err != nil {
+		return err
+	}
+	defer mask.DecrementReferenceCount()
+	return img.vipsAlphaMask(mask)
+}
+
+// applyClampGamut maps out of gamut colours back into range, only an scRGB image can hold them. It runs before
+// leaveWorkingSpace, so it needs an scRGB WorkingSpace, or an scRGB input.
+func (img *VipsImage) applyClampGamut() error {
+	if !img.Options.ClampGamut {
+		return nil
+	}
+
+	space, err := img.vipsInterpretation()
+	if err != nil || space != InterpretationScRGB {
+		return err
+	}
+	return img.vipsClampGamut()
+}
+
 func (img *VipsImage) applyGamma() error {
 	var err error
 	if img.Options.Gamma > 0 {
@@ -713,3 +2086,16 @@ func (img *VipsImage) applyGamma() error {
 	}
 	return nil
 }
+
+func (img *VipsImage) applyGrayscale() error {
+	if !img.Options.Grayscale {
+		return nil
+	}
+	err := img.vipsGrayscale(img.Options.KeepAlpha)
+	if err != nil {
+		return err
+	}
+	// Make sure the save doesn't convert it back to sRGB
+	img.Options.Interpretation = InterpretationBW
+	return nil
+}
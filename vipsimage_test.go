@@ -3,12 +3,19 @@ package vimg
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path"
+	"sync"
 	"testing"
 )
 
@@ -545,6 +552,46 @@ func TestRotationAndFlip(t *testing.T) {
 	}
 }
 
+func TestVipsImageAutoRotateKeepsOptions(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("exif/Landscape_5.jpg")), Options{Flop: true, Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	// The EXIF rotation and mirror are applied without being written back into the caller's Options
+	if !img.Options.Flop || img.Options.Rotate != D0 {
+		t.Errorf("Expected Flop and no rotation to be kept, got Flop %t and Rotate %v", img.Options.Flop, img.Options.Rotate)
+	}
+}
+
+func TestVipsImageExifMirrorAndFlop(t *testing.T) {
+	// Every pixel different, so any mirror shows
+	const width, height = 5, 3
+	picture := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			picture.SetGray(x, y, color.Gray{uint8(10 + 15*(y*width+x))})
+		}
+	}
+
+	// Orientation 2 is stored mirrored, so correcting it and flopping leaves the pixels as stored
+	out := processPNG(t, picture, Options{ForceOrientation: 2, Flop: true})
+	if size := out.Bounds().Size(); size.X != width || size.Y != height {
+		t.Fatalf("Expected %dx%d, got %dx%d", width, height, size.X, size.Y)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := picture.GrayAt(x, y).Y
+			if got := color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y; got != want {
+				t.Errorf("Expected pixel %d,%d to be %d, got %d", x, y, want, got)
+			}
+		}
+	}
+}
+
 func TestIfBothSmartCropOptionsAreIdentical(t *testing.T) {
 	if !(VipsMajorVersion >= 8 && VipsMinorVersion > 4) {
 		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s > 8.4", VipsVersion)
@@ -590,6 +637,183 @@ func TestIfBothSmartCropOptionsAreIdentical(t *testing.T) {
 	}
 }
 
+func TestVipsImageProgressCallback(t *testing.T) {
+	var mutex sync.Mutex
+	var percents []int
+
+	options := Options{
+		Width:  800,
+		Height: 600,
+		ProgressCallback: func(percent int) {
+			mutex.Lock()
+			percents = append(percents, percent)
+			mutex.Unlock()
+		},
+	}
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), options)
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	err = img.Process()
+	if err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	err = img.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(percents) == 0 {
+		t.Fatal("Progress callback was never called")
+	}
+	for i := 1; i < len(percents); i++ {
+		if percents[i] <= percents[i-1] {
+			t.Fatalf("Progress is not increasing: %v", percents)
+		}
+	}
+	if percents[len(percents)-1] != 100 {
+		t.Errorf("Progress didn't finish at 100: %v", percents)
+	}
+}
+
+func TestVipsImageWouldEnlarge(t *testing.T) {
+	tests := []struct {
+		options  Options
+		expected bool
+	}{
+		{Options{Width: 800, Height: 600}, true},
+		{Options{Width: 800}, true},
+		{Options{Height: 301}, true},
+		{Options{Width: 200, Height: 150}, false},
+		{Options{Width: 400, Height: 300}, false},
+		{Options{Width: 300, Height: 400, Rotate: D90}, false},
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	for _, test := range tests {
+		enlarge, err := img.WouldEnlarge(test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enlarge != test.expected {
+			t.Errorf("WouldEnlarge(%dx%d) expected %t, got %t", test.options.Width, test.options.Height, test.expected, enlarge)
+		}
+	}
+}
+
+func TestVipsImageDeltaE(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	deltaE, err := img.DeltaE(img)
+	if err != nil {
+		t.Fatalf("Cannot compare the image: %s", err)
+	}
+	if deltaE != 0 {
+		t.Errorf("Expected no difference against itself, got %f", deltaE)
+	}
+
+	// A low quality re-encode gives a slightly colour shifted copy
+	encoded, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Quality: 20})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer encoded.DecrementReferenceCount()
+	err = encoded.Save()
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	shifted, err := NewVipsImage(bytes.NewBuffer(encoded.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the image: %s", err)
+	}
+	defer shifted.DecrementReferenceCount()
+
+	deltaE, err = img.DeltaE(shifted)
+	if err != nil {
+		t.Fatalf("Cannot compare the image: %s", err)
+	}
+	if deltaE <= 0 || deltaE > 10 {
+		t.Errorf("Expected a small difference, got %f", deltaE)
+	}
+}
+
+func TestVipsImageJpegSubsampling(t *testing.T) {
+	// Alternating one pixel red and blue columns, the worst case for chroma subsampling
+	stripes := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x%2 == 1 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			stripes.Set(x, y, c)
+		}
+	}
+	source := &bytes.Buffer{}
+	if err := png.Encode(source, stripes); err != nil {
+		t.Fatalf("Cannot encode the source image: %s", err)
+	}
+
+	original, err := NewVipsImage(bytes.NewBuffer(source.Bytes()), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer original.DecrementReferenceCount()
+
+	deltaE := map[string]float64{}
+	for _, mode := range []string{"444", "420"} {
+		img, err := NewVipsImage(bytes.NewBuffer(source.Bytes()), Options{Type: JPEG, Quality: 95, JpegSubsampling: mode})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		err = img.Save()
+		if err != nil {
+			t.Fatalf("Cannot save the image with %s subsampling: %s", mode, err)
+		}
+		encoded, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+		if err != nil {
+			t.Fatalf("Cannot reload the image: %s", err)
+		}
+		defer encoded.DecrementReferenceCount()
+		deltaE[mode], err = original.DeltaE(encoded)
+		if err != nil {
+			t.Fatalf("Cannot compare the image: %s", err)
+		}
+	}
+
+	if deltaE["444"] >= deltaE["420"] {
+		t.Errorf("Expected 444 to preserve the edge chroma better than 420, got %f and %f", deltaE["444"], deltaE["420"])
+	}
+
+	for _, mode := range []string{"422", "411"} {
+		img, err := NewVipsImage(bytes.NewBuffer(source.Bytes()), Options{Type: JPEG, JpegSubsampling: mode})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err := img.Process(); err == nil {
+			t.Errorf("Expected an error processing with %s subsampling", mode)
+		}
+		if err := img.Save(); err == nil {
+			t.Errorf("Expected an error saving with %s subsampling", mode)
+		}
+	}
+}
+
 func runBenchmarkResize(file string, o Options, b *testing.B) {
 	buf, _ := Read(path.Join("testdata", file))
 
@@ -603,6 +827,2570 @@ func BenchmarkRotateJpeg(b *testing.B) {
 	runBenchmarkResize("test.jpg", options, b)
 }
 
+func TestVipsImageAutoInvertNegative(t *testing.T) {
+	// A grey ramp as a film negative, inverted under an orange base
+	negative := image.NewRGBA(image.Rect(0, 0, 256, 8))
+	grey := image.NewRGBA(image.Rect(0, 0, 256, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 256; x++ {
+			density := 1 - 0.8*float64(x)/255
+			negative.Set(x, y, color.RGBA{R: uint8(230 * density), G: uint8(150 * density), B: uint8(90 * density), A: 255})
+			grey.Set(x, y, color.RGBA{R: uint8(x), G: uint8(x), B: uint8(x), A: 255})
+		}
+	}
+
+	process := func(source image.Image) image.Image {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, source); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		img, err := NewVipsImage(buf, Options{AutoInvertNegative: true, Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(img.Buffer))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		return out
+	}
+
+	// The ramp should come back as a full range neutral positive
+	out := process(negative)
+	for _, x := range []int{0, 128, 255} {
+		r, g, b, _ := out.At(x, 0).RGBA()
+		r, g, b = r>>8, g>>8, b>>8
+		for _, v := range []uint32{r, g, b} {
+			if diff := int(v) - x; diff < -8 || diff > 8 {
+				t.Errorf("Expected %d at x=%d, got %d,%d,%d", x, x, r, g, b)
+				break
+			}
+		}
+	}
+
+	// A normal neutral image is left alone
+	out = process(grey)
+	if r, _, _, _ := out.At(255, 0).RGBA(); r>>8 != 255 {
+		t.Errorf("Expected a positive image to be untouched, got %d at x=255", r>>8)
+	}
+}
+
+func TestVipsImageResetsOrientation(t *testing.T) {
+	source, err := NewVipsImage(bytes.NewBuffer(readFile("exif/Landscape_6.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer source.DecrementReferenceCount()
+	before, err := source.Dimensions()
+	if err != nil {
+		t.Fatalf("Cannot read the dimensions: %s", err)
+	}
+
+	for _, noAutoRotate := range []bool{false, true} {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("exif/Landscape_6.jpg")), Options{NoAutoRotate: noAutoRotate})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+
+		out, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+		if err != nil {
+			t.Fatalf("Cannot reload the image: %s", err)
+		}
+		defer out.DecrementReferenceCount()
+		metadata, err := out.Metadata()
+		if err != nil {
+			t.Fatalf("Cannot read the metadata: %s", err)
+		}
+
+		if noAutoRotate {
+			if metadata.Orientation != 6 {
+				t.Errorf("Expected the orientation to be preserved without auto rotation, got %d", metadata.Orientation)
+			}
+			if metadata.Size != before {
+				t.Errorf("Expected %+v without auto rotation, got %+v", before, metadata.Size)
+			}
+			continue
+		}
+		if metadata.Orientation != 1 {
+			t.Errorf("Expected orientation 1 after auto rotation, got %d", metadata.Orientation)
+		}
+		if metadata.Size.Width != before.Height || metadata.Size.Height != before.Width {
+			t.Errorf("Expected %dx%d after auto rotation, got %+v", before.Height, before.Width, metadata.Size)
+		}
+	}
+}
+
+func TestVipsImageSetICCProfile(t *testing.T) {
+	tagged, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer tagged.DecrementReferenceCount()
+	profile, err := tagged.GetICCProfile()
+	if err != nil {
+		t.Fatalf("Cannot read the profile: %s", err)
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if has, _ := img.hasProfile(); has {
+		t.Fatal("Expected an untagged image")
+	}
+
+	if err = img.SetICCProfile(profile); err != nil {
+		t.Fatalf("Cannot set the profile: %s", err)
+	}
+	if has, _ := img.hasProfile(); !has {
+		t.Error("Expected the image to have a profile")
+	}
+	set, err := img.GetICCProfile()
+	if err != nil || !bytes.Equal(set, profile) {
+		t.Errorf("Expected the profile to be readable back, got %d bytes, %v", len(set), err)
+	}
+	if err = img.SetICCProfile(nil); err == nil {
+		t.Error("Expected an error setting an empty profile")
+	}
+
+	// Options.InputICC assigns the profile from a file when saving
+	file, err := ioutil.TempFile("", "vimg-*.icc")
+	if err != nil {
+		t.Fatalf("Cannot create the profile file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(profile)
+	file.Close()
+
+	input, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{Type: PNG, InputICC: file.Name()})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer input.DecrementReferenceCount()
+	if err = input.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	saved, err := NewVipsImage(bytes.NewBuffer(input.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+	if has, _ := saved.hasProfile(); !has {
+		t.Error("Expected the saved image to carry the input profile")
+	}
+}
+
+func TestVipsImageConvertICCVariants(t *testing.T) {
+	if VipsMajorVersion == 8 && VipsMinorVersion < 14 {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.14", VipsVersion)
+	}
+
+	// libvips 8.14 knows sRGB and Display-P3 by name, save with each to get the profile bytes
+	builtinProfile := func(name string) []byte {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{Type: PNG, OutputICC: name})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save with the %s profile: %s", name, err)
+		}
+		saved, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+		if err != nil {
+			t.Fatalf("Cannot reload the image: %s", err)
+		}
+		defer saved.DecrementReferenceCount()
+		profile, err := saved.GetICCProfile()
+		if err != nil {
+			t.Fatalf("Cannot read the %s profile: %s", name, err)
+		}
+		return profile
+	}
+	profiles := map[string][]byte{"srgb": builtinProfile("srgb"), "p3": builtinProfile("p3")}
+	if bytes.Equal(profiles["srgb"], profiles["p3"]) {
+		t.Fatal("Expected the sRGB and P3 profiles to differ")
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	variants, err := img.ConvertICCVariants(profiles)
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if len(variants) != len(profiles) {
+		t.Fatalf("Expected %d variants, got %d", len(profiles), len(variants))
+	}
+	for name, buf := range variants {
+		variant, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the %s variant: %s", name, err)
+		}
+		embedded, err := variant.GetICCProfile()
+		variant.DecrementReferenceCount()
+		if err != nil || !bytes.Equal(embedded, profiles[name]) {
+			t.Errorf("Expected the %s variant to embed its profile, got %d bytes, %v", name, len(embedded), err)
+		}
+	}
+
+	if _, err = img.ConvertICCVariants(map[string][]byte{"empty": nil}); err == nil {
+		t.Error("Expected an error for an empty profile")
+	}
+	untagged, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer untagged.DecrementReferenceCount()
+	if _, err = untagged.ConvertICCVariants(profiles); err == nil {
+		t.Error("Expected an error converting an image without a profile")
+	}
+}
+
+func TestStackAverage(t *testing.T) {
+	// Standard deviation of the first band, the images are flat grey apart from the noise
+	stdDev := func(buf []byte) float64 {
+		decoded, err := png.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		var sum, sum2, n float64
+		bounds := decoded.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, _, _, _ := decoded.At(x, y).RGBA()
+				v := float64(r >> 8)
+				sum += v
+				sum2 += v * v
+				n++
+			}
+		}
+		mean := sum / n
+		return math.Sqrt(sum2/n - mean*mean)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	var images []*VipsImage
+	var noise []float64
+	for i := 0; i < 3; i++ {
+		noisy := image.NewGray(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				noisy.SetGray(x, y, color.Gray{Y: uint8(128 + random.Intn(81) - 40)})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, noisy); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		noise = append(noise, stdDev(buf.Bytes()))
+
+		img, err := NewVipsImage(buf, Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		images = append(images, img)
+	}
+
+	stacked, err := StackAverage(images)
+	if err != nil {
+		t.Fatalf("Cannot stack the images: %s", err)
+	}
+	defer stacked.DecrementReferenceCount()
+	if stacked.Type != PNG {
+		t.Errorf("Unexpected image type: %s", ImageTypeName(stacked.Type))
+	}
+
+	averaged := stdDev(stacked.Buffer)
+	for i, n := range noise {
+		if averaged >= n {
+			t.Errorf("Expected less noise than input %d, got %f against %f", i, averaged, n)
+		}
+	}
+
+	// Sizes have to match
+	other, err := NewVipsImage(bytes.NewBuffer(readFile("test.png")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer other.DecrementReferenceCount()
+	if _, err = StackAverage(append(images, other)); err == nil {
+		t.Error("Expected an error stacking images of different sizes")
+	}
+}
+
+func TestVipsImageClampGamut(t *testing.T) {
+	orange := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			orange.Set(x, y, color.RGBA{R: 200, G: 80, B: 60, A: 255})
+		}
+	}
+	source := &bytes.Buffer{}
+	if err := png.Encode(source, orange); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	// HSV hue in degrees, for colours where red is the largest channel
+	hue := func(r, g, b uint32) float64 {
+		lowest := math.Min(float64(g), float64(b))
+		return (float64(g) - float64(b)) / (float64(r) - lowest) * 60
+	}
+
+	// Brightening 3 times in linear light pushes red far past the gamut, a float TIFF keeps it there
+	bright, err := NewVipsImage(bytes.NewBuffer(source.Bytes()), Options{Type: TIFF, Interpretation: InterpretationScRGB})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer bright.DecrementReferenceCount()
+	if err = bright.vipsColourspace(InterpretationScRGB); err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if err = bright.vipsLinear([]float64{3, 3, 3}, []float64{0, 0, 0}); err != nil {
+		t.Fatalf("Cannot brighten the image: %s", err)
+	}
+	if err = bright.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	// Flattening leaves the working space early, the clamp has to come before that
+	process := func(clamp bool) (uint32, uint32, uint32) {
+		img, err := NewVipsImage(bytes.NewBuffer(bright.Buffer), Options{
+			Type:          PNG,
+			WorkingSpace:  InterpretationScRGB,
+			ClampGamut:    clamp,
+			BackgroundSet: true,
+		})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(img.Buffer))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+		r, g, b, _ := out.At(4, 4).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+
+	original := hue(200, 80, 60)
+	clippedHue := hue(process(false))
+	r, g, b := process(true)
+	clampedHue := hue(r, g, b)
+
+	if r != 255 || g == 255 || b == 255 {
+		t.Errorf("Expected only red at full range, got %d,%d,%d", r, g, b)
+	}
+	if math.Abs(clampedHue-original) > 2 {
+		t.Errorf("Expected the hue to stay near %f, got %f", original, clampedHue)
+	}
+	if math.Abs(clampedHue-original) >= math.Abs(clippedHue-original) {
+		t.Errorf("Expected clamping to keep the hue better than clipping, got %f and %f against %f", clampedHue, clippedHue, original)
+	}
+}
+
+func TestVipsImagePreferredTypes(t *testing.T) {
+	preferred := []ImageType{MAGICK, WEBP, JPEG}
+	files := []struct {
+		name     string
+		expected ImageType
+	}{
+		{"test.jpg", WEBP},
+		{"transparent.png", WEBP},
+	}
+	// Without WEBP, transparency rules out JPEG and the source type is used
+	if !IsTypeSupportedSave(WEBP) {
+		files[0].expected = JPEG
+		files[1].expected = PNG
+	}
+
+	for _, file := range files {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile(file.name)), Options{PreferredTypes: preferred})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		if saved := DetermineImageType(img.Buffer); saved != file.expected {
+			t.Errorf("Expected %s to be saved as %s, got %s", file.name, ImageTypeName(file.expected), ImageTypeName(saved))
+		}
+	}
+
+	// A transparent source never becomes JPEG
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("transparent.png")), Options{PreferredTypes: []ImageType{MAGICK, JPEG}})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if saved := DetermineImageType(img.Buffer); saved != PNG {
+		t.Errorf("Expected the transparent image to stay png, got %s", ImageTypeName(saved))
+	}
+}
+
+func TestVipsImageApply(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			source.Set(x, y, color.RGBA{R: 10, G: 100, B: 200, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, source); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	img, err := NewVipsImage(buf, Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	if err = img.Apply("invert", nil); err != nil {
+		t.Fatalf("Cannot apply invert: %s", err)
+	}
+	if err = img.Apply("invert", map[string]interface{}{"in": []int{1}}); err == nil {
+		t.Error("Expected an error for an unsupported argument type")
+	}
+	if err = img.Apply("not-an-operation", nil); err == nil {
+		t.Error("Expected an error for an unknown operation")
+	}
+
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(img.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+	r, g, b, _ := out.At(8, 8).RGBA()
+	if r>>8 != 245 || g>>8 != 155 || b>>8 != 55 {
+		t.Errorf("Expected 245,155,55, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestVipsImageLinearProcessing(t *testing.T) {
+	// A one pixel black and white checkerboard averages to half the light, which is about 188 in sRGB
+	checkerboard := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				checkerboard.Set(x, y, color.White)
+			} else {
+				checkerboard.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	mean := func(linear bool) float64 {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, checkerboard); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		img, err := NewVipsImage(buf, Options{Width: 16, Height: 16, Force: true, LinearProcessing: linear, Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(img.Buffer))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+
+		// Skip the edges, where the resampling window runs off the image
+		total, n := 0.0, 0
+		for y := 4; y < 12; y++ {
+			for x := 4; x < 12; x++ {
+				r, g, b, _ := out.At(x, y).RGBA()
+				total += float64(r>>8+g>>8+b>>8) / 3
+				n++
+			}
+		}
+		return total / float64(n)
+	}
+
+	gamma, linear := mean(false), mean(true)
+	if math.Abs(linear-188) > 12 {
+		t.Errorf("Expected a linear light mean near 188, got %.1f", linear)
+	}
+	if linear-gamma < 30 {
+		t.Errorf("Expected linear light to keep more of the brightness, got %.1f against %.1f", linear, gamma)
+	}
+}
+
+func TestVipsImageSharpenDefaults(t *testing.T) {
+	for _, sharpen := range []Sharpen{{Sigma: 1}, {Y3: 15}, {Sigma: 1, Y2: 0, Y3: 15, Exact: true}} {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Sharpen: sharpen})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = img.Process(); err != nil {
+			t.Errorf("Cannot sharpen with %+v: %s", sharpen, err)
+		}
+		// The defaults are filled in for libvips, the Options stay as they were given
+		if img.Options.Sharpen != sharpen {
+			t.Errorf("Expected the Options to keep %+v, got %+v", sharpen, img.Options.Sharpen)
+		}
+		img.DecrementReferenceCount()
+	}
+
+	if s := (Sharpen{Y3: 15}).resolve(); s.Sigma != SharpenSigma || s.X1 != SharpenX1 || s.Y2 != SharpenY2 || s.Y3 != 15 || s.M2 != SharpenM2 {
+		t.Errorf("Expected the defaults to be filled in, got %+v", s)
+	}
+	if s := (Sharpen{Sigma: 1, Exact: true}).resolve(); s.X1 != 0 || s.Y2 != 0 || s.Y3 != 0 || s.M2 != 0 {
+		t.Errorf("Expected Exact to keep the zero values, got %+v", s)
+	}
+
+	invalid := Sharpen{Sigma: 1, M2: -1}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected an error for a negative m2")
+	}
+	if err := (Sharpen{Y2: 5, Exact: true}).Validate(); err == nil {
+		t.Error("Expected an error for an exact zero sigma")
+	}
+	unset := Sharpen{}
+	if err := unset.Validate(); err != nil || unset.isSet() {
+		t.Errorf("Expected an unset Sharpen to be left alone, got %+v, %v", unset, err)
+	}
+}
+
+func TestVipsImageIsBlank(t *testing.T) {
+	solid := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			solid.Set(x, y, color.RGBA{R: 240, G: 238, B: 230, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, solid); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	files := []struct {
+		name  string
+		buf   *bytes.Buffer
+		blank bool
+	}{
+		{"solid", buf, true},
+		{"test.jpg", bytes.NewBuffer(readFile("test.jpg")), false},
+	}
+	for _, file := range files {
+		img, err := NewVipsImage(file.buf, Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		blank, err := img.IsBlank(2)
+		if err != nil {
+			t.Errorf("Cannot check %s: %s", file.name, err)
+		}
+		if blank != file.blank {
+			t.Errorf("Expected %s blank to be %t", file.name, file.blank)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+func TestVipsImageAutoSharpenOnDownscale(t *testing.T) {
+	// Mid-grey stripes leave room for the sharpening overshoot
+	stripes := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			v := uint8(64)
+			if (x/16)%2 == 1 {
+				v = 192
+			}
+			stripes.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+
+	// acutance is the steepest step between horizontal neighbours along the middle row
+	acutance := func(size int, sharpen bool) int {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, stripes); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		img, err := NewVipsImage(buf, Options{Width: size, Height: size, AutoSharpenOnDownscale: sharpen, Type: PNG})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		out, err := png.Decode(bytes.NewReader(img.Buffer))
+		if err != nil {
+			t.Fatalf("Cannot decode the image: %s", err)
+		}
+
+		steepest := 0
+		bounds := out.Bounds()
+		y := bounds.Dy() / 2
+		for x := 1; x < bounds.Dx(); x++ {
+			a, _, _, _ := out.At(x-1, y).RGBA()
+			b, _, _, _ := out.At(x, y).RGBA()
+			if step := int(math.Abs(float64(a>>8) - float64(b>>8))); step > steepest {
+				steepest = step
+			}
+		}
+		return steepest
+	}
+
+	if plain, sharpened := acutance(64, false), acutance(64, true); sharpened <= plain {
+		t.Errorf("Expected more edge contrast after a 4x downscale with auto-sharpen, got %d against %d", sharpened, plain)
+	}
+	if plain, sharpened := acutance(256, false), acutance(256, true); sharpened != plain {
+		t.Errorf("Expected no sharpening at 1x, got %d against %d", sharpened, plain)
+	}
+}
+
+func TestVipsImageRotateCrop(t *testing.T) {
+	rotate := func(crop bool) (ImageSize, ImageSize) {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Rotate: 10, RotateCrop: crop})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		before, _ := img.Dimensions()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		after, _ := img.Dimensions()
+		return before, after
+	}
+
+	if before, after := rotate(true); after != before {
+		t.Errorf("Expected %+v, got %+v", before, after)
+	}
+	if before, after := rotate(false); after.Width <= before.Width || after.Height <= before.Height {
+		t.Errorf("Expected the canvas to expand from %+v, got %+v", before, after)
+	}
+}
+
+func TestVipsImageTiledPyramidTIFF(t *testing.T) {
+	if !IsTypeSupportedSave(TIFF) {
+		t.Skip("TIFF saving is not supported")
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 1024, 1024))); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	img, err := NewVipsImage(buf, Options{
+		Type:            TIFF,
+		TIFFTile:        true,
+		TIFFTileWidth:   256,
+		TIFFTileHeight:  256,
+		TIFFPyramid:     true,
+		TIFFCompression: "deflate",
+	})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	// Each pyramid level is a page: 1024, 512 and 256 pixels
+	out, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the TIFF: %s", err)
+	}
+	defer out.DecrementReferenceCount()
+	if out.Type != TIFF {
+		t.Fatalf("Expected a tiff, got %s", ImageTypeName(out.Type))
+	}
+	if pages, ok := out.vipsImageGetInt("n-pages"); !ok || pages < 3 {
+		t.Errorf("Expected at least 3 pages, got %d", pages)
+	}
+
+	for _, o := range []vipsSaveOptions{{TIFFCompression: "zip"}, {TIFFTile: true, TIFFTileWidth: 100}} {
+		if _, err = vipsTiffOptions(o); err == nil {
+			t.Errorf("Expected an error for %+v", o)
+		}
+	}
+}
+
+func TestVipsImagePalettePNG(t *testing.T) {
+	// Four flat colours, scattered so deflate can't hide the cost of full colour pixels
+	icon := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	colours := []color.RGBA{{200, 30, 30, 255}, {30, 200, 30, 255}, {30, 30, 200, 255}, {240, 240, 240, 255}}
+	random := rand.New(rand.NewSource(1))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			icon.Set(x, y, colours[random.Intn(len(colours))])
+		}
+	}
+
+	save := func(o Options) []byte {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, icon); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		o.Type = PNG
+		img, err := NewVipsImage(buf, o)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Save(); err != nil {
+			if o.Palette {
+				t.Skipf("Cannot save a palette PNG: %s", err)
+			}
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return img.Buffer
+	}
+
+	full := save(Options{})
+	indexed := save(Options{Palette: true, Colors: 16})
+	if !isIndexedPNG(indexed) {
+		t.Fatal("Expected an indexed PNG")
+	}
+	decoded, err := png.Decode(bytes.NewReader(indexed))
+	if err != nil {
+		t.Fatalf("Cannot decode the palette PNG: %s", err)
+	}
+	if _, ok := decoded.ColorModel().(color.Palette); !ok {
+		t.Errorf("Expected a paletted image, got %T", decoded.ColorModel())
+	}
+	if len(indexed) >= len(full)*3/4 {
+		t.Errorf("Expected the palette PNG to be substantially smaller, got %d bytes against %d", len(indexed), len(full))
+	}
+
+	if _, _, err = vipsPaletteOptions(vipsSaveOptions{Type: PNG, Palette: true, Colors: 300}); err == nil {
+		t.Error("Expected an error for 300 colours")
+	}
+}
+
+func TestVipsImageWebPEffort(t *testing.T) {
+	if !IsTypeSupportedSave(WEBP) || VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skip("WEBP effort needs libvips 8.8 or later")
+	}
+
+	save := func(o Options) []byte {
+		o.Type = WEBP
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), o)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return img.Buffer
+	}
+
+	zero, six := 0, 6
+	fastest := save(Options{WebPEffort: &zero})
+	smallest := save(Options{WebPEffort: &six})
+	if len(smallest) >= len(fastest) {
+		t.Errorf("Expected effort 6 to be smaller than effort 0, got %d bytes against %d", len(smallest), len(fastest))
+	}
+
+	if nearLossless := save(Options{WebPNearLossless: true, Quality: 60}); DetermineImageType(nearLossless) != WEBP {
+		t.Errorf("Expected a near lossless WEBP, got %s", DetermineImageTypeName(nearLossless))
+	}
+
+	seven := 7
+	if _, _, _, err := vipsWebpOptions(vipsSaveOptions{Type: WEBP, WebPEffort: &seven}); err == nil {
+		t.Error("Expected an error for effort 7")
+	}
+}
+
+func TestVipsImageMultiPageResize(t *testing.T) {
+	if !IsTypeSupportedSave(WEBP) || VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skip("Saving animated WEBP is not supported")
+	}
+	colours := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	anim := &gif.GIF{}
+	for _, c := range colours {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{c})
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("Cannot encode the animation: %s", err)
+	}
+
+	img, err := NewVipsImage(buf, Options{AllPages: true, Width: 32, Type: WEBP, Lossless: true})
+	if err != nil {
+		t.Fatalf("Cannot read the animation: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the animation: %s", err)
+	}
+
+	out, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{AllPages: true, Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the resized animation: %s", err)
+	}
+	defer out.DecrementReferenceCount()
+	if pageHeight, ok := out.vipsImageGetInt("page-height"); !ok || pageHeight != 32 {
+		t.Errorf("Expected a page-height of 32, got %d", pageHeight)
+	}
+	if pages, ok := out.vipsImageGetInt("n-pages"); !ok || pages != len(colours) {
+		t.Errorf("Expected %d pages, got %d", len(colours), pages)
+	}
+
+	// Each frame keeps its own colour, so the frames weren't split at the old height
+	if err = out.Save(); err != nil {
+		t.Fatalf("Cannot save the strip: %s", err)
+	}
+	strip, err := png.Decode(bytes.NewReader(out.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the strip: %s", err)
+	}
+	if strip.Bounds().Dx() != 32 || strip.Bounds().Dy() != 32*len(colours) {
+		t.Fatalf("Expected a 32x%d strip, got %v", 32*len(colours), strip.Bounds())
+	}
+	for i, c := range colours {
+		r, g, b, _ := strip.At(16, i*32+16).RGBA()
+		if uint8(r>>8) != c.R || uint8(g>>8) != c.G || uint8(b>>8) != c.B {
+			t.Errorf("Frame %d: expected %v, got %d,%d,%d", i, c, r>>8, g>>8, b>>8)
+		}
+	}
+}
+
+func TestVipsImageForceOrientation(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("exif/Landscape_1.jpg")), Options{ForceOrientation: 6})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if o, _ := img.vipsExifOrientation(); o != 1 {
+		t.Fatalf("Expected the image to be tagged orientation 1, got %d", o)
+	}
+	stored, _ := img.Dimensions()
+
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if size, _ := img.Dimensions(); size.Width != stored.Height || size.Height != stored.Width {
+		t.Errorf("Expected the image rotated to %dx%d, got %dx%d", stored.Height, stored.Width, size.Width, size.Height)
+	}
+
+	img.Options.ForceOrientation = 9
+	if _, _, err = img.calculateRotationAndFlip(true); err == nil {
+		t.Error("Expected an error for orientation 9")
+	}
+
+	// Process refuses them up front, even with auto rotation off
+	for _, orientation := range []int{-1, 9} {
+		img.Options = Options{ForceOrientation: orientation, NoAutoRotate: true}
+		if err = img.Process(); err == nil {
+			t.Errorf("Expected Process to refuse orientation %d", orientation)
+		}
+	}
+}
+
+func TestVipsImageClone(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Width: 300})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	before, _ := img.Dimensions()
+
+	clone, err := img.Clone()
+	if err != nil {
+		t.Fatalf("Cannot clone the image: %s", err)
+	}
+	clone.Options = Options{Width: 100, Type: PNG, Grayscale: true}
+	if err = clone.Process(); err != nil {
+		t.Fatalf("Cannot process the clone: %s", err)
+	}
+	if err = clone.Save(); err != nil {
+		t.Fatalf("Cannot save the clone: %s", err)
+	}
+	if DetermineImageType(clone.Buffer) != PNG {
+		t.Errorf("Expected the clone to be saved as png, got %s", DetermineImageTypeName(clone.Buffer))
+	}
+	clone.DecrementReferenceCount()
+
+	// The original is untouched and still processes with its own options
+	if size, _ := img.Dimensions(); size != before {
+		t.Fatalf("Expected the original to stay %+v, got %+v", before, size)
+	}
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the original: %s", err)
+	}
+	m, err := img.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if m.Size.Width != 300 || m.Space != "srgb" {
+		t.Errorf("Expected a 300 pixel wide srgb image, got %d wide %s", m.Size.Width, m.Space)
+	}
+}
+
+func TestVipsImageResolution(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Width: 200, Type: JPEG, XRes: 300})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	out, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the saved image: %s", err)
+	}
+	defer out.DecrementReferenceCount()
+	m, err := out.Metadata()
+	if err != nil {
+		t.Fatalf("Cannot read the metadata: %s", err)
+	}
+	if math.Abs(m.XRes-300) > 0.5 || math.Abs(m.YRes-300) > 0.5 {
+		t.Errorf("Expected 300 DPI, got %.1fx%.1f", m.XRes, m.YRes)
+	}
+}
+
+func TestVipsImageContactSheet(t *testing.T) {
+	colours := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 0, 255}}
+	anim := &gif.GIF{}
+	for _, c := range colours {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 40, 40), color.Palette{c}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("Cannot encode the animation: %s", err)
+	}
+
+	img, err := NewVipsImage(buf, Options{AllPages: true})
+	if err != nil {
+		t.Fatalf("Cannot read the animation: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if img.pages != len(colours) {
+		t.Skipf("Expected %d frames, got %d, this libvips can't load all of them", len(colours), img.pages)
+	}
+
+	sheet, err := img.ContactSheet(2, 20, 4, Color{255, 255, 255, 255})
+	if err != nil {
+		t.Fatalf("Cannot make the contact sheet: %s", err)
+	}
+	defer sheet.DecrementReferenceCount()
+	if size, _ := sheet.Dimensions(); size.Width != 44 || size.Height != 44 {
+		t.Fatalf("Expected a 44x44 sheet, got %dx%d", size.Width, size.Height)
+	}
+
+	sheet.Options.Type = PNG
+	if err = sheet.Save(); err != nil {
+		t.Fatalf("Cannot save the contact sheet: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(sheet.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the contact sheet: %s", err)
+	}
+	// Frames go across then down, 24 pixels apart
+	for n, c := range colours {
+		x, y := 10+24*(n%2), 10+24*(n/2)
+		r, g, b, _ := out.At(x, y).RGBA()
+		if uint8(r>>8) != c.R || uint8(g>>8) != c.G || uint8(b>>8) != c.B {
+			t.Errorf("Expected frame %d at %d,%d to be %v, got %d,%d,%d", n, x, y, c, r>>8, g>>8, b>>8)
+		}
+	}
+
+	if _, err = img.ContactSheet(0, 20, 4, ColorBlack); err == nil {
+		t.Error("Expected an error for 0 columns")
+	}
+}
+
+func TestVipsImageResizeOddPageHeight(t *testing.T) {
+	anim := &gif.GIF{}
+	for n := 0; n < 5; n++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 40, 101), color.Palette{color.RGBA{uint8(n * 50), 0, 0, 255}}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("Cannot encode the animation: %s", err)
+	}
+
+	img, err := NewVipsImage(buf, Options{AllPages: true})
+	if err != nil {
+		t.Fatalf("Cannot read the animation: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if img.pages != 5 {
+		t.Skipf("Expected 5 frames, got %d, this libvips can't load all of them", img.pages)
+	}
+
+	// 505 rows at half size would be 253, which doesn't split into 5 frames
+	if err = img.vipsResize(0.5, Bicubic); err != nil {
+		t.Fatalf("Cannot resize the animation: %s", err)
+	}
+	if img.Image.Ysize != 5*51 {
+		t.Errorf("Expected a height of %d, got %d", 5*51, img.Image.Ysize)
+	}
+	if err = img.vipsPreSave(&vipsSaveOptions{Type: PNG}); err != nil {
+		t.Fatalf("Cannot prepare the animation for saving: %s", err)
+	}
+	if pageHeight, ok := img.vipsImageGetInt("page-height"); !ok || pageHeight != 51 {
+		t.Errorf("Expected a page-height of 51, got %d", pageHeight)
+	}
+}
+
+func TestMontageAutoRotates(t *testing.T) {
+	var images []*VipsImage
+	for _, file := range []string{"exif/Landscape_6.jpg", "exif/Landscape_1.jpg"} {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile(file)), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read %s: %s", file, err)
+		}
+		defer img.DecrementReferenceCount()
+		images = append(images, img)
+	}
+
+	sheet, err := Montage(images, 2, 60, 0, ColorBlack)
+	if err != nil {
+		t.Fatalf("Cannot make the montage: %s", err)
+	}
+	defer sheet.DecrementReferenceCount()
+
+	// Both are landscape once upright, a sideways orientation 6 cell would make the row taller than it is wide
+	size, _ := sheet.Dimensions()
+	if size.Width != 120 || size.Height >= 60 {
+		t.Fatalf("Expected a 120 pixel wide row of landscape cells, got %dx%d", size.Width, size.Height)
+	}
+
+	sheet.Options.Type = PNG
+	if err = sheet.Save(); err != nil {
+		t.Fatalf("Cannot save the montage: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(sheet.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the montage: %s", err)
+	}
+	// The same photo upright in both cells
+	var diff, n float64
+	for y := 0; y < size.Height; y++ {
+		for x := 0; x < 60; x++ {
+			r0, g0, b0, _ := out.At(x, y).RGBA()
+			r1, g1, b1, _ := out.At(x+60, y).RGBA()
+			diff += math.Abs(float64(r0)-float64(r1)) + math.Abs(float64(g0)-float64(g1)) + math.Abs(float64(b0)-float64(b1))
+			n += 3
+		}
+	}
+	if mean := diff / n / 257; mean > 16 {
+		t.Errorf("Expected both cells to match, they differ by %.1f on average", mean)
+	}
+
+	if _, err = Montage(nil, 2, 60, 0, ColorBlack); err == nil {
+		t.Error("Expected an error for no images")
+	}
+}
+
+func TestVipsImageMaxProcessingMemory(t *testing.T) {
+	// 1680x1050 RGB needs about 16MB
+	for budget, expected := range map[int64]error{1 << 20: ErrMaxProcessingMemoryExceeded, 64 << 20: nil} {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Width: 100, MaxProcessingMemory: budget})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = img.Process(); err != expected {
+			t.Errorf("Expected %v with a budget of %d, got %v", expected, budget, err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+func TestVipsImageTrimDetectsBackground(t *testing.T) {
+	if !(VipsMajorVersion >= 8 && VipsMinorVersion >= 6) {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.6", VipsVersion)
+	}
+
+	// A 120x90 white scan with a 60x40 page of text 30px in and 20px down
+	scan := image.NewRGBA(image.Rect(0, 0, 120, 90))
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 120; x++ {
+			scan.Set(x, y, color.White)
+			if x >= 30 && x < 90 && y >= 20 && y < 60 {
+				scan.Set(x, y, color.RGBA{40, 40, 40, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scan); err != nil {
+		t.Fatalf("Cannot encode the scan: %s", err)
+	}
+
+	img, err := NewVipsImage(&buf, Options{Trim: true, Threshold: 10})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	box, err := img.TrimBox()
+	if err != nil {
+		t.Fatalf("Cannot find the trim box: %s", err)
+	}
+	if expected := (ImageRect{Left: 30, Top: 20, Width: 60, Height: 40}); box != expected {
+		t.Errorf("Expected a trim box of %+v, got %+v", expected, box)
+	}
+
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if size, _ := img.Dimensions(); size.Width != 60 || size.Height != 40 {
+		t.Errorf("Expected the scan to be trimmed to 60x40, got %dx%d", size.Width, size.Height)
+	}
+}
+
+func TestVipsImageBadge(t *testing.T) {
+	photo := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			photo.Set(x, y, color.White)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, photo); err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+
+	img, err := NewVipsImage(&buf, Options{Type: PNG, Badge: Badge{
+		Text:       "PROOF",
+		Color:      Color{0, 0, 255, 0},
+		Background: Color{255, 0, 0, 0},
+		Radius:     8,
+		Padding:    20,
+		Gravity:    GravityNorth,
+		Margin:     10,
+	}})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(img.Buffer))
+	img.DecrementReferenceCount()
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+
+	// The top padding of the badge, centred 10px down
+	if r, g, b, _ := out.At(150, 20).RGBA(); r>>8 != 255 || g>>8 != 0 || b>>8 != 0 {
+		t.Errorf("Expected the badge background to be red, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+	// Outside the badge is untouched
+	if r, g, b, _ := out.At(150, 190).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 {
+		t.Errorf("Expected the photo to stay white below the badge, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+
+	// Somewhere below the padding there's a solid glyph pixel
+	glyph := false
+	for y := 30; y < 200 && !glyph; y++ {
+		for x := 0; x < 300 && !glyph; x++ {
+			r, g, b, _ := out.At(x, y).RGBA()
+			glyph = r>>8 < 32 && g>>8 < 32 && b>>8 > 224
+		}
+	}
+	if !glyph {
+		t.Error("Expected a blue text glyph on the badge")
+	}
+}
+
+func TestVipsImageSaveWithSSIM(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	buf, quality, err := img.SaveWithSSIM(0.95, Options{Width: 300, Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if DetermineImageType(buf) != JPEG {
+		t.Fatalf("Expected a jpeg, got %s", DetermineImageTypeName(buf))
+	}
+
+	ssim := func(buf []byte) float64 {
+		decoded, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the saved image: %s", err)
+		}
+		defer decoded.DecrementReferenceCount()
+		s, err := img.vipsSSIM(decoded)
+		if err != nil {
+			t.Fatalf("Cannot measure the SSIM: %s", err)
+		}
+		return s
+	}
+	if s := ssim(buf); s < 0.95 {
+		t.Errorf("Expected an SSIM of at least 0.95 at quality %d, got %f", quality, s)
+	}
+
+	// One step lower misses the target
+	if quality > 1 {
+		lower, _, err := img.encodeWithSSIM(quality - 1)
+		if err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		if s := ssim(lower); s >= 0.95 {
+			t.Errorf("Expected quality %d to miss the target, got an SSIM of %f", quality-1, s)
+		}
+	}
+
+	if _, _, err = img.SaveWithSSIM(1.5, Options{Type: JPEG}); err == nil {
+		t.Error("Expected an error for a target above 1")
+	}
+}
+
+func TestVipsImageFirstFrameOnly(t *testing.T) {
+	buf := longAnimation(t, 5)
+
+	img, err := NewVipsImage(bytes.NewBuffer(buf), Options{FirstFrameOnly: true})
+	if err != nil {
+		t.Fatalf("Cannot read the animation: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if size, _ := img.Dimensions(); size.Height != 128 {
+		t.Errorf("Expected only the first 128px frame, got a height of %d", size.Height)
+	}
+
+	if _, err = NewVipsImage(bytes.NewBuffer(buf), Options{FirstFrameOnly: true, AllPages: true}); err == nil {
+		t.Error("Expected an error with both FirstFrameOnly and AllPages")
+	}
+}
+
+func TestVipsImageCropLargerThanImage(t *testing.T) {
+	small := func() *VipsImage {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 100, 60))); err != nil {
+			t.Fatalf("Cannot encode the image: %s", err)
+		}
+		img, err := NewVipsImage(buf, Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		return img
+	}
+
+	// Wider than the image, so the crop is clamped to its width rather than starting at a negative left
+	for _, test := range []struct {
+		options       Options
+		width, height int
+	}{
+		{Options{Crop: true, Width: 200, Height: 40, Gravity: GravitySouth}, 100, 40},
+		{Options{Crop: true, Embed: true, Width: 200, Height: 40, Gravity: GravitySouth}, 200, 40},
+	} {
+		img := small()
+		cropped, err := img.extractOrEmbedImage(test.options)
+		if err != nil {
+			t.Fatalf("Cannot crop with %+v: %s", test.options, err)
+		}
+		if size, _ := cropped.Dimensions(); size.Width != test.width || size.Height != test.height {
+			t.Errorf("Expected %dx%d with %+v, got %dx%d", test.width, test.height, test.options, size.Width, size.Height)
+		}
+		cropped.DecrementReferenceCount()
+		img.DecrementReferenceCount()
+	}
+
+	// Through Process an image smaller both ways is left at its own size
+	img := small()
+	defer img.DecrementReferenceCount()
+	img.Options = Options{Crop: true, Width: 200, Height: 200, Type: PNG}
+	if err := img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if size, _ := img.Dimensions(); size.Width != 100 || size.Height != 60 {
+		t.Errorf("Expected the image to stay 100x60, got %dx%d", size.Width, size.Height)
+	}
+}
+
+func TestVipsImageFocalCrop(t *testing.T) {
+	// Black, with the top-right corner marked green
+	picture := flatImage(200, 100, color.Black)
+	picture.Set(150, 0, color.RGBA{0, 255, 0, 255})
+	img, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, picture)), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	// Centred on the focal point the crop would go over the top and right edges, so it's moved into the corner
+	cropped, err := img.extractOrEmbedImage(Options{Crop: true, Width: 50, Height: 50, Gravity: GravityFocal, FocalX: 0.98, FocalY: 0.02})
+	if err != nil {
+		t.Fatalf("Cannot crop the image: %s", err)
+	}
+	defer cropped.DecrementReferenceCount()
+	if size, _ := cropped.Dimensions(); size.Width != 50 || size.Height != 50 {
+		t.Errorf("Expected a 50x50 crop, got %dx%d", size.Width, size.Height)
+	}
+	if corner, _ := cropped.vipsCornerColor(); corner != (Color{0, 255, 0, 0}) {
+		t.Errorf("Expected the crop to start at the green 150,0, got a corner of %+v", corner)
+	}
+
+	if left, top := calculateFocalCrop(200, 100, 50, 50, 0.5, 0.5); left != 75 || top != 25 {
+		t.Errorf("Expected a centred focal point to crop from 75,25, got %d,%d", left, top)
+	}
+	if _, err = img.extractOrEmbedImage(Options{Crop: true, Width: 50, Height: 50, Gravity: GravityFocal, FocalX: 1.5}); err == nil {
+		t.Error("Expected an error for a focal point outside 0 to 1")
+	}
+}
+
+func TestVipsImageSmartCropStrategy(t *testing.T) {
+	if VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.8", VipsVersion)
+	}
+
+	// A flat skin tone on the left for attention, faint grey noise on the right for entropy
+	random := rand.New(rand.NewSource(1))
+	picture := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			switch {
+			case x < 100:
+				picture.Set(x, y, color.RGBA{224, 172, 138, 255})
+			case x >= 300:
+				v := uint8(120 + random.Intn(16))
+				picture.Set(x, y, color.RGBA{v, v, v, 255})
+			default:
+				picture.Set(x, y, color.RGBA{128, 128, 128, 255})
+			}
+		}
+	}
+	buf := encodePNG(t, picture)
+
+	crop := func(strategy SmartCropStrategy) ImageRect {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{SmartCropStrategy: strategy})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		rect, err := img.SmartCropRect(100, 100)
+		if err != nil {
+			t.Fatalf("Cannot smart crop the image: %s", err)
+		}
+		return rect
+	}
+	attention := crop(SmartCropAttention)
+	entropy := crop(SmartCropEntropy)
+	if attention.Left >= entropy.Left {
+		t.Errorf("Expected attention to crop left of entropy, got %d and %d", attention.Left, entropy.Left)
+	}
+
+	var o Options
+	if err := json.Unmarshal([]byte(`{"SmartCropStrategy": "entropy"}`), &o); err != nil || o.SmartCropStrategy != SmartCropEntropy {
+		t.Errorf("Expected the entropy strategy from JSON, got %d, %v", o.SmartCropStrategy, err)
+	}
+}
+
+// stubFaceDetector finds the same faces in every image.
+type stubFaceDetector struct {
+	faces []ImageRect
+}
+
+func (d stubFaceDetector) DetectFaces(img *VipsImage) ([]ImageRect, error) {
+	return d.faces, nil
+}
+
+func TestVipsImageCropToFaces(t *testing.T) {
+	buf := encodePNG(t, image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	crop := func(detector FaceDetector) ImageRect {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		rect, err := img.CropToFaces(100, 100, detector)
+		if err != nil {
+			t.Fatalf("Cannot crop to the faces: %s", err)
+		}
+		if size, _ := img.Dimensions(); size.Width != 100 || size.Height != 100 {
+			t.Errorf("Expected a 100x100 crop, got %dx%d", size.Width, size.Height)
+		}
+		return rect
+	}
+
+	// Centred on the face at 280,70
+	rect := crop(stubFaceDetector{[]ImageRect{{Left: 250, Top: 40, Width: 60, Height: 60}}})
+	if rect != (ImageRect{Left: 230, Top: 20, Width: 100, Height: 100}) {
+		t.Errorf("Expected the crop to centre on the face, got %+v", rect)
+	}
+	// Two faces are centred on the box around both, and kept inside the image
+	rect = crop(stubFaceDetector{[]ImageRect{{Left: 300, Top: 0, Width: 40, Height: 40}, {Left: 360, Top: 20, Width: 40, Height: 40}}})
+	if rect != (ImageRect{Left: 300, Top: 0, Width: 100, Height: 100}) {
+		t.Errorf("Expected the crop to cover both faces in the top-right corner, got %+v", rect)
+	}
+
+	if VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skipf("Skipping the smart crop fallback, libvips doesn't meet version requirement %s >= 8.8", VipsVersion)
+	}
+	crop(stubFaceDetector{})
+}
+
+func TestVipsImageExtractBand(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, flatImage(20, 10, color.RGBA{10, 200, 30, 255}))), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	bands := img.Bands()
+
+	green, err := img.ExtractBand(1, 1)
+	if err != nil {
+		t.Fatalf("Cannot extract the green band: %s", err)
+	}
+	defer green.DecrementReferenceCount()
+	if green.Bands() != 1 {
+		t.Errorf("Expected a single band, got %d", green.Bands())
+	}
+	if img.Bands() != bands {
+		t.Errorf("Expected the source to keep its %d bands, got %d", bands, img.Bands())
+	}
+	decoded, err := png.Decode(bytes.NewReader(green.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the band: %s", err)
+	}
+	if grey := color.GrayModel.Convert(decoded.At(5, 5)).(color.Gray); grey.Y != 200 {
+		t.Errorf("Expected the green value 200, got %d", grey.Y)
+	}
+
+	for _, c := range []struct{ start, n int }{{bands, 1}, {1, bands}, {-1, 1}, {0, 0}} {
+		if _, err = img.ExtractBand(c.start, c.n); err == nil {
+			t.Errorf("Expected an error extracting %d bands from band %d of %d", c.n, c.start, bands)
+		}
+	}
+}
+
+func TestVipsImageSaveAs(t *testing.T) {
+	save := func(suffix string, o Options) []byte {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if suffix == "" {
+			img.Options = o
+			if err = img.Process(); err != nil {
+				t.Fatalf("Cannot process the image: %s", err)
+			}
+			if err = img.Save(); err != nil {
+				t.Fatalf("Cannot save the image: %s", err)
+			}
+			return img.Buffer
+		}
+		buf, err := img.SaveAs(suffix, o)
+		if err != nil {
+			t.Fatalf("Cannot save the image as %s: %s", suffix, err)
+		}
+		return buf
+	}
+
+	buf := save("image.jpg[Q=50]", Options{Width: 400, Quality: 95})
+	if DetermineImageType(buf) != JPEG {
+		t.Fatalf("Expected a JPEG, got %s", DetermineImageTypeName(buf))
+	}
+	// The bracketed quality wins over Options.Quality, so it's about the size of a quality 50 save
+	expected := save("", Options{Width: 400, Type: JPEG, Quality: 50})
+	if ratio := float64(len(buf)) / float64(len(expected)); ratio < 0.8 || ratio > 1.2 {
+		t.Errorf("Expected about %d bytes for quality 50, got %d", len(expected), len(buf))
+	}
+	if high := save("image.jpg[Q=95]", Options{Width: 400}); len(high) <= len(buf) {
+		t.Errorf("Expected quality 95 to be larger than %d bytes, got %d", len(buf), len(high))
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if _, err = img.SaveAs("image.xyz", Options{}); err == nil {
+		t.Error("Expected an error for an unknown suffix")
+	}
+}
+
+func TestVipsImageResizeKeepsCMYK(t *testing.T) {
+	// A flat colour converted to a CMYK JPEG
+	picture := flatImage(200, 100, color.RGBA{200, 120, 60, 255})
+	source, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, picture)), Options{Type: JPEG, Interpretation: InterpretationCMYK})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer source.DecrementReferenceCount()
+	if err = source.vipsColourspace(InterpretationCMYK); err != nil {
+		t.Skipf("This libvips can't convert to CMYK: %s", err)
+	}
+	if err = source.Save(); err != nil {
+		t.Fatalf("Cannot save the CMYK JPEG: %s", err)
+	}
+	cmyk, err := jpeg.Decode(bytes.NewReader(source.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the CMYK JPEG: %s", err)
+	}
+	if _, ok := cmyk.(*image.CMYK); !ok {
+		t.Fatalf("Expected a CMYK JPEG to resize, got %T", cmyk)
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(source.Buffer), Options{Width: 100})
+	if err != nil {
+		t.Fatalf("Cannot read the CMYK JPEG: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	resized, err := jpeg.Decode(bytes.NewReader(img.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the resized image: %s", err)
+	}
+	out, ok := resized.(*image.CMYK)
+	if !ok {
+		t.Fatalf("Expected a 4 band CMYK JPEG, got %T", resized)
+	}
+	if size := out.Bounds().Size(); size.X != 100 || size.Y != 50 {
+		t.Errorf("Expected 100x50, got %dx%d", size.X, size.Y)
+	}
+	before := cmyk.(*image.CMYK).CMYKAt(100, 50)
+	after := out.CMYKAt(50, 25)
+	for i, pair := range [][2]uint8{{before.C, after.C}, {before.M, after.M}, {before.Y, after.Y}, {before.K, after.K}} {
+		if diff := int(pair[0]) - int(pair[1]); diff < -3 || diff > 3 {
+			t.Errorf("Expected channel %d to stay about %d, got %d", i, pair[0], pair[1])
+		}
+	}
+
+	// Asking for sRGB still converts
+	img, err = NewVipsImage(bytes.NewBuffer(source.Buffer), Options{Width: 100, Interpretation: InterpretationSRGB})
+	if err != nil {
+		t.Fatalf("Cannot read the CMYK JPEG: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if converted, err := jpeg.Decode(bytes.NewReader(img.Buffer)); err != nil {
+		t.Errorf("Cannot decode the converted image: %s", err)
+	} else if _, ok := converted.(*image.CMYK); ok {
+		t.Error("Expected an sRGB JPEG when asked for")
+	}
+}
+
+func TestVipsImagePremultiplyAlpha(t *testing.T) {
+	// A white square with hard edges on transparent black
+	logo := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for y := 25; y < 75; y++ {
+		for x := 25; x < 75; x++ {
+			logo.Set(x, y, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+
+	// The darkest red of any visible pixel once resized
+	darkest := func(premultiply bool) uint8 {
+		decoded := processPNG(t, logo, Options{Width: 33, PremultiplyAlpha: &premultiply})
+		min := uint8(255)
+		bounds := decoded.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+				if c.A > 16 && c.R < min {
+					min = c.R
+				}
+			}
+		}
+		return min
+	}
+
+	premultiplied := darkest(true)
+	if premultiplied < 245 {
+		t.Errorf("Expected no dark halo round the square, the darkest edge is %d", premultiplied)
+	}
+	if straight := darkest(false); straight >= premultiplied {
+		t.Errorf("Expected a darker edge without premultiplying, got %d against %d", straight, premultiplied)
+	}
+}
+
+func TestVipsImageMetadataPresetMinimal(t *testing.T) {
+	// Tag a JPEG with an ICC profile, an orientation, EXIF strings, a description and XMP
+	source, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer source.DecrementReferenceCount()
+	tags := map[string]string{
+		"exif-ifd0-Make":    "vimg",
+		"exif-ifd0-Artist":  "vimg",
+		"image-description": "A heavily tagged image",
+	}
+	for name, value := range tags {
+		if err = source.vipsImageSetString(name, value); err != nil {
+			t.Fatalf("Cannot set %s: %s", name, err)
+		}
+	}
+	if err = source.vipsImageSetInt("orientation", 6); err != nil {
+		t.Fatalf("Cannot set the orientation: %s", err)
+	}
+	if err = source.vipsSetBlob(VIPS_META_XMP_NAME, []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)); err != nil {
+		t.Fatalf("Cannot set the XMP: %s", err)
+	}
+	if err = source.Save(); err != nil {
+		t.Fatalf("Cannot save the tagged image: %s", err)
+	}
+	size, _ := source.Dimensions()
+
+	img, err := NewVipsImage(bytes.NewBuffer(source.Buffer), Options{MetadataPreset: MetadataMinimal, StripMetadata: true})
+	if err != nil {
+		t.Fatalf("Cannot read the tagged image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+
+	saved, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the saved image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+	if has, _ := saved.hasProfile(); !has {
+		t.Error("Expected the ICC profile to be kept")
+	}
+	// Auto-rotated, so the orientation is corrected to 1
+	if orientation, _ := saved.vipsExifOrientation(); orientation != 1 {
+		t.Errorf("Expected the corrected orientation 1, got %d", orientation)
+	}
+	if rotated, _ := saved.Dimensions(); rotated.Width != size.Height || rotated.Height != size.Width {
+		t.Errorf("Expected the image to be auto-rotated to %dx%d, got %dx%d", size.Height, size.Width, rotated.Width, rotated.Height)
+	}
+	header, err := saved.Header()
+	if err != nil {
+		t.Fatalf("Cannot read the header: %s", err)
+	}
+	for _, name := range []string{"exif-ifd0-Make", "exif-ifd0-Artist", "image-description", "xmp-data", "iptc-data"} {
+		if value, ok := header[name]; ok {
+			t.Errorf("Expected %s to be removed, got %q", name, value)
+		}
+	}
+}
+
+func TestVipsImageGrayscaleJPEG(t *testing.T) {
+	save := func(o Options) []byte {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), o)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return img.Buffer
+	}
+	colour := save(Options{Width: 300, Type: JPEG})
+	gray := save(Options{Width: 300, Type: JPEG, Grayscale: true})
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(gray))
+	if err != nil {
+		t.Fatalf("Cannot decode the greyscale JPEG: %s", err)
+	}
+	if config.ColorModel != color.GrayModel {
+		t.Errorf("Expected a single component JPEG, got %v", config.ColorModel)
+	}
+	if len(gray) >= len(colour) {
+		t.Errorf("Expected the greyscale JPEG to be smaller than the colour one, got %d >= %d", len(gray), len(colour))
+	}
+
+	// A greyscale source stays single component when resized or saved as is
+	img, err := NewVipsImage(bytes.NewBuffer(gray), Options{Width: 150})
+	if err != nil {
+		t.Fatalf("Cannot read the greyscale JPEG: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if config, err = jpeg.DecodeConfig(bytes.NewReader(img.Buffer)); err != nil {
+		t.Fatalf("Cannot decode the resized JPEG: %s", err)
+	}
+	if config.ColorModel != color.GrayModel || config.Width != 150 {
+		t.Errorf("Expected a 150px wide single component JPEG, got %dpx %v", config.Width, config.ColorModel)
+	}
+
+	img, err = NewVipsImage(bytes.NewBuffer(gray), Options{Type: JPEG})
+	if err != nil {
+		t.Fatalf("Cannot read the greyscale JPEG: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot save the image: %s", err)
+	}
+	if config, err = jpeg.DecodeConfig(bytes.NewReader(img.Buffer)); err != nil {
+		t.Fatalf("Cannot decode the saved JPEG: %s", err)
+	}
+	if config.ColorModel != color.GrayModel {
+		t.Errorf("Expected a single component JPEG, got %v", config.ColorModel)
+	}
+}
+
+func TestVipsImageCMYKProfileToSRGB(t *testing.T) {
+	if VipsMajorVersion == 8 && VipsMinorVersion < 14 {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.14", VipsVersion)
+	}
+
+	// The built in sRGB profile, to tag the swatch with
+	tagged, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{Type: PNG, OutputICC: "srgb"})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer tagged.DecrementReferenceCount()
+	if err = tagged.Save(); err != nil {
+		t.Fatalf("Cannot save with the sRGB profile: %s", err)
+	}
+	saved, err := NewVipsImage(bytes.NewBuffer(tagged.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot reload the image: %s", err)
+	}
+	defer saved.DecrementReferenceCount()
+	srgb, err := saved.GetICCProfile()
+	if err != nil {
+		t.Fatalf("Cannot read the sRGB profile: %s", err)
+	}
+
+	// A flat swatch turned into a CMYK JPEG with the built in CMYK profile embedded
+	want := color.RGBA{200, 120, 60, 255}
+	swatch, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, flatImage(64, 64, want))), Options{Type: JPEG, Quality: 95, OutputICC: "cmyk"})
+	if err != nil {
+		t.Fatalf("Cannot read the swatch: %s", err)
+	}
+	defer swatch.DecrementReferenceCount()
+	if err = swatch.SetICCProfile(srgb); err != nil {
+		t.Fatalf("Cannot tag the swatch: %s", err)
+	}
+	if err = swatch.Save(); err != nil {
+		t.Fatalf("Cannot save the CMYK swatch: %s", err)
+	}
+	if decoded, err := jpeg.Decode(bytes.NewReader(swatch.Buffer)); err != nil {
+		t.Fatalf("Cannot decode the CMYK swatch: %s", err)
+	} else if _, ok := decoded.(*image.CMYK); !ok {
+		t.Skipf("This libvips didn't write a CMYK JPEG, got %T", decoded)
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(swatch.Buffer), Options{Type: PNG})
+	if err != nil {
+		t.Fatalf("Cannot read the CMYK swatch: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Save(); err != nil {
+		t.Fatalf("Cannot convert the swatch: %s", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(img.Buffer))
+	if err != nil {
+		t.Fatalf("Cannot decode the converted swatch: %s", err)
+	}
+	got := color.RGBAModel.Convert(decoded.At(32, 32)).(color.RGBA)
+	for i, pair := range [][2]uint8{{want.R, got.R}, {want.G, got.G}, {want.B, got.B}} {
+		if diff := int(pair[0]) - int(pair[1]); diff < -8 || diff > 8 {
+			t.Errorf("Expected channel %d to come back about %d, got %d", i, pair[0], pair[1])
+		}
+	}
+}
+
+func TestVipsImageSaveToTempFile(t *testing.T) {
+	for _, typ := range []ImageType{PNG, TIFF} {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		path, cleanup, err := img.SaveToTempFile(Options{Width: 3000, Height: 2000, Force: true, Type: typ})
+		if err != nil {
+			t.Fatalf("Cannot save the image as %s: %s", ImageTypeName(typ), err)
+		}
+
+		saved, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Cannot read the saved file: %s", err)
+		}
+		width, height, savedType, err := DecodeConfig(saved)
+		if err != nil {
+			t.Fatalf("Cannot read the saved image: %s", err)
+		}
+		if width != 3000 || height != 2000 || savedType != typ {
+			t.Errorf("Expected a 3000x2000 %s, got a %dx%d %s", ImageTypeName(typ), width, height, ImageTypeName(savedType))
+		}
+
+		cleanup()
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected cleanup to remove %s, got %v", path, err)
+		}
+	}
+
+	// Savers fail on options they don't take, GIF has no quality
+	if options := vipsFileSaveOptions(vipsSaveOptions{Type: GIF, Quality: 80, StripMetadata: true}); options != "[strip]" {
+		t.Errorf("Expected only strip for a GIF, got %s", options)
+	}
+}
+
+func TestVipsImageRejectAnimated(t *testing.T) {
+	anim := &gif.GIF{}
+	for _, c := range []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}} {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{c}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("Cannot encode the animation: %s", err)
+	}
+
+	// Rejected whether just the first frame or all of them are loaded
+	for _, allPages := range []bool{false, true} {
+		img, err := NewVipsImage(bytes.NewBuffer(buf.Bytes()), Options{AllPages: allPages, Width: 32, Type: PNG, RejectAnimated: true})
+		if err != nil {
+			t.Fatalf("Cannot read the animation: %s", err)
+		}
+		if err = img.Process(); err != ErrAnimatedNotAllowed {
+			t.Errorf("Expected ErrAnimatedNotAllowed with AllPages %t, got %v", allPages, err)
+		}
+		img.DecrementReferenceCount()
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Width: 32, RejectAnimated: true})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Errorf("Expected a static image to pass, got %s", err)
+	}
+}
+
+func TestVipsImageKeepMetadata(t *testing.T) {
+	// A JPEG with an ICC profile and EXIF
+	source, err := NewVipsImage(bytes.NewBuffer(readFile("test_icc_prophoto.jpg")), Options{Type: JPEG, Quality: 90})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer source.DecrementReferenceCount()
+	if err = source.SetEXIFTag("exif-ifd0-Artist", "vimg"); err != nil {
+		t.Fatalf("Cannot set the artist: %s", err)
+	}
+	if err = source.Save(); err != nil {
+		t.Fatalf("Cannot save the tagged image: %s", err)
+	}
+
+	strip := func(keep []Blob) *VipsImage {
+		img, err := NewVipsImage(bytes.NewBuffer(source.Buffer), Options{StripMetadata: true, KeepMetadata: keep})
+		if err != nil {
+			t.Fatalf("Cannot read the tagged image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		saved, err := NewVipsImage(bytes.NewBuffer(img.Buffer), Options{})
+		if err != nil {
+			t.Fatalf("Cannot read the saved image: %s", err)
+		}
+		return saved
+	}
+
+	saved := strip([]Blob{VIPS_META_ICC_NAME})
+	defer saved.DecrementReferenceCount()
+	if hasProfile, _ := saved.hasProfile(); !hasProfile {
+		t.Error("Expected the ICC profile to be kept")
+	}
+	if artist, ok := saved.GetEXIFTag("exif-ifd0-Artist"); ok {
+		t.Errorf("Expected the EXIF to be stripped, got the artist %q", artist)
+	}
+
+	saved = strip([]Blob{VIPS_META_ICC_NAME, VIPS_META_EXIF_NAME})
+	defer saved.DecrementReferenceCount()
+	if hasProfile, _ := saved.hasProfile(); !hasProfile {
+		t.Error("Expected the ICC profile to be kept")
+	}
+	if artist, _ := saved.GetEXIFTag("exif-ifd0-Artist"); artist != "vimg" {
+		t.Errorf("Expected the artist to be kept, got %q", artist)
+	}
+
+	// Without KeepMetadata everything goes
+	saved = strip(nil)
+	defer saved.DecrementReferenceCount()
+	if hasProfile, _ := saved.hasProfile(); hasProfile {
+		t.Error("Expected the ICC profile to be stripped")
+	}
+
+	var o Options
+	if err = json.Unmarshal([]byte(`{"KeepMetadata": ["icc-profile-data", "exif-data"]}`), &o); err != nil {
+		t.Fatalf("Cannot unmarshal the options: %s", err)
+	}
+	if len(o.KeepMetadata) != 2 || o.KeepMetadata[0] != VIPS_META_ICC_NAME || o.KeepMetadata[1] != VIPS_META_EXIF_NAME {
+		t.Errorf("Expected the ICC profile and EXIF to be kept, got %v", o.KeepMetadata)
+	}
+	if err = json.Unmarshal([]byte(`{"KeepMetadata": ["gps"]}`), &o); err == nil {
+		t.Error("Expected an error for an unknown blob")
+	}
+}
+
+func TestVipsImageMaxAspectRatio(t *testing.T) {
+	img, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 10000)))), Options{Width: 1, MaxAspectRatio: 100})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != ErrMaxAspectRatioExceeded {
+		t.Errorf("Expected ErrMaxAspectRatioExceeded for a 1x10000 image, got %v", err)
+	}
+
+	img, err = NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), Options{Width: 100, MaxAspectRatio: 100})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		t.Errorf("Expected an ordinary image to pass, got %s", err)
+	}
+}
+
+func TestRecompressWebP(t *testing.T) {
+	if !IsTypeSupportedSave(WEBP) || VipsMajorVersion == 8 && VipsMinorVersion < 8 {
+		t.Skip("Saving WEBP with an effort is not supported")
+	}
+	encode := func(o Options) []byte {
+		img, err := NewVipsImage(bytes.NewBuffer(readFile("test.jpg")), o)
+		if err != nil {
+			t.Fatalf("Cannot read the image: %s", err)
+		}
+		defer img.DecrementReferenceCount()
+		if err = img.Process(); err != nil {
+			t.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			t.Fatalf("Cannot save the image: %s", err)
+		}
+		return img.Buffer
+	}
+	one := 1
+	source := encode(Options{Width: 600, Type: WEBP, WebPEffort: &one})
+
+	out, err := RecompressWebP(source, 6)
+	if err != nil {
+		t.Fatalf("Cannot recompress the image: %s", err)
+	}
+	if len(out) >= len(source) {
+		t.Errorf("Expected effort 6 to be smaller than effort 1, got %d >= %d", len(out), len(source))
+	}
+	if isLosslessWebP(out) {
+		t.Error("Expected a lossy WEBP to stay lossy")
+	}
+
+	before, err := NewVipsImage(bytes.NewBuffer(source), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the source: %s", err)
+	}
+	defer before.DecrementReferenceCount()
+	after, err := NewVipsImage(bytes.NewBuffer(out), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the recompressed image: %s", err)
+	}
+	defer after.DecrementReferenceCount()
+	if ssim, err := before.vipsSSIM(after); err != nil {
+		t.Fatalf("Cannot compare the images: %s", err)
+	} else if ssim <= 0.99 {
+		t.Errorf("Expected an SSIM over 0.99, got %f", ssim)
+	}
+
+	lossless := encode(Options{Width: 200, Type: WEBP, Lossless: true, WebPEffort: &one})
+	if out, err = RecompressWebP(lossless, 6); err != nil {
+		t.Fatalf("Cannot recompress the lossless image: %s", err)
+	}
+	if !isLosslessWebP(out) {
+		t.Error("Expected a lossless WEBP to stay lossless")
+	}
+
+	if _, err = RecompressWebP(readFile("test.jpg"), 6); err == nil {
+		t.Error("Expected an error for a JPEG")
+	}
+	if _, err = RecompressWebP(source, 7); err == nil {
+		t.Error("Expected an error for effort 7")
+	}
+}
+
+func TestVipsImageFlattenTo(t *testing.T) {
+	if !IsTypeSupportedSave(WEBP) {
+		t.Skip("Saving WEBP is not supported")
+	}
+	// Half transparent red as a WebP
+	picture := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			picture.Set(x, y, color.NRGBA{255, 0, 0, 128})
+		}
+	}
+	source, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, picture)), Options{Type: WEBP, Lossless: true})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer source.DecrementReferenceCount()
+	if err = source.Save(); err != nil {
+		t.Fatalf("Cannot save the WebP: %s", err)
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(source.Buffer), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the WebP: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	out, err := img.FlattenTo(Color{128, 128, 128, 255}, JPEG)
+	if err != nil {
+		t.Fatalf("Cannot flatten the image: %s", err)
+	}
+	if DetermineImageType(out) != JPEG {
+		t.Fatalf("Expected a JPEG, got %s", DetermineImageTypeName(out))
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Cannot decode the JPEG: %s", err)
+	}
+	// Half of each, allowing for the JPEG
+	got := color.RGBAModel.Convert(decoded.At(16, 16)).(color.RGBA)
+	for i, pair := range [][2]uint8{{191, got.R}, {64, got.G}, {64, got.B}} {
+		if diff := int(pair[0]) - int(pair[1]); diff < -8 || diff > 8 {
+			t.Errorf("Expected channel %d to be about %d, got %d", i, pair[0], pair[1])
+		}
+	}
+
+	// Greyscale with alpha onto a colour
+	img, err = NewVipsImage(bytes.NewBuffer(encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 8, 8)))), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.vipsColourspace(InterpretationBW); err != nil {
+		t.Fatalf("Cannot convert the image to greyscale: %s", err)
+	}
+	if out, err = img.FlattenTo(Color{0, 0, 255, 255}, PNG); err != nil {
+		t.Fatalf("Cannot flatten the greyscale image: %s", err)
+	}
+	flat, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Cannot decode the PNG: %s", err)
+	}
+	if got := color.RGBAModel.Convert(flat.At(4, 4)).(color.RGBA); got != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("Expected the transparent greyscale image flattened onto blue, got %v", got)
+	}
+}
+
+func TestVipsImageOrientations(t *testing.T) {
+	// Every pixel different, so any wrong rotation or mirror shows
+	const width, height = 5, 3
+	picture := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			picture.SetGray(x, y, color.Gray{uint8(10 + 15*(y*width+x))})
+		}
+	}
+
+	// Where each pixel of the corrected image comes from in the stored one
+	cases := []struct {
+		orientation int
+		source      func(x, y int) (int, int)
+	}{
+		{1, func(x, y int) (int, int) { return x, y }},
+		{2, func(x, y int) (int, int) { return width - 1 - x, y }},
+		{3, func(x, y int) (int, int) { return width - 1 - x, height - 1 - y }},
+		{4, func(x, y int) (int, int) { return x, height - 1 - y }},
+		{5, func(x, y int) (int, int) { return y, x }},
+		{6, func(x, y int) (int, int) { return y, height - 1 - x }},
+		{7, func(x, y int) (int, int) { return width - 1 - y, height - 1 - x }},
+		{8, func(x, y int) (int, int) { return width - 1 - y, x }},
+	}
+	for _, c := range cases {
+		out := processPNG(t, picture, Options{ForceOrientation: c.orientation})
+
+		outWidth, outHeight := width, height
+		if c.orientation >= 5 {
+			outWidth, outHeight = height, width
+		}
+		if size := out.Bounds().Size(); size.X != outWidth || size.Y != outHeight {
+			t.Errorf("Expected orientation %d to be %dx%d, got %dx%d", c.orientation, outWidth, outHeight, size.X, size.Y)
+			continue
+		}
+		for y := 0; y < outHeight; y++ {
+			for x := 0; x < outWidth; x++ {
+				sx, sy := c.source(x, y)
+				want := picture.GrayAt(sx, sy).Y
+				if got := color.GrayModel.Convert(out.At(x, y)).(color.Gray).Y; got != want {
+					t.Errorf("Expected orientation %d pixel %d,%d to be %d, got %d", c.orientation, x, y, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestVipsImagePDFPageAndDPI(t *testing.T) {
+	if !IsTypeSupported(PDF) || VipsMajorVersion == 8 && VipsMinorVersion < 7 {
+		t.Skip("PDF loading at a DPI is not supported")
+	}
+	buf := testPDF(3)
+
+	// The second page of 72x144 points, at 72 DPI a pixel a point
+	sizes := map[float64]ImageSize{0: {72, 144}, 72: {72, 144}, 150: {150, 300}}
+	for dpi, expected := range sizes {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{Page: 1, PDFDPI: dpi})
+		if err != nil {
+			t.Fatalf("Cannot read the PDF at %g DPI: %s", dpi, err)
+		}
+		size, _ := img.Dimensions()
+		img.DecrementReferenceCount()
+		if size != expected {
+			t.Errorf("Expected %dx%d at %g DPI, got %dx%d", expected.Width, expected.Height, dpi, size.Width, size.Height)
+		}
+	}
+
+	// Rendering again to a width keeps the page and DPI
+	img, err := NewVipsImage(bytes.NewBuffer(buf), Options{Page: 2, PDFDPI: 150})
+	if err != nil {
+		t.Fatalf("Cannot read the PDF: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.RenderVectorToWidth(300); err != nil {
+		t.Fatalf("Cannot render the PDF: %s", err)
+	}
+	if size, _ := img.Dimensions(); size.Width != 300 || size.Height != 600 {
+		t.Errorf("Expected 300x600, got %dx%d", size.Width, size.Height)
+	}
+
+	for _, o := range []Options{{Page: 3}, {Page: -1}, {PDFDPI: -72}} {
+		if img, err := NewVipsImage(bytes.NewBuffer(buf), o); err == nil {
+			img.DecrementReferenceCount()
+			t.Errorf("Expected an error for page %d at %g DPI", o.Page, o.PDFDPI)
+		}
+	}
+}
+
+func TestVipsImageTrimWithInfo(t *testing.T) {
+	if !(VipsMajorVersion >= 8 && VipsMinorVersion >= 6) {
+		t.Skipf("Skipping this test, libvips doesn't meet version requirement %s >= 8.6", VipsVersion)
+	}
+
+	// A 100x80 white border 10px on the left, 25px on the right, 5px at the top and 20px at the bottom
+	scan := image.NewRGBA(image.Rect(0, 0, 100, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 100; x++ {
+			scan.Set(x, y, color.White)
+			if x >= 10 && x < 75 && y >= 5 && y < 60 {
+				scan.Set(x, y, color.RGBA{40, 40, 40, 255})
+			}
+		}
+	}
+	img, err := NewVipsImage(bytes.NewBuffer(encodePNG(t, scan)), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+
+	info, err := img.TrimWithInfo(Color{255, 255, 255, 255}, 10)
+	if err != nil {
+		t.Fatalf("Cannot trim the image: %s", err)
+	}
+	expected := TrimInfo{
+		Top:          5,
+		Bottom:       20,
+		Left:         10,
+		Right:        25,
+		OriginalSize: ImageSize{Width: 100, Height: 80},
+		TrimmedSize:  ImageSize{Width: 65, Height: 55},
+	}
+	if info != expected {
+		t.Errorf("Expected %+v, got %+v", expected, info)
+	}
+	if size, _ := img.Dimensions(); size != expected.TrimmedSize {
+		t.Errorf("Expected the image to be trimmed to 65x55, got %dx%d", size.Width, size.Height)
+	}
+
+	// Only the dark page is left, so trimming it as the background leaves nothing
+	if _, err = img.TrimWithInfo(Color{40, 40, 40, 255}, 10); err == nil {
+		t.Error("Expected an error for an image that's all background")
+	}
+}
+
+func TestVipsImageSVGScale(t *testing.T) {
+	if !IsTypeSupported(SVG) {
+		t.Skip("SVG loading is not supported")
+	}
+	buf := readFile("test.svg")
+	if !IsSVGImage(buf) {
+		t.Fatal("Expected test.svg to be detected as an SVG")
+	}
+
+	img, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+	if err != nil {
+		t.Fatalf("Cannot read the SVG: %s", err)
+	}
+	native, _ := img.Dimensions()
+	img.DecrementReferenceCount()
+
+	// Twice the scale or twice the density is twice the size, give or take the renderer's rounding
+	for _, o := range []Options{{SVGScale: 2}, {SVGDPI: 144}} {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), o)
+		if err != nil {
+			t.Fatalf("Cannot read the SVG with %+v: %s", o, err)
+		}
+		size, _ := img.Dimensions()
+		if img.Type != SVG {
+			t.Errorf("Expected an SVG, got %s", ImageTypeName(img.Type))
+		}
+		img.DecrementReferenceCount()
+		if math.Abs(float64(size.Width-2*native.Width)) > 1 || math.Abs(float64(size.Height-2*native.Height)) > 1 {
+			t.Errorf("Expected about %dx%d with scale %g and DPI %g, got %dx%d", 2*native.Width, 2*native.Height, o.SVGScale, o.SVGDPI, size.Width, size.Height)
+		}
+	}
+
+	if img, err := NewVipsImage(bytes.NewBuffer(buf), Options{SVGScale: -1}); err == nil {
+		img.DecrementReferenceCount()
+		t.Error("Expected an error for a negative scale")
+	}
+}
+
+func TestVipsImageWatermarkRotate(t *testing.T) {
+	page := flatImage(300, 300, color.White)
+
+	// The spread of the dark text pixels, the bounding box and the correlation of their x and y
+	stamp := func(rotate float64) (float64, float64) {
+		out := processPNG(t, page, Options{Watermark: Watermark{
+			Text:        "DRAFT",
+			Font:        "sans bold 40",
+			Width:       240,
+			DPI:         72,
+			NoReplicate: true,
+			Background:  Color{0, 0, 0, 255},
+			Rotate:      rotate,
+		}})
+
+		var n, sx, sy, sxx, syy, sxy float64
+		minX, minY, maxX, maxY := 300, 300, 0, 0
+		for y := 0; y < 300; y++ {
+			for x := 0; x < 300; x++ {
+				if r, _, _, _ := out.At(x, y).RGBA(); r>>8 >= 128 {
+					continue
+				}
+				fx, fy := float64(x), float64(y)
+				n, sx, sy, sxx, syy, sxy = n+1, sx+fx, sy+fy, sxx+fx*fx, syy+fy*fy, sxy+fx*fy
+				minX, minY = int(math.Min(float64(minX), fx)), int(math.Min(float64(minY), fy))
+				maxX, maxY = int(math.Max(float64(maxX), fx)), int(math.Max(float64(maxY), fy))
+			}
+		}
+		if n == 0 {
+			t.Fatalf("Expected the watermark to be drawn at %g degrees", rotate)
+		}
+		aspect := float64(maxY-minY+1) / float64(maxX-minX+1)
+		correlation := (sxy/n - sx/n*sy/n) / math.Sqrt((sxx/n-sx/n*sx/n)*(syy/n-sy/n*sy/n))
+		return aspect, correlation
+	}
+
+	if aspect, _ := stamp(0); aspect > 0.5 {
+		t.Errorf("Expected upright text to be wide and short, got a height to width of %.2f", aspect)
+	}
+	// Clockwise with y down runs from top left to bottom right
+	if aspect, correlation := stamp(45); aspect < 0.7 || aspect > 1.4 || correlation < 0.5 {
+		t.Errorf("Expected diagonal text, got a height to width of %.2f and a correlation of %.2f", aspect, correlation)
+	}
+}
+
+func TestVipsImageEstimateOutputSize(t *testing.T) {
+	if q := jpegQuality(readFile("test_square.jpg")); q != 90 {
+		t.Errorf("Expected test_square.jpg to be quality 90, got %d", q)
+	}
+
+	for _, file := range []string{"test.jpg", "northern_cardinal_bird.jpg", "test_square.jpg", "exif/Landscape_1.jpg"} {
+		for _, width := range []int{0, 400} {
+			o := Options{Type: JPEG, Quality: 80, Width: width}
+			img, err := NewVipsImage(bytes.NewBuffer(readFile(file)), o)
+			if err != nil {
+				t.Fatalf("Cannot read %s: %s", file, err)
+			}
+			estimate, err := img.EstimateOutputSize(o)
+			if err != nil {
+				t.Fatalf("Cannot estimate %s: %s", file, err)
+			}
+			if err = img.Process(); err != nil {
+				t.Fatalf("Cannot process %s: %s", file, err)
+			}
+			if err = img.Save(); err != nil {
+				t.Fatalf("Cannot save %s: %s", file, err)
+			}
+			actual := len(img.Buffer)
+			img.DecrementReferenceCount()
+
+			if ratio := float64(estimate) / float64(actual); ratio < 0.5 || ratio > 2 {
+				t.Errorf("Expected %s %d wide to be estimated within a factor of 2 of %d bytes, got %d", file, width, actual, estimate)
+			}
+		}
+	}
+}
+
+func TestVipsImageWatermarkImageTile(t *testing.T) {
+	page := flatImage(400, 400, color.White)
+	// A red square in the middle of a transparent 40x40 tile
+	mark := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for y := 10; y < 30; y++ {
+		for x := 10; x < 30; x++ {
+			mark.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+
+	// Red pixels in each quadrant, top left, top right, bottom left then bottom right
+	quadrants := func(tile bool) [4]int {
+		out := processPNG(t, page, Options{WatermarkImage: WatermarkImage{
+			Buf:     encodePNG(t, mark),
+			Width:   40,
+			Opacity: 1,
+			HAlign:  PositionLeft,
+			VAlign:  PositionTop,
+			HOffset: 10,
+			VOffset: 10,
+			Tile:    tile,
+		}})
+		if size := out.Bounds().Size(); size.X != 400 || size.Y != 400 {
+			t.Fatalf("Expected 400x400, got %dx%d", size.X, size.Y)
+		}
+
+		var counts [4]int
+		for y := 0; y < 400; y++ {
+			for x := 0; x < 400; x++ {
+				if r, g, b, _ := out.At(x, y).RGBA(); r>>8 > 200 && g>>8 < 50 && b>>8 < 50 {
+					counts[x/200+2*(y/200)]++
+				}
+			}
+		}
+		return counts
+	}
+
+	if counts := quadrants(false); counts[0] == 0 || counts[1]+counts[2]+counts[3] != 0 {
+		t.Errorf("Expected a single watermark in the top left quadrant, got red pixels %v", counts)
+	}
+	for n, count := range quadrants(true) {
+		if count == 0 {
+			t.Errorf("Expected the tiled watermark in quadrant %d", n)
+		}
+	}
+}
+
+// Rotating fetches an intermediate buffer in the source format before resizing
+func BenchmarkRotateResizeWebp(b *testing.B) {
+	buf := readFile("test.webp")
+
+	for n := 0; n < b.N; n++ {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{Rotate: D90, Width: 200, Height: 200})
+		if err != nil {
+			b.Fatalf("Cannot read the image: %s", err)
+		}
+		err = img.Process()
+		if err != nil {
+			b.Fatalf("Cannot process the image: %s", err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+// A 200px thumbnail of a PDF page, rendered at the smaller scale by shrink-on-load
+func BenchmarkThumbnailPdf(b *testing.B) {
+	buf := readFile("test.pdf")
+
+	for n := 0; n < b.N; n++ {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{Width: 200, Type: JPEG})
+		if err != nil {
+			b.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = img.Process(); err != nil {
+			b.Fatalf("Cannot process the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			b.Fatalf("Cannot save the image: %s", err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+// The same thumbnail rendering the page at full size then shrinking it, for comparison
+func BenchmarkThumbnailPdfRenderThenShrink(b *testing.B) {
+	buf := readFile("test.pdf")
+
+	for n := 0; n < b.N; n++ {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{Type: JPEG})
+		if err != nil {
+			b.Fatalf("Cannot read the image: %s", err)
+		}
+		if err = img.vipsResize(200/float64(img.Image.Xsize), Bicubic); err != nil {
+			b.Fatalf("Cannot resize the image: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			b.Fatalf("Cannot save the image: %s", err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+// Pooled images are acquired and freed for every request, so their allocations add up
+func BenchmarkVipsImagePoolChurn(b *testing.B) {
+	buf := readFile("test.png")
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), Options{})
+		if err != nil {
+			b.Fatalf("Cannot read the image: %s", err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+// A 64px thumbnail of a 100 frame GIF decodes a single frame
+func BenchmarkThumbnailAnimationFirstFrame(b *testing.B) {
+	benchmarkThumbnailAnimation(b, Options{Width: 64, Type: JPEG, FirstFrameOnly: true})
+}
+
+// The same thumbnail from every frame, stacked, for comparison
+func BenchmarkThumbnailAnimationAllPages(b *testing.B) {
+	benchmarkThumbnailAnimation(b, Options{Width: 64, Type: JPEG, AllPages: true})
+}
+
+func benchmarkThumbnailAnimation(b *testing.B, o Options) {
+	buf := longAnimation(b, 100)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		img, err := NewVipsImage(bytes.NewBuffer(buf), o)
+		if err != nil {
+			b.Fatalf("Cannot read the animation: %s", err)
+		}
+		if err = img.Process(); err != nil {
+			b.Fatalf("Cannot process the animation: %s", err)
+		}
+		if err = img.Save(); err != nil {
+			b.Fatalf("Cannot save the animation: %s", err)
+		}
+		img.DecrementReferenceCount()
+	}
+}
+
+// longAnimation encodes a GIF of the given number of 128x128 frames of noise, so they don't compress away.
+func longAnimation(tb testing.TB, frames int) []byte {
+	random := rand.New(rand.NewSource(1))
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 128, 128), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(random.Intn(len(palette)))
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 4)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		tb.Fatalf("Cannot encode the animation: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// flatImage returns a width x height picture filled with c.
+func flatImage(width, height int, c color.Color) *image.RGBA {
+	picture := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			picture.Set(x, y, c)
+		}
+	}
+	return picture
+}
+
+// encodePNG encodes picture as a PNG to read as a test image.
+func encodePNG(tb testing.TB, picture image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, picture); err != nil {
+		tb.Fatalf("Cannot encode the image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// processPNG reads picture as a PNG with o, processes and saves it as a PNG, and decodes the result.
+func processPNG(tb testing.TB, picture image.Image, o Options) image.Image {
+	o.Type = PNG
+	img, err := NewVipsImage(bytes.NewBuffer(encodePNG(tb, picture)), o)
+	if err != nil {
+		tb.Fatalf("Cannot read the image: %s", err)
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		tb.Fatalf("Cannot process the image: %s", err)
+	}
+	if err = img.Save(); err != nil {
+		tb.Fatalf("Cannot save the image: %s", err)
+	}
+	out, err := png.Decode(bytes.NewReader(img.Buffer))
+	if err != nil {
+		tb.Fatalf("Cannot decode the image: %s", err)
+	}
+	return out
+}
+
 func BenchmarkResizeLargeJpeg(b *testing.B) {
 	options := Options{
 		Width:  800,
@@ -0,0 +1,116 @@
+package vimg
+
+/*
+#cgo pkg-config: vips
+#include "vips/vips.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// ErrWorkerClosed is returned by Worker.Submit once the worker has been closed.
+var ErrWorkerClosed = errors.New("Worker is closed")
+
+// Worker processes and saves images on a fixed pool of size goroutines, each locked to its own OS thread while the
+// worker runs. The per operation locks are off, so a VipsImage must only be used from one goroutine at a time; a
+// Worker gives each image one thread from load to save, so it's safe to call Submit from any number of goroutines,
+// with at most size images in libvips at once. The libvips error buffer is shared by the whole process, reading and
+// clearing it is serialized, but an error message can still include text from a failure on another thread.
+type Worker struct {
+	jobs   chan workerJob
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type workerJob struct {
+	buf    []byte
+	o      Options
+	result chan workerResult
+}
+
+type workerResult struct {
+	buf []byte
+	err error
+}
+
+// NewWorker starts a Worker with size threads, runtime.NumCPU() when size isn't positive. Close it to stop them.
+func NewWorker(size int) *Worker {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	w := &Worker{jobs: make(chan workerJob)}
+	w.wg.Add(size)
+	for n := 0; n < size; n++ {
+		go w.run()
+	}
+	return w
+}
+
+// Submit processes buf with o and returns the saved image, waiting for a free thread first.
+func (w *Worker) Submit(buf []byte, o Options) ([]byte, error) {
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return nil, ErrWorkerClosed
+	}
+	result := make(chan workerResult, 1)
+	w.jobs <- workerJob{buf: buf, o: o, result: result}
+	w.mu.RUnlock()
+
+	r := <-result
+	return r.buf, r.err
+}
+
+// Close waits for submitted images to finish and stops the threads, Submit fails after it.
+func (w *Worker) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (w *Worker) run() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer w.wg.Done()
+	// Free libvips' per thread state before the thread goes back to the scheduler
+	defer C.vips_thread_shutdown()
+
+	for job := range w.jobs {
+		buf, err := processAndSave(job.buf, job.o)
+		job.result <- workerResult{buf: buf, err: err}
+	}
+}
+
+// processAndSave loads, processes and saves buf with o. A panic is returned as the error, so one bad image doesn't
+// take down the thread processing the others.
+func processAndSave(buf []byte, o Options) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, fmt.Errorf("Processing the image panicked: %v", r)
+		}
+	}()
+
+	img, err := NewVipsImage(bytes.NewBuffer(buf), o)
+	if err != nil {
+		return nil, err
+	}
+	defer img.DecrementReferenceCount()
+	if err = img.Process(); err != nil {
+		return nil, err
+	}
+	if err = img.Save(); err != nil {
+		return nil, err
+	}
+	return img.Buffer, nil
+}
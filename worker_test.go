@@ -0,0 +1,49 @@
+package vimg
+
+import (
+	"sync"
+	"testing"
+)
+
+// Run with -race, the worker must keep the images apart
+func TestWorkerConcurrent(t *testing.T) {
+	w := NewWorker(4)
+	files := []string{"test.jpg", "test.png", "northern_cardinal_bird.jpg"}
+	bufs := make([][]byte, len(files))
+	for n, file := range files {
+		bufs[n] = readFile(file)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for n := 0; n < 64; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			width := 50 + n
+			buf, err := w.Submit(bufs[n%len(bufs)], Options{Width: width, Height: 40, Crop: true, Type: JPEG})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if got, height, typ, err := DecodeConfig(buf); err != nil || got != width || height != 40 || typ != JPEG {
+				t.Errorf("Expected a %dx40 JPEG, got a %dx%d %s (%v)", width, got, height, ImageTypeName(typ), err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Cannot process the image: %s", err)
+	}
+
+	// A bad image fails on its own
+	if _, err := w.Submit([]byte("not an image at all"), Options{}); err == nil {
+		t.Error("Expected an error for a buffer that isn't an image")
+	}
+
+	w.Close()
+	if _, err := w.Submit(bufs[0], Options{Width: 100}); err != ErrWorkerClosed {
+		t.Errorf("Expected ErrWorkerClosed from a closed worker, got %v", err)
+	}
+}